@@ -0,0 +1,178 @@
+// Anonymization of the remote addresses of web100 snapshot files, so that
+// the data of embargoed sites can be published at once in a form that does
+// not identify the clients. The member names only have the local (server)
+// IP, so only the content changes.
+package embargo
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/m-lab/etl-embargo/metrics"
+	"github.com/m-lab/etl/web100"
+)
+
+// Methods of anonymization.
+const (
+	// AnonymizeTruncate keeps the /24 of IPv4 and the /48 of IPv6 addresses.
+	AnonymizeTruncate = "truncate"
+	// AnonymizeHash replaces addresses with a keyed hash of the same family.
+	AnonymizeHash = "hash"
+)
+
+// AnonymizedPrefix is the directory, in the public archives, of the
+// anonymized copies of the embargoed members. It keeps their base names from
+// clashing with the originals once those are unembargoed.
+const AnonymizedPrefix = "anonymized/"
+
+// Anonymizer anonymizes the remote addresses of web100 files.
+type Anonymizer struct {
+	method string
+	key    []byte
+}
+
+// NewAnonymizer returns an Anonymizer using method, AnonymizeTruncate or
+// AnonymizeHash. The key is required to hash, and ignored to truncate.
+func NewAnonymizer(method string, key []byte) (*Anonymizer, error) {
+	switch method {
+	case AnonymizeTruncate:
+	case AnonymizeHash:
+		if len(key) == 0 {
+			return nil, fmt.Errorf("no key to hash addresses")
+		}
+	default:
+		return nil, fmt.Errorf("unknown anonymization method %q", method)
+	}
+	return &Anonymizer{method: method, key: key}, nil
+}
+
+// IP returns the anonymized ip, of the same family.
+func (a *Anonymizer) IP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if a.method == AnonymizeHash {
+		mac := hmac.New(sha256.New, a.key)
+		mac.Write(ip)
+		return net.IP(mac.Sum(nil)[:len(ip)])
+	}
+	if len(ip) == net.IPv4len {
+		return ip.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(48, 128))
+}
+
+// AnonymizeWeb100 returns a copy of the web100 snapshot file content, gzipped
+// or not, with its remote addresses anonymized. The rest of the file is
+// unchanged.
+func (a *Anonymizer) AnonymizeWeb100(content []byte) ([]byte, error) {
+	r, err := MemberReader(content)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	column := -1
+	for i, line := range lines {
+		text := strings.TrimSuffix(line, "\n")
+		fields := strings.Split(text, " ")
+		switch fields[0] {
+		case "K:":
+			column = -1
+			for j, name := range fields {
+				if name == "RemAddress" {
+					column = j
+				}
+			}
+			if column < 0 {
+				return nil, fmt.Errorf("line %d: no RemAddress variable", i+1)
+			}
+		case "C:":
+			if column < 0 || column >= len(fields) {
+				return nil, fmt.Errorf("line %d: no RemAddress value", i+1)
+			}
+			normalized, err := web100.NormalizeIPv6(fields[column])
+			ip := net.ParseIP(normalized)
+			if err != nil || ip == nil {
+				return nil, fmt.Errorf("line %d: bad RemAddress %q", i+1, fields[column])
+			}
+			fields[column] = formatIP(a.IP(ip))
+			lines[i] = strings.Join(fields, " ") + line[len(text):]
+		}
+	}
+	if column < 0 {
+		return nil, errNoSnapshot
+	}
+	anonymized := []byte(strings.Join(lines, ""))
+
+	codec := DetectCodec(content)
+	if codec == nil || len(codec.Magic) == 0 {
+		return anonymized, nil
+	}
+	if codec.NewWriter == nil {
+		return nil, fmt.Errorf("cannot write %s members", codec.Name)
+	}
+	var buf bytes.Buffer
+	w, err := codec.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(anonymized); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SetAnonymizer sets the anonymizer of the embargoed web100 files. If it is
+// not nil, SplitFile adds an anonymized copy of the files embargoed because
+// their site is not whitelisted to the public output, under
+// AnonymizedPrefix. The files withheld or embargoed for their clients are
+// never published.
+func (ec *EmbargoConfig) SetAnonymizer(a *Anonymizer) {
+	ec.anonymizer = a
+}
+
+// addAnonymized adds an anonymized copy of the member hdr, of the given
+// content, to the public output. A member that cannot be anonymized is only
+// logged.
+func (ec *EmbargoConfig) addAnonymized(out *splitOutputs, hdr *tar.Header, content []byte) error {
+	anonymized, err := ec.anonymizer.AnonymizeWeb100(content)
+	if err != nil {
+		log.Printf("cannot anonymize %s: %v\n", hdr.Name, err)
+		metrics.AnonymizedFilesTotal.WithLabelValues("failed").Inc()
+		return nil
+	}
+	copied := *hdr
+	copied.Name = AnonymizedPrefix + hdr.Name
+	copied.Size = int64(len(anonymized))
+	if hdr.PAXRecords != nil {
+		// The records of the original name and size would override them.
+		copied.PAXRecords = make(map[string]string, len(hdr.PAXRecords))
+		for k, v := range hdr.PAXRecords {
+			if k != "path" && k != "size" {
+				copied.PAXRecords[k] = v
+			}
+		}
+	}
+	if err := out.public.add(&copied, anonymized); err != nil {
+		return err
+	}
+	out.stats.Sides.add("anonymized", int64(len(anonymized)))
+	metrics.AnonymizedFilesTotal.WithLabelValues("published").Inc()
+	return nil
+}
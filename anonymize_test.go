@@ -0,0 +1,151 @@
+package embargo_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+func TestAnonymizerIP(t *testing.T) {
+	truncate, err := embargo.NewAnonymizer(embargo.AnonymizeTruncate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{
+		"203.0.113.77":                  "203.0.113.0",
+		"2001:db8:1234:5678::1":         "2001:db8:1234::",
+		"::ffff:203.0.113.77":           "203.0.113.0",
+		"2001:db8:1234:ffff:ffff::ffff": "2001:db8:1234::",
+	} {
+		if got := truncate.IP(net.ParseIP(ip)).String(); got != want {
+			t.Errorf("truncated IP(%s) = %s, want %s", ip, got, want)
+		}
+	}
+
+	hash, err := embargo.NewAnonymizer(embargo.AnonymizeHash, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := embargo.NewAnonymizer(embargo.AnonymizeHash, []byte("other key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"203.0.113.77", "2001:db8::1"} {
+		got := hash.IP(net.ParseIP(ip))
+		if (got.To4() != nil) != (net.ParseIP(ip).To4() != nil) {
+			t.Errorf("hashed IP(%s) = %s, of another family", ip, got)
+		}
+		if !got.Equal(hash.IP(net.ParseIP(ip))) {
+			t.Errorf("hashed IP(%s) is not stable", ip)
+		}
+		if got.Equal(other.IP(net.ParseIP(ip))) || got.Equal(net.ParseIP(ip)) {
+			t.Errorf("hashed IP(%s) = %s, which does not depend on the key", ip, got)
+		}
+	}
+
+	if _, err := embargo.NewAnonymizer(embargo.AnonymizeHash, nil); err == nil {
+		t.Error("NewAnonymizer(hash) without a key succeeded")
+	}
+	if _, err := embargo.NewAnonymizer("scramble", nil); err == nil {
+		t.Error("NewAnonymizer(scramble) succeeded")
+	}
+}
+
+func TestAnonymizeWeb100(t *testing.T) {
+	a, err := embargo.NewAnonymizer(embargo.AnonymizeTruncate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := snapshot("213.244.128.144", "203.0.113.77", "2001:4c08:2003:2:::148", "2001:db8:1234:5678:::1")
+	want := snapshot("213.244.128.144", "203.0.113.0", "2001:4c08:2003:2:::148", "2001:db8:1234:::")
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(content))
+	zw.Close()
+
+	for _, c := range [][]byte{[]byte(content), compressed.Bytes()} {
+		got, err := a.AnonymizeWeb100(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := embargo.MemberReader(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, _ := ioutil.ReadAll(r)
+		if string(plain) != want {
+			t.Errorf("AnonymizeWeb100() = %q, want %q", plain, want)
+		}
+		if embargo.DetectCodec(got) != embargo.DetectCodec(c) {
+			t.Error("AnonymizeWeb100() changed the compression")
+		}
+	}
+
+	for _, bad := range []string{"", "garbage", "K: cid LocalAddress\nC: 1 213.244.128.144\n", snapshot("213.244.128.144", "not-an-ip")} {
+		if _, err := a.AnonymizeWeb100([]byte(bad)); err == nil {
+			t.Errorf("AnonymizeWeb100(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestSplitFileAnonymize(t *testing.T) {
+	var whitelist embargo.WhitelistChecker
+	if err := whitelist.LoadFromLocalWhitelist("testdata/whitelist"); err != nil {
+		t.Fatal(err)
+	}
+	cn, err := embargo.ParseClientNetworks(strings.NewReader(clientNetworks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := embargo.NewAnonymizer(embargo.AnonymizeTruncate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		public    = "2017/03/15/mlab3.sea03/20170315T05:00:00Z_213.244.128.144_0.web100"
+		private   = "2017/03/15/mlab3.sea03/20170315T06:00:00Z_4.34.58.34_0.web100"
+		embargoed = "2017/03/15/mlab3.sea03/20170315T07:00:00Z_4.34.58.34_0.web100"
+		garbage   = "2017/03/15/mlab3.sea03/20170315T08:00:00Z_4.34.58.34_0.web100"
+	)
+	members := map[string]string{
+		public:    snapshot("213.244.128.144", "203.0.113.77"),
+		private:   snapshot("4.34.58.34", "203.0.113.77"),
+		embargoed: snapshot("4.34.58.34", "198.51.100.1"),
+		garbage:   "garbage",
+	}
+	input := makeTgz(t, gzip.BestSpeed, members, public, private, embargoed, garbage)
+
+	ec := embargo.NewEmbargoConfig("", "", "", whitelist, nil)
+	ec.SetClientNetworks(*cn)
+	ec.SetAnonymizer(a)
+	privateBuf, publicBuf, err := ec.SplitFile(context.Background(), bytes.NewReader(input), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicMembers, err := listRegular(publicBuf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateMembers, err := listRegular(privateBuf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPublic := []tarMember{
+		{public, members[public]},
+		{embargo.AnonymizedPrefix + private, snapshot("4.34.58.34", "203.0.113.0")},
+	}
+	wantPrivate := []tarMember{{private, members[private]}, {embargoed, members[embargoed]}, {garbage, members[garbage]}}
+	if !reflect.DeepEqual(publicMembers, wantPublic) {
+		t.Errorf("public members %v, want %v", publicMembers, wantPublic)
+	}
+	if !reflect.DeepEqual(privateMembers, wantPrivate) {
+		t.Errorf("private members %v, want %v", privateMembers, wantPrivate)
+	}
+}
@@ -0,0 +1,215 @@
+// Compression formats of the archives, detected by their magic bytes.
+package embargo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec reads and writes one compression format of tar archives.
+type Codec struct {
+	// Name identifies the codec, like "gzip".
+	Name string
+	// Extensions are the archive name extensions of the format. The first
+	// one is used to name outputs of archives in another format.
+	Extensions []string
+	// Magic are the first bytes of a compressed stream. The codec without
+	// magic bytes is used when no other codec matches.
+	Magic []byte
+	// NewReader returns a reader of the decompressed stream.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+	// NewWriter returns a writer compressing to w, whose Close flushes the
+	// stream but does not close w. It is nil if the format is read only.
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// The codecs of the archives of M-Lab.
+var (
+	TarCodec = &Codec{
+		Name:       "tar",
+		Extensions: []string{".tar"},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(r), nil
+		},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+	}
+	GzipCodec = &Codec{
+		Name:       "gzip",
+		Extensions: []string{".tgz", ".tar.gz"},
+		Magic:      []byte{0x1f, 0x8b},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+	}
+	ZstdCodec = &Codec{
+		Name:       "zstd",
+		Extensions: []string{".tar.zst"},
+		Magic:      []byte{0x28, 0xb5, 0x2f, 0xfd},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	}
+	// Bzip2Codec only reads. The outputs of bzip2 archives are written with
+	// gzip, unless another output codec is set.
+	Bzip2Codec = &Codec{
+		Name:       "bzip2",
+		Extensions: []string{".tar.bz2"},
+		Magic:      []byte("BZh"),
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bzip2.NewReader(r)), nil
+		},
+	}
+)
+
+// codecs are the registered codecs, with the ones with magic bytes first.
+var codecs = []*Codec{GzipCodec, ZstdCodec, Bzip2Codec, TarCodec}
+
+// RegisterCodec adds a codec, or replaces the one with the same name.
+func RegisterCodec(c *Codec) {
+	for i, old := range codecs {
+		if old.Name == c.Name {
+			codecs[i] = c
+			return
+		}
+	}
+	if len(c.Magic) == 0 {
+		codecs = append(codecs, c)
+		return
+	}
+	codecs = append([]*Codec{c}, codecs...)
+}
+
+// CodecByName returns the registered codec called name, or nil.
+func CodecByName(name string) *Codec {
+	for _, c := range codecs {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// codecForName returns the codec and the extension matching the name of an
+// archive, or nil if it has no archive extension.
+func codecForName(name string) (*Codec, string) {
+	var best *Codec
+	bestExt := ""
+	for _, c := range codecs {
+		for _, ext := range c.Extensions {
+			if strings.HasSuffix(name, ext) && len(ext) > len(bestExt) {
+				best, bestExt = c, ext
+			}
+		}
+	}
+	return best, bestExt
+}
+
+// IsArchiveName reports whether name has the extension of an archive
+// format, like .tgz or .tar.zst.
+func IsArchiveName(name string) bool {
+	c, _ := codecForName(name)
+	return c != nil
+}
+
+// EmbargoedName returns the name of the private output of an archive, with
+// "-e" before the archive extension: a.tar.gz gives a-e.tar.gz.
+func EmbargoedName(name string) string {
+	_, ext := codecForName(name)
+	return strings.TrimSuffix(name, ext) + "-e" + ext
+}
+
+// WithheldPrefix is the prefix, in the private bucket, of the archives of
+// members withheld for their client networks. Unembargo copies the objects
+// of a day prefix, like sidestream/2017/03/15, so it never copies them.
+const WithheldPrefix = "withheld/"
+
+// WithheldName returns the name of the withheld output of an archive, under
+// WithheldPrefix and with "-w" before the archive extension: a.tgz gives
+// withheld/a-w.tgz.
+func WithheldName(name string) string {
+	_, ext := codecForName(name)
+	return WithheldPrefix + strings.TrimSuffix(name, ext) + "-w" + ext
+}
+
+// outputName returns the name of the output of the archive name written
+// with codec. It keeps the extension of name if it belongs to codec.
+func outputName(name string, codec *Codec) string {
+	_, ext := codecForName(name)
+	for _, e := range codec.Extensions {
+		if e == ext {
+			return name
+		}
+	}
+	return strings.TrimSuffix(name, ext) + codec.Extensions[0]
+}
+
+// DetectCodec returns the codec of a stream from its first bytes.
+func DetectCodec(header []byte) *Codec {
+	var fallback *Codec
+	for _, c := range codecs {
+		if len(c.Magic) == 0 {
+			if fallback == nil {
+				fallback = c
+			}
+			continue
+		}
+		if bytes.HasPrefix(header, c.Magic) {
+			return c
+		}
+	}
+	return fallback
+}
+
+// OpenArchive detects the codec of the archive r and returns a reader of
+// its tar stream.
+func OpenArchive(r io.Reader) (io.ReadCloser, *Codec, error) {
+	br := bufio.NewReader(r)
+	// A short stream is detected from what there is.
+	header, _ := br.Peek(8)
+	codec := DetectCodec(header)
+	if codec == nil {
+		return nil, nil, fmt.Errorf("%w: unknown format", ErrCorruptArchive)
+	}
+	rc, err := codec.NewReader(br)
+	if err != nil {
+		return nil, codec, fmt.Errorf("%w: %s: %v", ErrCorruptArchive, codec.Name, err)
+	}
+	return rc, codec, nil
+}
+
+// MemberReader returns the content of an archive member, decompressed if it
+// is compressed itself, like the *.web100.gz members. Members are always
+// written unchanged; this is for inspecting them.
+func MemberReader(content []byte) (io.ReadCloser, error) {
+	codec := DetectCodec(content)
+	if codec == nil || len(codec.Magic) == 0 {
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+	return codec.NewReader(bytes.NewReader(content))
+}
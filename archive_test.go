@@ -0,0 +1,153 @@
+package embargo_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+const (
+	publicMember  = "2017/03/15/mlab3.sea03/20170315T05:00:00Z_213.244.128.144_0.web100"
+	privateMember = "2017/03/15/mlab3.sea03/20170315T17:00:00Z_4.34.58.34_0.web100.gz"
+)
+
+// makeArchive returns a tar archive of one public and one private member,
+// compressed with codec.
+func makeArchive(t *testing.T, codec *embargo.Codec) []byte {
+	var buf bytes.Buffer
+	w, err := codec.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(w)
+	for _, name := range []string{publicMember, privateMember} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(name))})
+		tw.Write([]byte(name))
+	}
+	tw.Close()
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDetectCodec(t *testing.T) {
+	tests := []struct {
+		path string
+		want *embargo.Codec
+	}{
+		{"testdata/20170315T000000Z-mlab3-sea03-sidestream-0000.tgz", embargo.GzipCodec},
+		{"testdata/20170315T000000Z-mlab3-sea03-sidestream-0001.tar.bz2", embargo.Bzip2Codec},
+		{"testdata/whitelist", embargo.TarCodec},
+	}
+	for _, tt := range tests {
+		content, err := ioutil.ReadFile(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := embargo.DetectCodec(content); got != tt.want {
+			t.Errorf("DetectCodec(%s) = %s, want %s", tt.path, got.Name, tt.want.Name)
+		}
+	}
+	if got := embargo.DetectCodec(makeArchive(t, embargo.ZstdCodec)); got != embargo.ZstdCodec {
+		t.Errorf("DetectCodec(zstd archive) = %s", got.Name)
+	}
+}
+
+func TestArchiveNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		archive   bool
+		embargoed string
+	}{
+		{"sidestream/a.tgz", true, "sidestream/a-e.tgz"},
+		{"sidestream/a.tar.gz", true, "sidestream/a-e.tar.gz"},
+		{"sidestream/a.tar.zst", true, "sidestream/a-e.tar.zst"},
+		{"sidestream/a.tar.bz2", true, "sidestream/a-e.tar.bz2"},
+		{"sidestream/a.tar", true, "sidestream/a-e.tar"},
+		{"sidestream/a.web100.gz", false, ""},
+		{"sidestream/tgz/a.json", false, ""},
+	}
+	for _, tt := range tests {
+		if got := embargo.IsArchiveName(tt.name); got != tt.archive {
+			t.Errorf("IsArchiveName(%q) = %v, want %v", tt.name, got, tt.archive)
+		}
+		if tt.archive && embargo.EmbargoedName(tt.name) != tt.embargoed {
+			t.Errorf("EmbargoedName(%q) = %q, want %q", tt.name, embargo.EmbargoedName(tt.name), tt.embargoed)
+		}
+	}
+}
+
+func TestEmbargoOneTarCodecs(t *testing.T) {
+	var whitelist embargo.WhitelistChecker
+	if err := whitelist.LoadFromLocalWhitelist("testdata/whitelist"); err != nil {
+		t.Fatal(err)
+	}
+	bz2, err := ioutil.ReadFile("testdata/20170315T000000Z-mlab3-sea03-sidestream-0001.tar.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		input       string
+		content     []byte
+		outputCodec string
+		want        *embargo.Codec
+		outputs     []string
+	}{
+		{"a.tar", makeArchive(t, embargo.TarCodec), "", embargo.TarCodec, []string{"a-e.tar", "a.tar"}},
+		{"a.tar.gz", makeArchive(t, embargo.GzipCodec), "", embargo.GzipCodec, []string{"a-e.tar.gz", "a.tar.gz"}},
+		{"a.tar.zst", makeArchive(t, embargo.ZstdCodec), "", embargo.ZstdCodec, []string{"a-e.tar.zst", "a.tar.zst"}},
+		{"a.tar.bz2", bz2, "", embargo.GzipCodec, []string{"a-e.tgz", "a.tgz"}},
+		{"a.tgz", makeArchive(t, embargo.GzipCodec), "zstd", embargo.ZstdCodec, []string{"a-e.tar.zst", "a.tar.zst"}},
+	}
+	for _, tt := range tests {
+		fs := newFakeStore()
+		ec := embargo.NewEmbargoConfig("scraper", "out", "out", whitelist, fs)
+		if err := ec.SetOutputCodec(tt.outputCodec); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ec.EmbargoOneTar(context.Background(), bytes.NewReader(tt.content), tt.input, false); err != nil {
+			t.Errorf("EmbargoOneTar(%s) = %v", tt.input, err)
+			continue
+		}
+		if got := fs.archives("out"); !reflect.DeepEqual(got, tt.outputs) {
+			t.Errorf("EmbargoOneTar(%s) wrote %v, want %v", tt.input, got, tt.outputs)
+			continue
+		}
+		for _, name := range tt.outputs {
+			content, _ := fs.ReadObject(context.Background(), "out", name)
+			if got := embargo.DetectCodec(content); got != tt.want {
+				t.Errorf("EmbargoOneTar(%s) wrote %s with %s, want %s", tt.input, name, got.Name, tt.want.Name)
+			}
+			if _, err := listRegular(content); err != nil {
+				t.Errorf("EmbargoOneTar(%s) wrote %s, which cannot be read: %v", tt.input, name, err)
+			}
+		}
+	}
+	var ec embargo.EmbargoConfig
+	if err := ec.SetOutputCodec("bzip2"); err == nil {
+		t.Error("SetOutputCodec(bzip2) succeeded, but bzip2 cannot write")
+	}
+}
+
+func TestMemberReader(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("web100 snapshot"))
+	zw.Close()
+	for _, content := range [][]byte{compressed.Bytes(), []byte("web100 snapshot")} {
+		r, err := embargo.MemberReader(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(got) != "web100 snapshot" {
+			t.Errorf("MemberReader() read %q, %v", got, err)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Client networks whose data is withheld, or embargoed even when the server
+// is whitelisted. The member names only have the local (server) IP, so the
+// remote (client) addresses come from the content of the web100 files.
+package embargo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/m-lab/etl/web100"
+)
+
+// ClientPolicy is what is done with the data of a client network.
+type ClientPolicy string
+
+const (
+	// ClientWithhold keeps the data private for good: it is written to the
+	// withheld archives, which unembargo does not publish.
+	ClientWithhold ClientPolicy = "withhold"
+	// ClientEmbargo embargoes the data even when the server is whitelisted,
+	// so that it is only published when it is more than one year old.
+	ClientEmbargo ClientPolicy = "embargo"
+)
+
+// ClientNetwork is one client network and its policy.
+type ClientNetwork struct {
+	Network *net.IPNet
+	Policy  ClientPolicy
+}
+
+// ClientNetworks is the list of client networks that asked for their data to
+// be withheld or embargoed.
+type ClientNetworks struct {
+	Networks []ClientNetwork
+}
+
+// ParseClientNetworks parses a list of client networks, one per line, like
+// "192.0.2.0/24 withhold" or "2001:db8::/32 embargo". The policy defaults to
+// withhold, and a single IP is a network of its own. Blank lines and lines
+// starting with "#" are skipped.
+func ParseClientNetworks(r io.Reader) (*ClientNetworks, error) {
+	cn := &ClientNetworks{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: want a network and a policy, got %q", line, scanner.Text())
+		}
+		network, _, err := parseNetwork(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		policy := ClientWithhold
+		if len(fields) == 2 {
+			policy = ClientPolicy(fields[1])
+		}
+		if policy != ClientWithhold && policy != ClientEmbargo {
+			return nil, fmt.Errorf("line %d: unknown policy %q", line, policy)
+		}
+		cn.Networks = append(cn.Networks, ClientNetwork{Network: network, Policy: policy})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cn, nil
+}
+
+// parseNetwork parses a CIDR, or an IP as a network of one address. For an
+// IP, it also returns the IP normalized like GetLocalIP, so it compares equal
+// to the IPs of the file names.
+func parseNetwork(s string) (*net.IPNet, string, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, "", fmt.Errorf("not a network: %q", s)
+		}
+		return network, "", nil
+	}
+	normalized, err := web100.NormalizeIPv6(s)
+	if err != nil {
+		return nil, "", fmt.Errorf("not an IP: %q", s)
+	}
+	ip := net.ParseIP(normalized)
+	if ip == nil {
+		return nil, "", fmt.Errorf("not an IP: %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, normalized, nil
+}
+
+// LoadFromLocalFile loads the client networks from a local file.
+func (cn *ClientNetworks) LoadFromLocalFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	loaded, err := ParseClientNetworks(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	cn.Networks = loaded.Networks
+	return nil
+}
+
+// LoadFromURL loads the client networks from a URL, with the timeout, the
+// content type check and the size limit of the whitelist.
+func (cn *ClientNetworks) LoadFromURL(listURL string) error {
+	body, err := downloadClientNetworks(listURL)
+	if err != nil {
+		return err
+	}
+	loaded, err := ParseClientNetworks(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%s: %v", listURL, err)
+	}
+	cn.Networks = loaded.Networks
+	return nil
+}
+
+// downloadClientNetworks returns the list of client networks at listURL,
+// without parsing it.
+func downloadClientNetworks(listURL string) ([]byte, error) {
+	resp, err := listClient.Get(listURL)
+	if err != nil {
+		log.Printf("cannot download client networks.\n")
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot download client networks from %s: %s", listURL, resp.Status)
+	}
+	body, err := readList(resp)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", listURL, err)
+	}
+	return body, nil
+}
+
+// Policy returns the policy of the networks containing ip. Withhold wins
+// over embargo if several networks contain it.
+func (cn *ClientNetworks) Policy(ip string) (ClientPolicy, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", false
+	}
+	var policy ClientPolicy
+	for _, n := range cn.Networks {
+		if !n.Network.Contains(addr) {
+			continue
+		}
+		if n.Policy == ClientWithhold {
+			return ClientWithhold, true
+		}
+		policy = n.Policy
+	}
+	return policy, policy != ""
+}
+
+// Outputs of the members.
+const (
+	sidePublic   = "public"
+	sidePrivate  = "private"
+	sideWithheld = "withheld"
+)
+
+// Reasons of the decisions, used as metric labels.
+const (
+	reasonNotWeb100       = "not_web100"
+	reasonOld             = "older_than_one_year"
+	reasonWhitelisted     = "whitelisted"
+	reasonNotWhitelisted  = "not_whitelisted"
+	reasonClientWithheld  = "client_withheld"
+	reasonClientEmbargoed = "client_embargoed"
+	reasonUninspectable   = "client_uninspectable"
+)
+
+// decide returns the output of the member name, of the given content, and
+// the reason why. When client networks are set, web100 files whose content
+// cannot be read are embargoed, since their clients are unknown.
+func (ec *EmbargoConfig) decide(name string, content []byte, moreThanOneYear bool) (string, string) {
+	if !strings.Contains(name, "web100") {
+		return sidePublic, reasonNotWeb100
+	}
+	if networks := ec.networks(); len(networks.Networks) > 0 {
+		snapshots, err := InspectWeb100(content)
+		if err != nil {
+			if moreThanOneYear {
+				return sidePublic, reasonOld
+			}
+			return sidePrivate, reasonUninspectable
+		}
+		embargoed := false
+		for _, ip := range snapshots.RemoteAddresses {
+			switch policy, _ := networks.Policy(ip); policy {
+			case ClientWithhold:
+				return sideWithheld, reasonClientWithheld
+			case ClientEmbargo:
+				embargoed = true
+			}
+		}
+		if embargoed && !moreThanOneYear {
+			return sidePrivate, reasonClientEmbargoed
+		}
+	}
+	if moreThanOneYear {
+		return sidePublic, reasonOld
+	}
+	if ec.isPublic(name, content) {
+		return sidePublic, reasonWhitelisted
+	}
+	return sidePrivate, reasonNotWhitelisted
+}
+
+// SetClientNetworks sets the client networks whose data is withheld or
+// embargoed. An empty list turns the client checks off.
+func (ec *EmbargoConfig) SetClientNetworks(cn ClientNetworks) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.clientNetworks = &cn
+}
+
+// SetClientNetworksSource sets where ReloadWhitelist loads the client
+// networks from, a URL or a local file, or nowhere if source is empty.
+func (ec *EmbargoConfig) SetClientNetworksSource(source string) {
+	ec.clientNetworksSource = source
+}
+
+// networks returns the client networks in use, which must not be changed.
+func (ec *EmbargoConfig) networks() *ClientNetworks {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	return ec.clientNetworks
+}
+
+// SetClientNetworksCache sets where the last loaded client networks are
+// cached, to fall back to when they cannot be loaded at startup.
+func (ec *EmbargoConfig) SetClientNetworksCache(cache WhitelistCache) {
+	ec.clientNetworksCache = cache
+}
+
+// reloadClientNetworks loads the client networks again from where they were
+// first loaded, if anywhere, and replaces those in use. If they cannot be
+// loaded, those in use are kept, or, if there are none, the cached ones are
+// used.
+func (ec *EmbargoConfig) reloadClientNetworks(ctx context.Context) error {
+	source := ec.clientNetworksSource
+	var (
+		body []byte
+		err  error
+	)
+	switch {
+	case source == "":
+		return nil
+	case isURL(source):
+		body, err = downloadClientNetworks(source)
+	default:
+		body, err = ioutil.ReadFile(source)
+	}
+	var loaded *ClientNetworks
+	if err == nil {
+		if loaded, err = ParseClientNetworks(bytes.NewReader(body)); err != nil {
+			err = fmt.Errorf("%s: %v", source, err)
+		}
+	}
+	if err != nil {
+		ec.useCachedClientNetworks(ctx)
+		return err
+	}
+	ec.SetClientNetworks(*loaded)
+	if ec.clientNetworksCache != nil {
+		cached := &CachedWhitelist{Body: body, Format: FormatClientNetworks, Validated: time.Now().UTC()}
+		if err := ec.clientNetworksCache.Save(ctx, cached); err != nil {
+			log.Printf("Cannot cache the client networks: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// useCachedClientNetworks uses the cached client networks if none are in
+// use, like at startup.
+func (ec *EmbargoConfig) useCachedClientNetworks(ctx context.Context) {
+	if len(ec.networks().Networks) > 0 || ec.clientNetworksCache == nil {
+		return
+	}
+	cached, err := ec.clientNetworksCache.Load(ctx)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Cannot load the cached client networks: %v\n", err)
+		}
+		return
+	}
+	cn, err := ParseClientNetworks(bytes.NewReader(cached.Body))
+	if err != nil {
+		log.Printf("Cannot parse the cached client networks: %v\n", err)
+		return
+	}
+	log.Printf("Using the client networks cached on %s\n", cached.Validated.Format(time.RFC3339))
+	ec.SetClientNetworks(*cn)
+}
@@ -0,0 +1,226 @@
+package embargo_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+const clientNetworks = `# Client networks.
+192.0.2.0/24 withhold
+198.51.100.7
+2001:db8::/32   embargo
+198.51.100.0/24 embargo
+`
+
+func TestParseClientNetworks(t *testing.T) {
+	cn, err := embargo.ParseClientNetworks(strings.NewReader(clientNetworks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range cn.Networks {
+		got = append(got, n.Network.String()+" "+string(n.Policy))
+	}
+	want := []string{"192.0.2.0/24 withhold", "198.51.100.7/32 withhold", "2001:db8::/32 embargo", "198.51.100.0/24 embargo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseClientNetworks() = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		ip     string
+		policy embargo.ClientPolicy
+	}{
+		{"192.0.2.1", embargo.ClientWithhold},
+		// Withhold wins over embargo.
+		{"198.51.100.7", embargo.ClientWithhold},
+		{"198.51.100.8", embargo.ClientEmbargo},
+		{"2001:db8::1", embargo.ClientEmbargo},
+		{"203.0.113.1", ""},
+		{"not-an-ip", ""},
+	}
+	for _, tt := range tests {
+		if got, ok := cn.Policy(tt.ip); got != tt.policy || ok != (tt.policy != "") {
+			t.Errorf("Policy(%s) = %q, %v, want %q", tt.ip, got, ok, tt.policy)
+		}
+	}
+
+	for _, bad := range []string{"192.0.2.0/33", "192.0.2", "192.0.2.0/24 publish", "192.0.2.0/24 withhold now"} {
+		if _, err := embargo.ParseClientNetworks(strings.NewReader("# ok\n" + bad)); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("ParseClientNetworks(%q) = %v, want an error on line 2", bad, err)
+		}
+	}
+}
+
+func TestLoadClientNetworks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client_networks")
+	if err := ioutil.WriteFile(path, []byte(clientNetworks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var fromFile embargo.ClientNetworks
+	if err := fromFile.LoadFromLocalFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/client_networks":
+			w.Write([]byte(clientNetworks))
+		case "/error_page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html>" + clientNetworks + "</html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	var fromURL embargo.ClientNetworks
+	if err := fromURL.LoadFromURL(ts.URL + "/client_networks"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fromFile.Networks) != 4 || !reflect.DeepEqual(fromFile, fromURL) {
+		t.Errorf("loaded %v from the file and %v from the URL", fromFile.Networks, fromURL.Networks)
+	}
+
+	// A failed load keeps the networks.
+	if err := fromURL.LoadFromURL(ts.URL + "/missing"); err == nil {
+		t.Error("LoadFromURL() of a missing list succeeded")
+	}
+	if err := fromURL.LoadFromURL(ts.URL + "/error_page"); err == nil {
+		t.Error("LoadFromURL() of an HTML page succeeded")
+	}
+	if err := fromFile.LoadFromLocalFile(path + ".missing"); !os.IsNotExist(err) {
+		t.Errorf("LoadFromLocalFile() of a missing file = %v", err)
+	}
+	if len(fromFile.Networks) != 4 || len(fromURL.Networks) != 4 {
+		t.Error("a failed load changed the networks")
+	}
+}
+
+func TestEmbargoOneTarClientNetworks(t *testing.T) {
+	var whitelist embargo.WhitelistChecker
+	if err := whitelist.LoadFromLocalWhitelist("testdata/whitelist"); err != nil {
+		t.Fatal(err)
+	}
+	cn, err := embargo.ParseClientNetworks(strings.NewReader(clientNetworks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		withheld  = "20170315T05:00:00Z_213.244.128.144_0.web100"
+		embargoed = "20170315T06:00:00Z_213.244.128.144_0.web100"
+		public    = "20170315T07:00:00Z_213.244.128.144_0.web100"
+		garbage   = "20170315T08:00:00Z_213.244.128.144_0.web100"
+		private   = "20170315T09:00:00Z_4.34.58.34_0.web100"
+	)
+	members := map[string]string{
+		withheld:  snapshot("213.244.128.144", "203.0.113.1", "213.244.128.144", "192.0.2.10"),
+		embargoed: snapshot("213.244.128.144", "2001:db8:::1"),
+		public:    snapshot("213.244.128.144", "203.0.113.1"),
+		garbage:   "garbage",
+		private:   snapshot("4.34.58.34", "203.0.113.1"),
+	}
+	input := makeTgz(t, gzip.BestSpeed, members, withheld, embargoed, public, garbage, private)
+
+	tests := []struct {
+		moreThanOneYear bool
+		public          []string
+		private         []string
+	}{
+		{false, []string{public}, []string{embargoed, garbage, private}},
+		{true, []string{embargoed, public, garbage, private}, nil},
+	}
+	for _, tt := range tests {
+		fs := newFakeStore()
+		ec := embargo.NewEmbargoConfig("scraper", "embargo", "archive", whitelist, fs)
+		ec.SetClientNetworks(*cn)
+		if _, err := ec.EmbargoOneTar(context.Background(), bytes.NewReader(input), "sidestream/2017/03/15/a.tgz", tt.moreThanOneYear); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fs.archives("embargo"), []string{"sidestream/2017/03/15/a-e.tgz", "withheld/sidestream/2017/03/15/a-w.tgz"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("private bucket has %v, want %v", got, want)
+		}
+		for _, out := range []struct {
+			bucket, name string
+			want         []string
+		}{
+			{"archive", "sidestream/2017/03/15/a.tgz", tt.public},
+			{"embargo", "sidestream/2017/03/15/a-e.tgz", tt.private},
+			{"embargo", "withheld/sidestream/2017/03/15/a-w.tgz", []string{withheld}},
+		} {
+			content, err := fs.ReadObject(context.Background(), out.bucket, out.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list, err := listRegular(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range list {
+				got = append(got, m.name)
+			}
+			if !reflect.DeepEqual(got, out.want) {
+				t.Errorf("moreThanOneYear %v: %s has %v, want %v", tt.moreThanOneYear, out.name, got, out.want)
+			}
+		}
+	}
+}
+
+func TestReloadClientNetworksFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client_networks")
+	if err := ioutil.WriteFile(path, []byte(clientNetworks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache := embargo.NewFileWhitelistCache(filepath.Join(dir, "client_networks.cache"))
+	reload := func() *embargo.EmbargoConfig {
+		ec := embargo.NewEmbargoConfig("", "", "", embargo.WhitelistChecker{}, nil)
+		ec.SetWhitelistSource("testdata/whitelist")
+		ec.SetClientNetworksSource(path)
+		ec.SetClientNetworksCache(cache)
+		if err := ec.ReloadWhitelist(); err != nil {
+			t.Fatalf("ReloadWhitelist() = %v", err)
+		}
+		return ec
+	}
+	const withheld = "20170315T05:00:00Z_213.244.128.144_0.web100"
+	input := makeTgz(t, gzip.BestSpeed, map[string]string{withheld: snapshot("213.244.128.144", "192.0.2.10")}, withheld)
+	// The member is public after a year, unless withheld for the client
+	// networks.
+	check := func(ec *embargo.EmbargoConfig, when string) {
+		_, pub, err := ec.SplitFile(context.Background(), bytes.NewReader(input), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list, err := listRegular(pub.Bytes()); err != nil || len(list) != 0 {
+			t.Errorf("%s: the client networks are not in use, public members %v, %v", when, list, err)
+		}
+	}
+	ec := reload()
+	check(ec, "first load")
+
+	// A failed load keeps the networks in use and still reloads the
+	// whitelist.
+	if err := ioutil.WriteFile(path, []byte("not a network\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ec.ReloadWhitelist(); err != nil {
+		t.Errorf("ReloadWhitelist() with bad client networks = %v", err)
+	}
+	check(ec, "failed reload")
+
+	// At startup, the cached networks are used.
+	os.Remove(path)
+	check(reload(), "restart")
+}
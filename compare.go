@@ -0,0 +1,188 @@
+// Content-aware comparison of the objects of two buckets.
+package embargo
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+// CompareOptions change how Compare compares two buckets.
+type CompareOptions struct {
+	// Prefix restricts the comparison to the objects whose name starts
+	// with it.
+	Prefix string
+	// TarMembers compares the member listings (name, size and SHA-256 of
+	// the content) of the tar archives, gzipped or not, whose attributes
+	// differ. Archives with the same members are then considered equal,
+	// since compressing the same members twice may give different bytes.
+	TarMembers bool
+}
+
+// ObjectDiff describes how an object present in both buckets differs.
+type ObjectDiff struct {
+	Name string `json:"name"`
+	// Fields are the attributes that differ: "size", "crc32c" or "md5".
+	Fields []string `json:"fields"`
+	// The member lists are only set when comparing tar member listings.
+	MembersOnlyInA   []string `json:"members_only_in_a,omitempty"`
+	MembersOnlyInB   []string `json:"members_only_in_b,omitempty"`
+	MembersDiffering []string `json:"members_differing,omitempty"`
+}
+
+// BucketDiff describes the differences between two buckets A and B.
+// Each list is sorted by name.
+type BucketDiff struct {
+	OnlyInA   []string     `json:"only_in_a"`
+	OnlyInB   []string     `json:"only_in_b"`
+	Differing []ObjectDiff `json:"differing"`
+}
+
+// Same reports whether both buckets have the same objects.
+func (d *BucketDiff) Same() bool {
+	return len(d.OnlyInA) == 0 && len(d.OnlyInB) == 0 && len(d.Differing) == 0
+}
+
+func (d *BucketDiff) String() string {
+	var differing []string
+	for _, od := range d.Differing {
+		differing = append(differing, od.Name+" ("+strings.Join(od.Fields, ", ")+")")
+	}
+	return fmt.Sprintf("only in A: %v, only in B: %v, differing: %v", d.OnlyInA, d.OnlyInB, differing)
+}
+
+// Compare compares the objects of the bucket (A) and other (B) by name,
+// size, CRC32C and MD5, and optionally by tar member listings.
+func (b *Bucket) Compare(ctx context.Context, other *Bucket, opts CompareOptions) (*BucketDiff, error) {
+	objectsA, err := b.objects(ctx, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	objectsB, err := other.objects(ctx, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	diff := &BucketDiff{OnlyInA: []string{}, OnlyInB: []string{}, Differing: []ObjectDiff{}}
+	for name := range objectsB {
+		if _, ok := objectsA[name]; !ok {
+			diff.OnlyInB = append(diff.OnlyInB, name)
+		}
+	}
+	for name, a := range objectsA {
+		o, ok := objectsB[name]
+		if !ok {
+			diff.OnlyInA = append(diff.OnlyInA, name)
+			continue
+		}
+		od := ObjectDiff{Name: name, Fields: differingFields(a, o)}
+		if len(od.Fields) == 0 {
+			continue
+		}
+		if opts.TarMembers {
+			if err := b.compareMembers(ctx, other, &od); err != nil {
+				return nil, err
+			}
+			if len(od.MembersOnlyInA)+len(od.MembersOnlyInB)+len(od.MembersDiffering) == 0 {
+				continue
+			}
+		}
+		diff.Differing = append(diff.Differing, od)
+	}
+	sort.Strings(diff.OnlyInA)
+	sort.Strings(diff.OnlyInB)
+	sort.Slice(diff.Differing, func(i, j int) bool { return diff.Differing[i].Name < diff.Differing[j].Name })
+	return diff, nil
+}
+
+// differingFields returns the attributes that differ between a and b.
+// Checksums missing on either side are not compared.
+func differingFields(a, b *storage.Object) []string {
+	var fields []string
+	if a.Size != b.Size {
+		fields = append(fields, "size")
+	}
+	if a.Crc32c != "" && b.Crc32c != "" && a.Crc32c != b.Crc32c {
+		fields = append(fields, "crc32c")
+	}
+	if a.Md5Hash != "" && b.Md5Hash != "" && a.Md5Hash != b.Md5Hash {
+		fields = append(fields, "md5")
+	}
+	return fields
+}
+
+// compareMembers fills the member lists of od with the differences between
+// the tar archives od.Name of b and other.
+func (b *Bucket) compareMembers(ctx context.Context, other *Bucket, od *ObjectDiff) error {
+	membersA, err := b.tarMembers(ctx, od.Name)
+	if err != nil {
+		return err
+	}
+	membersB, err := other.tarMembers(ctx, od.Name)
+	if err != nil {
+		return err
+	}
+	for name, sumA := range membersA {
+		sumB, ok := membersB[name]
+		switch {
+		case !ok:
+			od.MembersOnlyInA = append(od.MembersOnlyInA, name)
+		case sumA != sumB:
+			od.MembersDiffering = append(od.MembersDiffering, name)
+		}
+	}
+	for name := range membersB {
+		if _, ok := membersA[name]; !ok {
+			od.MembersOnlyInB = append(od.MembersOnlyInB, name)
+		}
+	}
+	sort.Strings(od.MembersOnlyInA)
+	sort.Strings(od.MembersOnlyInB)
+	sort.Strings(od.MembersDiffering)
+	return nil
+}
+
+// memberSum identifies the content of a tar member.
+type memberSum struct {
+	size   int64
+	sha256 [sha256.Size]byte
+}
+
+// tarMembers downloads the archive name, in any of the codecs, and returns
+// its members by name.
+func (b *Bucket) tarMembers(ctx context.Context, name string) (map[string]memberSum, error) {
+	content, err := b.store.ReadObject(ctx, b.Name, name)
+	if err != nil {
+		return nil, storageError("read", b.Name, name, err)
+	}
+	r, _, err := OpenArchive(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("gs://%s/%s: %w", b.Name, name, err)
+	}
+	defer r.Close()
+	members := make(map[string]memberSum)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: gs://%s/%s: %v", ErrCorruptArchive, b.Name, name, err)
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, tr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: gs://%s/%s: %v", ErrCorruptArchive, b.Name, name, err)
+		}
+		sum := memberSum{size: n}
+		copy(sum.sha256[:], h.Sum(nil))
+		members[header.Name] = sum
+	}
+}
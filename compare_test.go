@@ -0,0 +1,101 @@
+package embargo_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+// makeTgz returns a gzipped tar archive of members, compressed at level.
+func makeTgz(t testing.TB, level int, members map[string]string, order ...string) []byte {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	for _, name := range order {
+		content := members[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+	fs := newFakeStore()
+	members := map[string]string{"a.web100": "aaaa", "b.web100": "bbbb"}
+	fs.put("a", "sidestream/same.tgz", makeTgz(t, gzip.BestSpeed, members, "a.web100", "b.web100"))
+	fs.put("b", "sidestream/same.tgz", makeTgz(t, gzip.BestCompression, members, "b.web100", "a.web100"))
+	fs.put("a", "sidestream/changed.tgz", makeTgz(t, gzip.BestSpeed, members, "a.web100", "b.web100"))
+	fs.put("b", "sidestream/changed.tgz", makeTgz(t, gzip.BestSpeed, map[string]string{"a.web100": "AAAA", "c.web100": "c"}, "a.web100", "c.web100"))
+	fs.put("a", "sidestream/only-a.tgz", []byte("x"))
+	fs.put("b", "sidestream/only-b.tgz", []byte("x"))
+	fs.put("b", "other/ignored.tgz", []byte("x"))
+	a := embargo.NewBucket("a", fs, nil)
+	b := embargo.NewBucket("b", fs, nil)
+
+	diff, err := a.Compare(ctx, b, embargo.CompareOptions{Prefix: "sidestream/"})
+	if err != nil {
+		t.Fatalf("Compare() = %v", err)
+	}
+	if len(diff.Differing) != 2 || diff.Differing[0].Name != "sidestream/changed.tgz" || diff.Differing[1].Name != "sidestream/same.tgz" {
+		t.Errorf("Compare() by attributes = %s", diff)
+	}
+
+	diff, err = a.Compare(ctx, b, embargo.CompareOptions{Prefix: "sidestream/", TarMembers: true})
+	if err != nil {
+		t.Fatalf("Compare() = %v", err)
+	}
+	want := &embargo.BucketDiff{
+		OnlyInA: []string{"sidestream/only-a.tgz"},
+		OnlyInB: []string{"sidestream/only-b.tgz"},
+		Differing: []embargo.ObjectDiff{{
+			Name:             "sidestream/changed.tgz",
+			Fields:           []string{"size", "crc32c"},
+			MembersOnlyInA:   []string{"b.web100"},
+			MembersOnlyInB:   []string{"c.web100"},
+			MembersDiffering: []string{"a.web100"},
+		}},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("Compare() by members = %+v, want %+v", diff, want)
+	}
+
+	fs.put("b", "sidestream/only-a.tgz", []byte("not a tar file, but long enough to be read as a bad header"))
+	if _, err := a.Compare(ctx, b, embargo.CompareOptions{Prefix: "sidestream/only", TarMembers: true}); !errors.Is(err, embargo.ErrCorruptArchive) {
+		t.Errorf("Compare() of corrupt archives = %v, want %v", err, embargo.ErrCorruptArchive)
+	}
+}
+
+func TestCompareMembersAcrossCodecs(t *testing.T) {
+	ctx := context.Background()
+	fs := newFakeStore()
+	fs.put("a", "sidestream/x.tar.zst", makeArchive(t, embargo.GzipCodec))
+	fs.put("b", "sidestream/x.tar.zst", makeArchive(t, embargo.ZstdCodec))
+	fs.put("a", "sidestream/y.tar", makeArchive(t, embargo.GzipCodec))
+	fs.put("b", "sidestream/y.tar", makeArchive(t, embargo.TarCodec))
+	a := embargo.NewBucket("a", fs, nil)
+	b := embargo.NewBucket("b", fs, nil)
+
+	diff, err := a.Compare(ctx, b, embargo.CompareOptions{Prefix: "sidestream/", TarMembers: true})
+	if err != nil {
+		t.Fatalf("Compare() = %v", err)
+	}
+	for _, od := range diff.Differing {
+		if len(od.MembersOnlyInA)+len(od.MembersOnlyInB)+len(od.MembersDiffering) > 0 {
+			t.Errorf("Compare() of %s across codecs = %+v", od.Name, od)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/etl-embargo"
+	"github.com/m-lab/etl-embargo/tracing"
+)
+
+// openAPISpec describes the /v1 API. It is served at /v1/openapi.yaml.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// backend is the part of the embargo package used by the HTTP handlers.
+type backend interface {
+	EmbargoFile(ctx context.Context, file string) error
+	EmbargoDay(ctx context.Context, date string) error
+	UnembargoDay(ctx context.Context, date int) error
+	RecordInterrupted(jobID, action string, keys []string) error
+	Whitelist() ([]string, error)
+	ReloadWhitelist() error
+	DiffWhitelist(source string) (*embargo.WhitelistDiff, error)
+	VerifyDay(ctx context.Context, date string) (*embargo.DayReport, error)
+	DayStats(ctx context.Context, date string) (*embargo.TarStats, error)
+	CheckLag(ctx context.Context, windowDays int) (*embargo.LagReport, error)
+}
+
+// recordTimeout bounds writing the record of an interrupted job.
+const recordTimeout = 2 * time.Second
+
+// gcsBackend runs the embargo operations against the buckets of the
+// current project.
+type gcsBackend struct{}
+
+func (gcsBackend) EmbargoFile(ctx context.Context, file string) error {
+	ec, err := embargo.GetEmbargoConfig("")
+	if err != nil {
+		return err
+	}
+	return ec.EmbargoSingleFile(ctx, file)
+}
+
+func (gcsBackend) EmbargoDay(ctx context.Context, date string) error {
+	ec, err := embargo.GetEmbargoConfig("")
+	if err != nil {
+		return err
+	}
+	return ec.EmbargoOneDayData(ctx, date, embargo.FormatDateAsInt(time.Now().AddDate(-1, 0, 0)))
+}
+
+func (gcsBackend) UnembargoDay(ctx context.Context, date int) error {
+	return embargo.UnembargoCron(ctx, date)
+}
+
+func (gcsBackend) RecordInterrupted(jobID, action string, keys []string) error {
+	ec, err := embargo.GetEmbargoConfig("")
+	if err != nil {
+		return err
+	}
+	// The job context is already canceled at this point.
+	ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+	defer cancel()
+	return ec.RecordInterrupted(ctx, jobID, action, keys)
+}
+
+func (gcsBackend) Whitelist() ([]string, error) {
+	ec, err := embargo.GetEmbargoConfig("")
+	if err != nil {
+		return nil, err
+	}
+	return ec.Whitelist().IPs(), nil
+}
+
+func (gcsBackend) ReloadWhitelist() error {
+	return embargo.UpdateWhitelist()
+}
+
+func (gcsBackend) DiffWhitelist(source string) (*embargo.WhitelistDiff, error) {
+	ec, err := embargo.GetEmbargoConfig("")
+	if err != nil {
+		return nil, err
+	}
+	return ec.DiffWhitelist(source)
+}
+
+func (gcsBackend) VerifyDay(ctx context.Context, date string) (*embargo.DayReport, error) {
+	ec, err := embargo.GetEmbargoConfig("")
+	if err != nil {
+		return nil, err
+	}
+	return ec.VerifyOneDay(ctx, date)
+}
+
+func (gcsBackend) DayStats(ctx context.Context, date string) (*embargo.TarStats, error) {
+	ec, err := embargo.GetEmbargoConfig("")
+	if err != nil {
+		return nil, err
+	}
+	return ec.DayStats(ctx, date)
+}
+
+func (gcsBackend) CheckLag(ctx context.Context, windowDays int) (*embargo.LagReport, error) {
+	ec, err := embargo.GetEmbargoConfig("")
+	if err != nil {
+		return nil, err
+	}
+	return ec.CheckLag(ctx, time.Now(), windowDays)
+}
+
+// server implements the HTTP API on top of a backend.
+type server struct {
+	backend backend
+	jobs    *jobTracker
+}
+
+func newServer(b backend) *server {
+	return &server{backend: b, jobs: newJobTracker()}
+}
+
+// unembargoResponse summarizes what an unembargo request processed.
+type unembargoResponse struct {
+	Job         string   `json:"job"`
+	Dates       []string `json:"dates"`
+	Unembargoed []string `json:"unembargoed"`
+}
+
+// whitelistResponse is the body of GET /v1/whitelist.
+type whitelistResponse struct {
+	Size int      `json:"size"`
+	IPs  []string `json:"ips"`
+}
+
+// verifyResponse is the body of GET /v1/verify.
+type verifyResponse struct {
+	Complete bool                 `json:"complete"`
+	Days     []*embargo.DayReport `json:"days"`
+}
+
+// dayStats are the statistics of one day.
+type dayStats struct {
+	Date  string            `json:"date"`
+	Stats *embargo.TarStats `json:"stats"`
+}
+
+// statsResponse is the body of GET /v1/stats.
+type statsResponse struct {
+	Total *embargo.TarStats `json:"total"`
+	Days  []dayStats        `json:"days"`
+}
+
+// register adds the /v1 routes and /status/lag to mux. Reading the spec
+// needs no authentication, /status/lag needs auth.cron so that it can be
+// checked by cron, and everything else needs auth.manual.
+func (s *server) register(mux *http.ServeMux, auth authConfig) {
+	protect := func(route, method string, h http.HandlerFunc) {
+		mux.HandleFunc(route, requireAuth(route, onlyMethod(method, tracing.HandlerFunc(route, h)), auth.manual...))
+	}
+	protect("/v1/embargo", http.MethodPost, s.handleEmbargo)
+	protect("/v1/unembargo", http.MethodPost, s.handleUnembargo)
+	protect("/v1/whitelist", http.MethodGet, s.handleWhitelist)
+	protect("/v1/whitelist/reload", http.MethodPost, s.handleWhitelistReload)
+	protect("/v1/whitelist/diff", http.MethodGet, s.handleWhitelistDiff)
+	protect("/v1/verify", http.MethodGet, s.handleVerify)
+	protect("/v1/stats", http.MethodGet, s.handleStats)
+	protect("/v1/jobs", http.MethodGet, s.handleJobs)
+	protect("/v1/jobs/", http.MethodGet, s.handleJobs)
+	mux.HandleFunc("/v1/openapi.yaml", onlyMethod(http.MethodGet, handleOpenAPI))
+	mux.HandleFunc("/status/lag", requireAuth("/status/lag",
+		onlyMethod(http.MethodGet, tracing.HandlerFunc("/status/lag", s.handleLag)), auth.cron...))
+}
+
+// onlyMethod rejects requests that do not use method with 405.
+func onlyMethod(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed, use "+method)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPISpec)
+}
+
+// runJob calls process for each key of the job and stops at the first
+// error. The keys are processed under the context of the job tracker, with
+// the span of parent. Once that context is canceled, the key being processed
+// and the remaining ones are returned as interrupted and recorded so that
+// they can be retried. The job is marked done.
+func (s *server) runJob(parent context.Context, j *job, process func(ctx context.Context, key string) error) (processed, interrupted []string, err error) {
+	ctx := tracing.WithSpan(s.jobs.ctx, parent)
+	processed = []string{}
+	for i, key := range j.Keys {
+		if ctx.Err() != nil {
+			interrupted = j.Keys[i:]
+			break
+		}
+		if err = process(ctx, key); err != nil {
+			if ctx.Err() != nil {
+				interrupted, err = j.Keys[i:], nil
+			}
+			break
+		}
+		processed = append(processed, key)
+	}
+	s.jobs.done(j, err, interrupted)
+	if len(interrupted) > 0 {
+		log.Printf("Job %s interrupted, not processed: %v\n", j.ID, interrupted)
+		if err := s.backend.RecordInterrupted(j.ID, j.Action, interrupted); err != nil {
+			log.Printf("Cannot record interrupted job %s: %v\n", j.ID, err)
+		}
+	}
+	return processed, interrupted, err
+}
+
+// startJob starts a job, or replies 409 if it overlaps a running one and
+// 503 if the server is shutting down. within are the days the files of the
+// job are within, see jobTracker.start.
+func (s *server) startJob(w http.ResponseWriter, action string, keys, within []string) *job {
+	j, err := s.jobs.start(action, keys, within)
+	switch err {
+	case nil:
+		return j
+	case errShuttingDown:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusConflict, "an "+action+" job for the same data is already running")
+	}
+	return nil
+}
+
+// handleEmbargo embargoes one file, one day or a range of days.
+// Invalid requests get 400, missing source objects 404, and a request
+// overlapping one that is still running gets 409. Other failures get the
+// status of statusForError.
+func (s *server) handleEmbargo(w http.ResponseWriter, r *http.Request) {
+	req, err := parseEmbargoRequest(r.URL.Query())
+	if err != nil {
+		log.Printf("Invalid embargo request %q: %v\n", r.URL.RawQuery, err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	j := s.startJob(w, "embargo", req.keys(), req.within())
+	if j == nil {
+		return
+	}
+
+	resp := embargoResponse{Job: j.ID, Kind: req.Kind, Dataset: req.Dataset, File: req.File, Dates: req.Dates}
+	if req.Kind == kindFile {
+		_, interrupted, err := s.runJob(r.Context(), j, s.backend.EmbargoFile)
+		if len(interrupted) > 0 {
+			writeError(w, http.StatusServiceUnavailable, "interrupted by shutdown, retry "+req.File)
+			return
+		}
+		if err != nil {
+			log.Printf("Fail with embargo single file %s: %v\n", req.File, err)
+			if errors.Is(err, embargo.ErrSourceMissing) {
+				writeError(w, http.StatusNotFound, "source file not found: "+req.File)
+				return
+			}
+			writeError(w, statusForError(err), "fail with embargo single file "+req.File+": "+err.Error())
+			return
+		}
+		resp.Embargoed = []string{req.File}
+		log.Print("success with embargo single file")
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	prefix := req.Dataset + "/"
+	processed, interrupted, err := s.runJob(r.Context(), j, func(ctx context.Context, key string) error {
+		return s.backend.EmbargoDay(ctx, strings.TrimPrefix(key, prefix))
+	})
+	resp.Embargoed = []string{}
+	for _, key := range processed {
+		resp.Embargoed = append(resp.Embargoed, strings.TrimPrefix(key, prefix))
+	}
+	if len(interrupted) > 0 {
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("interrupted by shutdown, retry %v", interrupted))
+		return
+	}
+	if err != nil {
+		date := strings.TrimPrefix(j.Keys[len(processed)], prefix)
+		log.Printf("Fail with embargo on new coming data for date %s: %v\n", date, err)
+		writeError(w, statusForError(err), "fail with embargo on new coming data for date "+date+": "+err.Error())
+		return
+	}
+	log.Printf("success with embargo data for %d day(s)", len(resp.Embargoed))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// statusForError returns the HTTP status reporting an error of the
+// embargo package: 400 for bad input, 404 for missing sources, 409 for
+// whitelist changes waiting for approval, 422 for archives that cannot be
+// read, 502 for storage failures, 503 when canceled and 500 otherwise.
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, embargo.ErrInvalidFilename),
+		errors.Is(err, embargo.ErrInvalidDate),
+		errors.Is(err, embargo.ErrNotEligibleYet):
+		return http.StatusBadRequest
+	case errors.Is(err, embargo.ErrSourceMissing):
+		return http.StatusNotFound
+	case errors.Is(err, embargo.ErrWhitelistNotApproved):
+		return http.StatusConflict
+	case errors.Is(err, embargo.ErrCorruptArchive):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, embargo.ErrStorage):
+		return http.StatusBadGateway
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// handleUnembargo publishes the embargoed data of one day or a range of
+// days. All days must be more than one year old.
+func (s *server) handleUnembargo(w http.ResponseWriter, r *http.Request) {
+	dates, err := parseDates(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cutoff := embargo.FormatDateAsInt(time.Now().AddDate(-1, 0, 0))
+	keys := make([]string, len(dates))
+	for i, d := range dates {
+		if n, _ := strconv.Atoi(d); n > cutoff {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("date %s is too new, not qualified for unembargo", d))
+			return
+		}
+		keys[i] = "unembargo/" + d
+	}
+
+	j := s.startJob(w, "unembargo", keys, nil)
+	if j == nil {
+		return
+	}
+	processed, interrupted, err := s.runJob(r.Context(), j, func(ctx context.Context, key string) error {
+		n, _ := strconv.Atoi(strings.TrimPrefix(key, "unembargo/"))
+		log.Printf("Date of the unembargo data is %d.", n)
+		return s.backend.UnembargoDay(ctx, n)
+	})
+	resp := unembargoResponse{Job: j.ID, Dates: dates, Unembargoed: []string{}}
+	for _, key := range processed {
+		resp.Unembargoed = append(resp.Unembargoed, strings.TrimPrefix(key, "unembargo/"))
+	}
+	if len(interrupted) > 0 {
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("interrupted by shutdown, retry %v", interrupted))
+		return
+	}
+	if err != nil {
+		log.Print(err.Error())
+		writeError(w, statusForError(err), err.Error())
+		return
+	}
+	log.Println("success")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *server) handleWhitelist(w http.ResponseWriter, r *http.Request) {
+	ips, err := s.backend.Whitelist()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, whitelistResponse{Size: len(ips), IPs: ips})
+}
+
+func (s *server) handleWhitelistReload(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Update the site IPs used for embargo process.\n")
+	if err := s.backend.ReloadWhitelist(); err != nil {
+		log.Print(err.Error())
+		writeError(w, statusForError(err), err.Error())
+		return
+	}
+	s.handleWhitelist(w, r)
+}
+
+// handleWhitelistDiff compares the whitelist in use with the one a reload
+// would load, or with the one at the source URL.
+func (s *server) handleWhitelistDiff(w http.ResponseWriter, r *http.Request) {
+	source := r.URL.Query().Get("source")
+	if source != "" && !strings.HasPrefix(source, "https://") && !strings.HasPrefix(source, "http://") {
+		writeError(w, http.StatusBadRequest, "source must be an http(s) URL")
+		return
+	}
+	diff, err := s.backend.DiffWhitelist(source)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, diff)
+}
+
+// handleVerify reports, for each requested day, the source files whose
+// public or private outputs are missing.
+func (s *server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	dates, err := parseDates(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := verifyResponse{Complete: true}
+	for _, d := range dates {
+		report, err := s.backend.VerifyDay(r.Context(), d)
+		if err != nil {
+			writeError(w, statusForError(err), err.Error())
+			return
+		}
+		resp.Complete = resp.Complete && report.Complete()
+		resp.Days = append(resp.Days, report)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleStats returns the statistics of the archives embargoed on each
+// requested day, and their total.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	dates, err := parseDates(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := statsResponse{Total: embargo.NewTarStats()}
+	for _, d := range dates {
+		stats, err := s.backend.DayStats(r.Context(), d)
+		if err != nil {
+			writeError(w, statusForError(err), err.Error())
+			return
+		}
+		resp.Total.Merge(stats)
+		resp.Days = append(resp.Days, dayStats{Date: d, Stats: stats})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleLag reports the days late for embargo or unembargo over the window
+// of the days parameter, or of EMBARGO_LAG_WINDOW_DAYS, and updates the lag
+// metrics.
+func (s *server) handleLag(w http.ResponseWriter, r *http.Request) {
+	days, err := parseLagWindow(r.URL.Query(), lagWindow())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := s.backend.CheckLag(r.Context(), days)
+	if err != nil {
+		log.Printf("Cannot check the lag: %v\n", err)
+		writeError(w, statusForError(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleJobs lists all known jobs on /v1/jobs, and returns one job on
+// /v1/jobs/<id>.
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/jobs"), "/")
+	if id == "" {
+		writeJSON(w, http.StatusOK, s.jobs.list())
+		return
+	}
+	j, ok := s.jobs.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such job: "+id)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
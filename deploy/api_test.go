@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/etl-embargo"
+)
+
+// fakeBackend records the calls made by the handlers.
+type fakeBackend struct {
+	days               []string
+	unembargo          []int
+	reloaded           bool
+	fileErr            error
+	embargoing         chan struct{}
+	blockUntilCanceled bool
+	interrupted        []string
+	lagWindow          int
+	diffSource         string
+	reloadErr          error
+}
+
+func (f *fakeBackend) EmbargoFile(ctx context.Context, file string) error {
+	return f.fileErr
+}
+
+func (f *fakeBackend) EmbargoDay(ctx context.Context, date string) error {
+	if f.embargoing != nil {
+		f.embargoing <- struct{}{}
+		if f.blockUntilCanceled {
+			// Only stop when canceled, like a slow download.
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		<-f.embargoing
+	}
+	f.days = append(f.days, date)
+	return nil
+}
+
+func (f *fakeBackend) UnembargoDay(ctx context.Context, date int) error {
+	f.unembargo = append(f.unembargo, date)
+	return nil
+}
+
+func (f *fakeBackend) RecordInterrupted(jobID, action string, keys []string) error {
+	f.interrupted = keys
+	return nil
+}
+
+func (f *fakeBackend) Whitelist() ([]string, error) {
+	return []string{"213.244.128.170", "2001:4c08:2003:2::16"}, nil
+}
+
+func (f *fakeBackend) ReloadWhitelist() error {
+	f.reloaded = true
+	return f.reloadErr
+}
+
+func (f *fakeBackend) DiffWhitelist(source string) (*embargo.WhitelistDiff, error) {
+	f.diffSource = source
+	return &embargo.WhitelistDiff{Added: []string{"1.2.3.4"}, Removed: []string{}}, nil
+}
+
+func (f *fakeBackend) VerifyDay(ctx context.Context, date string) (*embargo.DayReport, error) {
+	report := &embargo.DayReport{Date: date, Sources: 1, MissingPublic: []string{}, MissingPrivate: []string{}}
+	if date == "20170530" {
+		report.MissingPrivate = []string{"sidestream/2017/05/30/20170530T000000Z-mlab1-atl06-sidestream-0000.tgz"}
+	}
+	return report, nil
+}
+
+func (f *fakeBackend) DayStats(ctx context.Context, date string) (*embargo.TarStats, error) {
+	stats := embargo.NewTarStats()
+	stats.Archives = 2
+	stats.Sides["public"] = embargo.SideStats{Members: 3, Bytes: 300}
+	stats.Sides["private"] = embargo.SideStats{Members: 1, Bytes: 100}
+	return stats, nil
+}
+
+func (f *fakeBackend) CheckLag(ctx context.Context, windowDays int) (*embargo.LagReport, error) {
+	f.lagWindow = windowDays
+	return &embargo.LagReport{
+		WindowDays:       windowDays,
+		MissingOutputs:   []*embargo.DayLag{{Date: "20170529", Sources: 1, MissingPublic: []string{"a.tgz"}}},
+		OverdueUnembargo: []*embargo.DayLag{},
+		StalePrivate:     []embargo.StaleObject{},
+	}, nil
+}
+
+// newTestServer serves the API of a server using fb, protected by a static token.
+func newTestServer(fb *fakeBackend) (*server, *httptest.Server) {
+	s := newServer(fb)
+	mux := http.NewServeMux()
+	token := []Authenticator{StaticTokenAuth{Token: "secret"}}
+	s.register(mux, authConfig{cron: token, manual: token})
+	return s, httptest.NewServer(mux)
+}
+
+func call(t *testing.T, ts *httptest.Server, method, path string, v interface{}) int {
+	req, err := http.NewRequest(method, ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if v != nil {
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Errorf("%s %s: cannot parse %q: %v", method, path, body, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestEmbargoAPI(t *testing.T) {
+	fb := &fakeBackend{}
+	_, ts := newTestServer(fb)
+	defer ts.Close()
+
+	var result embargoResponse
+	if code := call(t, ts, "POST", "/v1/embargo?start=20170529&end=20170530", &result); code != http.StatusOK {
+		t.Fatalf("embargo range: got status %d", code)
+	}
+	want := []string{"20170529", "20170530"}
+	if !reflect.DeepEqual(result.Embargoed, want) || !reflect.DeepEqual(fb.days, want) || result.Kind != kindRange {
+		t.Errorf("embargo range: got %+v, backend saw %v", result, fb.days)
+	}
+
+	var job job
+	if code := call(t, ts, "GET", "/v1/jobs/"+result.Job, &job); code != http.StatusOK || job.Status != jobSucceeded {
+		t.Errorf("job status: got %d %+v", code, job)
+	}
+
+	var e errorResponse
+	if code := call(t, ts, "POST", "/v1/embargo?date=bad", &e); code != http.StatusBadRequest || e.Error == "" {
+		t.Errorf("bad date: got %d %+v", code, e)
+	}
+	if code := call(t, ts, "GET", "/v1/embargo?date=20170529", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET embargo: got status %d", code)
+	}
+
+	fb.fileErr = &embargo.StorageError{Op: "read", Bucket: "scraper-mlab-testing", Err: &googleapi.Error{Code: http.StatusNotFound}}
+	file := "gs://scraper-mlab-testing/sidestream/2017/05/29/20170529T000000Z-mlab1-atl06-sidestream-0000.tgz"
+	if code := call(t, ts, "POST", "/v1/embargo?file="+file, nil); code != http.StatusNotFound {
+		t.Errorf("missing file: got status %d", code)
+	}
+	fb.fileErr = errors.New("write failed")
+	if code := call(t, ts, "POST", "/v1/embargo?file="+file, nil); code != http.StatusInternalServerError {
+		t.Errorf("failing file: got status %d", code)
+	}
+}
+
+func TestStatusForError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("%w: bad", embargo.ErrInvalidFilename), http.StatusBadRequest},
+		{fmt.Errorf("%w: 20990101", embargo.ErrNotEligibleYet), http.StatusBadRequest},
+		{&embargo.StorageError{Op: "read", Err: &googleapi.Error{Code: http.StatusNotFound}}, http.StatusNotFound},
+		{fmt.Errorf("%w: unexpected EOF", embargo.ErrCorruptArchive), http.StatusUnprocessableEntity},
+		{&embargo.StorageError{Op: "write", Err: &googleapi.Error{Code: http.StatusForbidden}}, http.StatusBadGateway},
+		{context.Canceled, http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: \"x\"", embargo.ErrUnknownProject), http.StatusInternalServerError},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := statusForError(tt.err); got != tt.want {
+			t.Errorf("statusForError(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestEmbargoAPIConflict(t *testing.T) {
+	fb := &fakeBackend{embargoing: make(chan struct{})}
+	_, ts := newTestServer(fb)
+	defer ts.Close()
+
+	done := make(chan int)
+	go func() {
+		done <- call(t, ts, "POST", "/v1/embargo?date=20170529", nil)
+	}()
+	// Wait until the first request is inside the backend.
+	<-fb.embargoing
+	if code := call(t, ts, "POST", "/v1/embargo?start=20170528&end=20170530", nil); code != http.StatusConflict {
+		t.Errorf("overlapping request: got status %d, want %d", code, http.StatusConflict)
+	}
+	fb.embargoing <- struct{}{}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("first request: got status %d", code)
+	}
+}
+
+func TestEmbargoAPIShutdown(t *testing.T) {
+	fb := &fakeBackend{embargoing: make(chan struct{}), blockUntilCanceled: true}
+	s, ts := newTestServer(fb)
+	defer ts.Close()
+
+	done := make(chan int)
+	go func() {
+		done <- call(t, ts, "POST", "/v1/embargo?start=20170529&end=20170530", nil)
+	}()
+	<-fb.embargoing
+	drained := make(chan []job)
+	go func() {
+		drained <- s.jobs.drain(10*time.Millisecond, time.Second)
+	}()
+
+	if code := <-done; code != http.StatusServiceUnavailable {
+		t.Errorf("interrupted request: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if stuck := <-drained; len(stuck) != 0 {
+		t.Errorf("drain() = %+v, want no stuck jobs", stuck)
+	}
+	want := []string{"sidestream/20170529", "sidestream/20170530"}
+	if !reflect.DeepEqual(fb.interrupted, want) {
+		t.Errorf("recorded interrupted %v, want %v", fb.interrupted, want)
+	}
+	if code := call(t, ts, "POST", "/v1/embargo?date=20170531", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("request after shutdown: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	deadline := time.Now().Add(shutdownTimeout)
+	if d := drainTimeout(deadline); d > defaultDrainTimeout || d+cancelGrace+stopTimeout > shutdownTimeout {
+		t.Errorf("drainTimeout() = %v, leaves no time to stop within %v", d, shutdownTimeout)
+	}
+	t.Setenv("EMBARGO_DRAIN_TIMEOUT", "5s")
+	if d := drainTimeout(deadline); d != 5*time.Second {
+		t.Errorf("drainTimeout() = %v, want 5s", d)
+	}
+	// A longer timeout is cut to end before the deadline.
+	t.Setenv("EMBARGO_DRAIN_TIMEOUT", "1m")
+	if d := drainTimeout(deadline); d+cancelGrace+stopTimeout > shutdownTimeout {
+		t.Errorf("drainTimeout() = %v, goes past the deadline", d)
+	}
+}
+
+func TestUnembargoAPI(t *testing.T) {
+	fb := &fakeBackend{}
+	_, ts := newTestServer(fb)
+	defer ts.Close()
+
+	var result unembargoResponse
+	if code := call(t, ts, "POST", "/v1/unembargo?date=20160102", &result); code != http.StatusOK {
+		t.Fatalf("unembargo: got status %d", code)
+	}
+	if !reflect.DeepEqual(fb.unembargo, []int{20160102}) || !reflect.DeepEqual(result.Unembargoed, []string{"20160102"}) {
+		t.Errorf("unembargo: got %+v, backend saw %v", result, fb.unembargo)
+	}
+	if code := call(t, ts, "POST", "/v1/unembargo", nil); code != http.StatusBadRequest {
+		t.Errorf("unembargo without date: got status %d", code)
+	}
+}
+
+func TestWhitelistAPI(t *testing.T) {
+	fb := &fakeBackend{}
+	_, ts := newTestServer(fb)
+	defer ts.Close()
+
+	var wl whitelistResponse
+	if code := call(t, ts, "GET", "/v1/whitelist", &wl); code != http.StatusOK || wl.Size != 2 {
+		t.Errorf("whitelist: got %d %+v", code, wl)
+	}
+	if code := call(t, ts, "POST", "/v1/whitelist/reload", &wl); code != http.StatusOK || !fb.reloaded {
+		t.Errorf("reload: got %d, reloaded %v", code, fb.reloaded)
+	}
+	var diff embargo.WhitelistDiff
+	if code := call(t, ts, "GET", "/v1/whitelist/diff", &diff); code != http.StatusOK || len(diff.Added) != 1 {
+		t.Errorf("diff: got %d %+v", code, diff)
+	}
+	if code := call(t, ts, "GET", "/v1/whitelist/diff?source=https://example.com/ips.json", nil); code != http.StatusOK ||
+		fb.diffSource != "https://example.com/ips.json" {
+		t.Errorf("diff of a URL: got %d, backend saw %q", code, fb.diffSource)
+	}
+	if code := call(t, ts, "GET", "/v1/whitelist/diff?source=/etc/passwd", nil); code != http.StatusBadRequest {
+		t.Errorf("diff of a file: got %d", code)
+	}
+	fb.reloadErr = fmt.Errorf("%w: it removes sites sea03", embargo.ErrWhitelistNotApproved)
+	if code := call(t, ts, "POST", "/v1/whitelist/reload", nil); code != http.StatusConflict {
+		t.Errorf("reload not approved: got %d", code)
+	}
+}
+
+func TestVerifyAPI(t *testing.T) {
+	_, ts := newTestServer(&fakeBackend{})
+	defer ts.Close()
+
+	var v verifyResponse
+	if code := call(t, ts, "GET", "/v1/verify?start=20170529&end=20170530", &v); code != http.StatusOK {
+		t.Fatalf("verify: got status %d", code)
+	}
+	if v.Complete || len(v.Days) != 2 || !v.Days[0].Complete() {
+		t.Errorf("verify: got %+v", v)
+	}
+}
+
+func TestStatsAPI(t *testing.T) {
+	_, ts := newTestServer(&fakeBackend{})
+	defer ts.Close()
+
+	var v statsResponse
+	if code := call(t, ts, "GET", "/v1/stats?start=20170529&end=20170530", &v); code != http.StatusOK {
+		t.Fatalf("stats: got status %d", code)
+	}
+	if len(v.Days) != 2 || v.Days[1].Date != "20170530" || v.Total.Archives != 4 ||
+		v.Total.Sides["public"] != (embargo.SideStats{Members: 6, Bytes: 600}) {
+		t.Errorf("stats: got %+v", v)
+	}
+	if code := call(t, ts, "GET", "/v1/stats?date=2017", nil); code != http.StatusBadRequest {
+		t.Errorf("stats of a bad date: got status %d", code)
+	}
+}
+
+func TestLagAPI(t *testing.T) {
+	fb := &fakeBackend{}
+	_, ts := newTestServer(fb)
+	defer ts.Close()
+
+	var v embargo.LagReport
+	if code := call(t, ts, "GET", "/status/lag", &v); code != http.StatusOK {
+		t.Fatalf("lag: got status %d", code)
+	}
+	if fb.lagWindow != defaultLagWindow || v.OK || len(v.MissingOutputs) != 1 || v.MissingOutputs[0].Date != "20170529" {
+		t.Errorf("lag: backend saw %d days, got %+v", fb.lagWindow, v)
+	}
+	if code := call(t, ts, "GET", "/status/lag?days=30", nil); code != http.StatusOK || fb.lagWindow != 30 {
+		t.Errorf("lag of 30 days: got status %d, backend saw %d days", code, fb.lagWindow)
+	}
+	for _, bad := range []string{"0", "400", "week"} {
+		if code := call(t, ts, "GET", "/status/lag?days="+bad, nil); code != http.StatusBadRequest {
+			t.Errorf("lag of %s days: got status %d", bad, code)
+		}
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	_, ts := newTestServer(&fakeBackend{})
+	defer ts.Close()
+
+	// The spec is public.
+	resp, err := http.Get(ts.URL + "/v1/openapi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "openapi:") {
+		t.Errorf("openapi.yaml: got %d %q", resp.StatusCode, body)
+	}
+	// Every registered route is documented.
+	for _, path := range []string{"/embargo:", "/unembargo:", "/whitelist:", "/whitelist/reload:",
+		"/whitelist/diff:", "/verify:", "/stats:", "/jobs:", "/jobs/{id}:", "/lag:"} {
+		if !strings.Contains(string(body), "\n  "+path) {
+			t.Errorf("openapi.yaml does not describe %s", path)
+		}
+	}
+}
+
+func TestOldRoutes(t *testing.T) {
+	fb := &fakeBackend{}
+	apiServer = newServer(fb)
+
+	rec := httptest.NewRecorder()
+	EmbargoHandler(rec, httptest.NewRequest("GET", "/submit?date=20170529", nil))
+	if rec.Code != http.StatusOK || !reflect.DeepEqual(fb.days, []string{"20170529"}) {
+		t.Errorf("/submit: got %d, backend saw %v", rec.Code, fb.days)
+	}
+
+	rec = httptest.NewRecorder()
+	unEmbargoCron(rec, httptest.NewRequest("GET", "/cron/unembargo", nil))
+	if rec.Code != http.StatusOK || len(fb.unembargo) != 1 {
+		t.Errorf("/cron/unembargo: got %d, backend saw %v", rec.Code, fb.unembargo)
+	}
+
+	rec = httptest.NewRecorder()
+	updateEmbargoWhitelist(rec, httptest.NewRequest("GET", "/cron/update_embargo_whitelist", nil))
+	if rec.Code != http.StatusOK || !fb.reloaded {
+		t.Errorf("/cron/update_embargo_whitelist: got %d, reloaded %v", rec.Code, fb.reloaded)
+	}
+}
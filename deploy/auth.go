@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+
+	"github.com/m-lab/etl-embargo/metrics"
+)
+
+// Reasons reported in the auth denial metric.
+const (
+	reasonMissingCredentials = "missing_credentials"
+	reasonInvalidToken       = "invalid_token"
+	reasonPrincipal          = "principal_not_allowed"
+	reasonNotConfigured      = "not_configured"
+)
+
+// authError is returned by an Authenticator when it rejects a request. The
+// reason is used as the metric label, so it must come from the list above.
+type authError struct {
+	reason string
+	msg    string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+// errNoCredentials means the request did not carry anything the
+// Authenticator knows how to check, so the next one should be tried.
+var errNoCredentials = &authError{reasonMissingCredentials, "no credentials"}
+
+// Authenticator checks whether a request may reach a protected handler.
+// It returns the name of the caller on success.
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, error)
+}
+
+// CronAuth accepts requests issued by the App Engine cron service.
+// App Engine strips the X-Appengine-Cron header from requests coming from
+// outside, so its presence proves the request came from cron.
+type CronAuth struct{}
+
+// Authenticate implements Authenticator.
+func (CronAuth) Authenticate(r *http.Request) (string, error) {
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		return "", errNoCredentials
+	}
+	return "appengine-cron", nil
+}
+
+// OIDCAuth accepts requests with a Google signed OIDC bearer token issued
+// for Audience, whose email is one of AllowedPrincipals.
+type OIDCAuth struct {
+	Audience          string
+	AllowedPrincipals map[string]struct{}
+	// validate is idtoken.Validate, replaced in tests.
+	validate func(ctx context.Context, token, audience string) (*idtoken.Payload, error)
+}
+
+// NewOIDCAuth creates an OIDCAuth for the given audience and principals.
+func NewOIDCAuth(audience string, principals []string) *OIDCAuth {
+	allowed := make(map[string]struct{})
+	for _, p := range principals {
+		allowed[p] = struct{}{}
+	}
+	return &OIDCAuth{
+		Audience:          audience,
+		AllowedPrincipals: allowed,
+		validate:          idtoken.Validate,
+	}
+}
+
+// Authenticate implements Authenticator.
+func (a *OIDCAuth) Authenticate(r *http.Request) (string, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return "", errNoCredentials
+	}
+	payload, err := a.validate(r.Context(), token, a.Audience)
+	if err != nil {
+		return "", &authError{reasonInvalidToken, "invalid token: " + err.Error()}
+	}
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if email == "" || !verified {
+		return "", &authError{reasonPrincipal, "token has no verified email"}
+	}
+	if _, ok := a.AllowedPrincipals[email]; !ok {
+		return "", &authError{reasonPrincipal, "principal not allowed: " + email}
+	}
+	return email, nil
+}
+
+// StaticTokenAuth accepts requests whose bearer token equals Token.
+// It is meant for local testing only.
+type StaticTokenAuth struct {
+	Token string
+}
+
+// Authenticate implements Authenticator.
+func (a StaticTokenAuth) Authenticate(r *http.Request) (string, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return "", errNoCredentials
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+		return "", &authError{reasonInvalidToken, "invalid static token"}
+	}
+	return "static-token", nil
+}
+
+// bearerToken returns the token from the Authorization header, or "".
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// requireAuth wraps handler so that it only runs when one of auths accepts
+// the request. Denied requests get 401 when no credentials were supplied,
+// 403 otherwise, and are counted per route and reason.
+func requireAuth(route string, handler http.HandlerFunc, auths ...Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		denial := &authError{reasonNotConfigured, "no authentication configured"}
+		for _, auth := range auths {
+			principal, err := auth.Authenticate(r)
+			if err == nil {
+				log.Printf("%s called by %s\n", route, principal)
+				handler(w, r)
+				return
+			}
+			var ae *authError
+			if !errors.As(err, &ae) {
+				ae = &authError{reasonInvalidToken, err.Error()}
+			}
+			// A real rejection is more informative than a missing credential.
+			if denial.reason == reasonNotConfigured || denial.reason == reasonMissingCredentials {
+				denial = ae
+			}
+		}
+		metrics.AuthDenialsTotal.WithLabelValues(route, denial.reason).Inc()
+		log.Printf("Denied request to %s: %s\n", route, denial.msg)
+		status := http.StatusForbidden
+		if denial.reason == reasonMissingCredentials {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// authConfig holds the Authenticators for each kind of route.
+type authConfig struct {
+	cron   []Authenticator
+	manual []Authenticator
+}
+
+// authConfigFromEnv builds the Authenticators from the environment:
+//
+//	EMBARGO_AUTH_AUDIENCE    audience expected in OIDC tokens
+//	EMBARGO_AUTH_PRINCIPALS  comma separated emails allowed to call manual routes
+//	EMBARGO_AUTH_STATIC_TOKEN shared token for local testing
+//
+// Cron routes accept App Engine cron plus anything allowed on manual routes,
+// so that operators can trigger a cron job by hand.
+func authConfigFromEnv() authConfig {
+	var manual []Authenticator
+	if audience := os.Getenv("EMBARGO_AUTH_AUDIENCE"); audience != "" {
+		var principals []string
+		for _, p := range strings.Split(os.Getenv("EMBARGO_AUTH_PRINCIPALS"), ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				principals = append(principals, p)
+			}
+		}
+		manual = append(manual, NewOIDCAuth(audience, principals))
+	}
+	if token := os.Getenv("EMBARGO_AUTH_STATIC_TOKEN"); token != "" {
+		log.Printf("Static token authentication enabled. Do not use this in production.\n")
+		manual = append(manual, StaticTokenAuth{Token: token})
+	}
+	if len(manual) == 0 {
+		log.Printf("No authentication configured for manual routes; they will deny every request.\n")
+	}
+	cron := append([]Authenticator{CronAuth{}}, manual...)
+	return authConfig{cron: cron, manual: manual}
+}
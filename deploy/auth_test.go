@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/idtoken"
+)
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+func fakeValidate(ctx context.Context, token, audience string) (*idtoken.Payload, error) {
+	if token != "good" || audience != "embargo" {
+		return nil, errors.New("bad token")
+	}
+	return &idtoken.Payload{Claims: map[string]interface{}{
+		"email":          "operator@mlab-testing.iam.gserviceaccount.com",
+		"email_verified": true,
+	}}, nil
+}
+
+func TestRequireAuth(t *testing.T) {
+	oidc := NewOIDCAuth("embargo", []string{"operator@mlab-testing.iam.gserviceaccount.com"})
+	oidc.validate = fakeValidate
+	other := NewOIDCAuth("embargo", []string{"someone@example.com"})
+	other.validate = fakeValidate
+
+	tests := []struct {
+		name   string
+		auths  []Authenticator
+		header map[string]string
+		want   int
+	}{
+		{"cron header", []Authenticator{CronAuth{}}, map[string]string{"X-Appengine-Cron": "true"}, http.StatusOK},
+		{"no cron header", []Authenticator{CronAuth{}}, nil, http.StatusUnauthorized},
+		{"nothing configured", nil, map[string]string{"Authorization": "Bearer good"}, http.StatusForbidden},
+		{"static token", []Authenticator{StaticTokenAuth{Token: "secret"}}, map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+		{"wrong static token", []Authenticator{StaticTokenAuth{Token: "secret"}}, map[string]string{"Authorization": "Bearer guess"}, http.StatusForbidden},
+		{"oidc", []Authenticator{CronAuth{}, oidc}, map[string]string{"Authorization": "Bearer good"}, http.StatusOK},
+		{"oidc bad token", []Authenticator{CronAuth{}, oidc}, map[string]string{"Authorization": "Bearer bad"}, http.StatusForbidden},
+		{"oidc wrong principal", []Authenticator{other}, map[string]string{"Authorization": "Bearer good"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/cron/unembargo", nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		requireAuth("/cron/unembargo", okHandler, tt.auths...)(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
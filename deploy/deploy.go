@@ -1,126 +1,155 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	// Enable exported debug vars.  See https://golang.org/pkg/expvar/
 	_ "expvar"
+	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
 	"github.com/m-lab/etl-embargo"
 	"github.com/m-lab/etl-embargo/metrics"
-	"github.com/m-lab/etl/storage"
+	"github.com/m-lab/etl-embargo/tracing"
 )
 
-// EmbargoHandler handles data for one day or a single file.
-// TODO(dev): make sure only authorized users can call this.
+// apiServer serves both the /v1 API and the older routes below.
+var apiServer = newServer(gcsBackend{})
+
+// EmbargoHandler handles data for one day, a range of days or a single file.
+// It is the old name of POST /v1/embargo, and accepts any method.
+// Only authorized users can call this, see requireAuth.
 // For example, if we want to process embargo on
 // gs://scraper-mlab-sandbox/sidestream/2017/05/29/20170529T000000Z-mlab1-atl02-sidestream-0000.tgz
 // The input URL is like: "https://embargo-dot-mlab-sandbox.appspot.com/submit?file=Z3M6Ly9zY3JhcGVyLW1sYWItc2FuZGJveC9zaWRlc3RyZWFtLzIwMTcvMDUvMjkvMjAxNzA1MjlUMDAwMDAwWi1tbGFiMS1hdGwwMi1zaWRlc3RyZWFtLTAwMDAudGd6"
+// A day is requested with date=yyyymmdd, a range with start=yyyymmdd&end=yyyymmdd.
 func EmbargoHandler(w http.ResponseWriter, r *http.Request) {
-	date := r.URL.Query()["date"]
-	filename := r.URL.Query()["file"]
-	if len(date) == 0 && len(filename) == 0 {
-		fmt.Fprint(w, "Missing date or filename there\n")
-		http.NotFound(w, r)
-		return
-	}
-
-	fn, err := storage.GetFilename(filename[0])
-	if err != nil {
-		log.Printf("Invalid filename: %s\n", fn)
-		http.Error(w, "Invalid filename: "+fn, http.StatusInternalServerError)
-		return
-	}
-
-	//log.Printf("filename: %s\n", fn)
-	removePrefix := fn[5:]
-	bucketNameEnd := strings.IndexByte(removePrefix, '/')
-	filePath := removePrefix[bucketNameEnd+1:]
-
-	testConfig, err := embargo.GetEmbargoConfig("")
-	if err != nil {
-		log.Print(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if fn != "" {
-		err := testConfig.EmbargoSingleFile(filePath)
-		if err != nil {
-			log.Print("Fail with embargo single file " + fn + " \n")
-			http.Error(w, "Fail with embargo single file.", http.StatusInternalServerError)
-		}
-		log.Print("success with embargo single file")
-		return
-	}
-
-	// Process the date if there is not single file.
-	if len(date) > 0 {
-		err := testConfig.EmbargoOneDayData(date[0], embargo.FormatDateAsInt(time.Now().AddDate(-1, 0, 0)))
-		if err != nil {
-			log.Print("Fail with embargo on new coming data for date: " + date[0] + " \n")
-			http.Error(w, "Fail with embargo on new coming data for date: "+date[0]+" \n", http.StatusInternalServerError)
-			return
-		}
-		log.Print("success with embargo one day data")
-		return
-	}
+	apiServer.handleEmbargo(w, r)
 }
 
-// Update the embargo whitelist by reloading the site IPs daily
+// Update the embargo whitelist by reloading the site IPs daily.
+// It is the old name of POST /v1/whitelist/reload.
 func updateEmbargoWhitelist(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Update the site IPs used for embargo process.\n")
-
-	err := embargo.UpdateWhitelist()
-	if err != nil {
-		log.Print(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	apiServer.handleWhitelistReload(w, r)
 }
 
 // Unembargo the data one year ago if the date is not specified.
 // If there is a date more than one year ago, then unembargo the data of that date.
+// It is the old name of POST /v1/unembargo.
 func unEmbargoCron(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Unembargo data.\n")
-	date := r.URL.Query().Get("date")
-	undate := embargo.FormatDateAsInt(time.Now().AddDate(-1, 0, 0))
-	var err error
-	if date != "" {
-		undate, err = strconv.Atoi(date)
-		if err != nil {
-			log.Print(err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-	}
-	log.Printf("Date of the unembargo data is %d.", undate)
-	err = embargo.UnembargoCron(undate)
-	if err != nil {
-		log.Print(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	query := r.URL.Query()
+	if query.Get("date") == "" && query.Get("start") == "" && query.Get("end") == "" {
+		undate := embargo.FormatDateAsInt(time.Now().AddDate(-1, 0, 0))
+		query.Set("date", strconv.Itoa(undate))
+		r.URL.RawQuery = query.Encode()
 	}
-	log.Println("success")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	apiServer.handleUnembargo(w, r)
 }
 
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "ok")
 }
 
+// Budget of the shutdown. App Engine flex sends SIGTERM and kills the
+// instance about 30 seconds later, so all the steps end within
+// shutdownTimeout: draining the jobs, cancelGrace for the canceled ones to
+// stop and record what they did not process, and stopTimeout for the servers
+// and the last traces.
+const (
+	shutdownTimeout     = 27 * time.Second
+	cancelGrace         = 3 * time.Second
+	stopTimeout         = 2 * time.Second
+	defaultDrainTimeout = shutdownTimeout - cancelGrace - stopTimeout
+)
+
+// defaultLagWindow is the number of days checked by /status/lag.
+const defaultLagWindow = 7
+
+// lagWindow returns the number of days checked by /status/lag, from
+// EMBARGO_LAG_WINDOW_DAYS or the default.
+func lagWindow() int {
+	if v := os.Getenv("EMBARGO_LAG_WINDOW_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err == nil && days >= 1 && days <= maxRangeDays {
+			return days
+		}
+		log.Printf("Invalid EMBARGO_LAG_WINDOW_DAYS %q\n", v)
+	}
+	return defaultLagWindow
+}
+
+// drainTimeout returns how long running jobs may take to finish after
+// SIGTERM, from EMBARGO_DRAIN_TIMEOUT (like "20s") or the default, but no
+// more than leaves cancelGrace and stopTimeout before deadline.
+func drainTimeout(deadline time.Time) time.Duration {
+	d := defaultDrainTimeout
+	if v := os.Getenv("EMBARGO_DRAIN_TIMEOUT"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err == nil {
+			d = parsed
+		} else {
+			log.Printf("Invalid EMBARGO_DRAIN_TIMEOUT %q: %v\n", v, err)
+		}
+	}
+	if max := time.Until(deadline) - cancelGrace - stopTimeout; d > max {
+		d = max
+	}
+	return d
+}
+
 func main() {
-	http.HandleFunc("/submit", EmbargoHandler)
+	// EMBARGO_TRACE_EXPORTER is "stdout", "otlp" or empty for no tracing.
+	shutdownTracing, err := tracing.Setup(context.Background(), os.Getenv("EMBARGO_TRACE_EXPORTER"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	auth := authConfigFromEnv()
+	http.HandleFunc("/submit", requireAuth("/submit", tracing.HandlerFunc("/submit", EmbargoHandler), auth.manual...))
 	http.HandleFunc("/_ah/health", healthCheckHandler)
-	http.HandleFunc("/cron/update_embargo_whitelist", updateEmbargoWhitelist)
-	http.HandleFunc("/cron/unembargo", unEmbargoCron)
-	metrics.SetupPrometheus()
-	log.Print("Listening on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	http.HandleFunc("/cron/update_embargo_whitelist",
+		requireAuth("/cron/update_embargo_whitelist",
+			tracing.HandlerFunc("/cron/update_embargo_whitelist", updateEmbargoWhitelist), auth.cron...))
+	http.HandleFunc("/cron/unembargo",
+		requireAuth("/cron/unembargo", tracing.HandlerFunc("/cron/unembargo", unEmbargoCron), auth.cron...))
+	apiServer.register(http.DefaultServeMux, auth)
+	metricsServer := metrics.SetupPrometheus()
+
+	srv := &http.Server{Addr: ":8080"}
+	go func() {
+		log.Print("Listening on port 8080")
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	sig := <-sigs
+	log.Printf("Received %v, draining running jobs.\n", sig)
+	deadline := time.Now().Add(shutdownTimeout)
+
+	// Stop taking new jobs, let the running ones finish, cancel the rest.
+	// Interrupted jobs record what they did not process.
+	for _, j := range apiServer.jobs.drain(drainTimeout(deadline), cancelGrace) {
+		log.Printf("Job %s did not stop in time, keys %v may be incomplete.\n", j.ID, j.Keys)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Cannot shut down the server: %v\n", err)
+	}
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		log.Printf("Cannot shut down the metrics server: %v\n", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Cannot flush the traces: %v\n", err)
+	}
+	log.Print("Server stopped.")
 }
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl/storage"
+
+	"github.com/m-lab/etl-embargo"
+	"github.com/m-lab/etl-embargo/metrics"
+)
+
+// Kinds of embargo requests accepted by /submit.
+const (
+	kindFile  = "file"
+	kindDay   = "day"
+	kindRange = "range"
+)
+
+// maxRangeDays limits how many days a single range request may cover.
+const maxRangeDays = 366
+
+// supportedDatasets lists the datasets the embargo service knows how to split.
+var supportedDatasets = map[string]bool{
+	"sidestream": true,
+}
+
+// embargoRequest is a validated request to embargo a file, a day or a range
+// of days of one dataset.
+type embargoRequest struct {
+	Kind    string
+	Dataset string
+	// File is the object path in the source bucket, for kindFile.
+	File string
+	// Dates are in format yyyymmdd, for kindDay and kindRange.
+	Dates []string
+}
+
+// keys returns the names used to detect duplicate in-progress jobs: the
+// file, or the dataset/yyyymmdd of each day.
+func (er *embargoRequest) keys() []string {
+	if er.Kind == kindFile {
+		return []string{er.File}
+	}
+	keys := make([]string, len(er.Dates))
+	for i, d := range er.Dates {
+		keys[i] = er.Dataset + "/" + d
+	}
+	return keys
+}
+
+// within returns the key of the day job that also embargoes the file, if
+// any, so that both do not run at once. Day jobs embargo the archives in
+// the directory of their DatePrefix.
+func (er *embargoRequest) within() []string {
+	if er.Kind != kindFile {
+		return nil
+	}
+	dirs := strings.Split(path.Dir(er.File), "/")
+	if len(dirs) != 4 {
+		return nil
+	}
+	date := dirs[1] + dirs[2] + dirs[3]
+	if _, err := time.Parse("20060102", date); err != nil {
+		return nil
+	}
+	return []string{er.Dataset + "/" + date}
+}
+
+// embargoResponse summarizes what an embargo request processed.
+type embargoResponse struct {
+	Job       string   `json:"job"`
+	Kind      string   `json:"kind"`
+	Dataset   string   `json:"dataset"`
+	File      string   `json:"file,omitempty"`
+	Dates     []string `json:"dates,omitempty"`
+	Embargoed []string `json:"embargoed"`
+}
+
+// errorResponse is the JSON body of every error reply.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// parseDate parses a date in format yyyymmdd.
+func parseDate(name, value string) (time.Time, error) {
+	t, err := time.Parse("20060102", value)
+	if err != nil {
+		return t, fmt.Errorf("invalid %s %q, want yyyymmdd", name, value)
+	}
+	if t.After(time.Now().UTC()) {
+		return t, fmt.Errorf("%s %s is in the future", name, value)
+	}
+	return t, nil
+}
+
+// parseEmbargoRequest validates the query of an embargo request. Exactly one of
+// file, date or start/end must be given. dataset defaults to sidestream.
+func parseEmbargoRequest(query url.Values) (*embargoRequest, error) {
+	er := &embargoRequest{Dataset: query.Get("dataset")}
+	if er.Dataset == "" {
+		er.Dataset = "sidestream"
+	}
+	if !supportedDatasets[er.Dataset] {
+		return nil, fmt.Errorf("unsupported dataset %q", er.Dataset)
+	}
+
+	file := query.Get("file")
+	if file == "" {
+		dates, err := parseDates(query)
+		if err != nil {
+			return nil, err
+		}
+		er.Kind = kindDay
+		if len(dates) > 1 || query.Get("start") != "" {
+			er.Kind = kindRange
+		}
+		er.Dates = dates
+		return er, nil
+	}
+	if query.Get("date") != "" || query.Get("start") != "" || query.Get("end") != "" {
+		return nil, errors.New("exactly one of file, date or start/end is required")
+	}
+
+	fn, err := storage.GetFilename(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename: %v", err)
+	}
+	if !strings.HasPrefix(fn, "gs://") {
+		return nil, fmt.Errorf("invalid filename %q, want gs://bucket/path", fn)
+	}
+	slash := strings.IndexByte(fn[5:], '/')
+	if slash <= 0 || 5+slash+1 >= len(fn) {
+		return nil, fmt.Errorf("invalid filename %q, want gs://bucket/path", fn)
+	}
+	er.Kind = kindFile
+	er.File = fn[5+slash+1:]
+	if !strings.HasPrefix(er.File, er.Dataset+"/") || !embargo.IsArchiveName(er.File) {
+		return nil, fmt.Errorf("%s is not a %s archive", er.File, er.Dataset)
+	}
+	return er, nil
+}
+
+// parseLagWindow returns the number of days of the days parameter, from 1
+// to maxRangeDays, or def if it is not set.
+func parseLagWindow(query url.Values, def int) (int, error) {
+	v := query.Get("days")
+	if v == "" {
+		return def, nil
+	}
+	days, err := strconv.Atoi(v)
+	if err != nil || days < 1 || days > maxRangeDays {
+		return 0, fmt.Errorf("days must be a number from 1 to %d", maxRangeDays)
+	}
+	return days, nil
+}
+
+// parseDates returns the days selected by either date, or start and end,
+// in format yyyymmdd.
+func parseDates(query url.Values) ([]string, error) {
+	date, start, end := query.Get("date"), query.Get("start"), query.Get("end")
+	if date != "" {
+		if start != "" || end != "" {
+			return nil, errors.New("exactly one of file, date or start/end is required")
+		}
+		if _, err := parseDate("date", date); err != nil {
+			return nil, err
+		}
+		return []string{date}, nil
+	}
+	if start == "" && end == "" {
+		return nil, errors.New("exactly one of file, date or start/end is required")
+	}
+	if start == "" || end == "" {
+		return nil, errors.New("both start and end are required")
+	}
+	s, err := parseDate("start", start)
+	if err != nil {
+		return nil, err
+	}
+	e, err := parseDate("end", end)
+	if err != nil {
+		return nil, err
+	}
+	if e.Before(s) {
+		return nil, errors.New("end is before start")
+	}
+	if e.Sub(s) >= maxRangeDays*24*time.Hour {
+		return nil, fmt.Errorf("range covers more than %d days", maxRangeDays)
+	}
+	var dates []string
+	for d := s; !d.After(e); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d.Format("20060102"))
+	}
+	return dates, nil
+}
+
+// Status of a job.
+const (
+	jobRunning     = "running"
+	jobSucceeded   = "succeeded"
+	jobFailed      = "failed"
+	jobInterrupted = "interrupted"
+)
+
+// maxFinishedJobs is how many finished jobs are remembered for status queries.
+const maxFinishedJobs = 100
+
+// Errors returned by jobTracker.start.
+var (
+	errJobConflict  = errors.New("a job for the same data is already running")
+	errShuttingDown = errors.New("the server is shutting down")
+)
+
+// job is one embargo or unembargo run, as reported by the job status API.
+type job struct {
+	ID       string     `json:"id"`
+	Action   string     `json:"action"`
+	Keys     []string   `json:"keys"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Interrupted lists the keys that were not processed because the
+	// server shut down. They should be retried.
+	Interrupted []string `json:"interrupted,omitempty"`
+	// seq orders the jobs by creation.
+	seq int
+	// within are the day keys the files of the job are within.
+	within []string
+}
+
+// jobTracker remembers which files and days are being processed, so that
+// a duplicate request, or a day request covering a file being processed, is
+// rejected instead of racing the running one, and keeps the recently
+// finished jobs for status queries.
+// Jobs run under ctx, which is canceled when draining times out.
+type jobTracker struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	closed  bool
+	nextID  int
+	running map[string]*job
+	jobs    map[string]*job
+	// files counts the running file jobs within each day key.
+	files    map[string]int
+	finished []string
+}
+
+func newJobTracker() *jobTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobTracker{
+		ctx:     ctx,
+		cancel:  cancel,
+		running: make(map[string]*job),
+		jobs:    make(map[string]*job),
+		files:   make(map[string]int),
+	}
+}
+
+// start creates a running job covering keys, files within the day keys
+// within if any. It returns errJobConflict without creating anything if one
+// of the keys is already running, or is a day with a file being processed,
+// or if one of the days within is running, and errShuttingDown once drain
+// was called.
+func (jt *jobTracker) start(action string, keys, within []string) (*job, error) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	if jt.closed {
+		return nil, errShuttingDown
+	}
+	for _, k := range keys {
+		if _, ok := jt.running[k]; ok || jt.files[k] > 0 {
+			return nil, errJobConflict
+		}
+	}
+	for _, d := range within {
+		if _, ok := jt.running[d]; ok {
+			return nil, errJobConflict
+		}
+	}
+	jt.nextID++
+	j := &job{
+		ID:      fmt.Sprintf("%d-%d", time.Now().Unix(), jt.nextID),
+		seq:     jt.nextID,
+		Action:  action,
+		Keys:    keys,
+		Status:  jobRunning,
+		Started: time.Now().UTC(),
+		within:  within,
+	}
+	for _, k := range keys {
+		jt.running[k] = j
+	}
+	for _, d := range within {
+		jt.files[d]++
+	}
+	jt.jobs[j.ID] = j
+	jt.wg.Add(1)
+	metrics.JobsInFlight.WithLabelValues(action).Inc()
+	return j, nil
+}
+
+// done marks the job as finished. It failed if err is not nil, and was
+// interrupted if some keys were not processed.
+func (jt *jobTracker) done(j *job, err error, interrupted []string) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	for _, k := range j.Keys {
+		delete(jt.running, k)
+	}
+	for _, d := range j.within {
+		if jt.files[d]--; jt.files[d] == 0 {
+			delete(jt.files, d)
+		}
+	}
+	now := time.Now().UTC()
+	j.Finished = &now
+	j.Status = jobSucceeded
+	if err != nil {
+		j.Status = jobFailed
+		j.Error = err.Error()
+	}
+	if len(interrupted) > 0 {
+		j.Status = jobInterrupted
+		j.Interrupted = interrupted
+	}
+	metrics.JobsInFlight.WithLabelValues(j.Action).Dec()
+	jt.finished = append(jt.finished, j.ID)
+	if len(jt.finished) > maxFinishedJobs {
+		delete(jt.jobs, jt.finished[0])
+		jt.finished = jt.finished[1:]
+	}
+	jt.wg.Done()
+}
+
+// drain stops accepting new jobs and waits for the running ones to finish.
+// If they are still running after timeout, their context is canceled and
+// drain waits up to grace more for them to stop. It returns the jobs that
+// did not finish in time.
+func (jt *jobTracker) drain(timeout, grace time.Duration) []job {
+	jt.mu.Lock()
+	jt.closed = true
+	jt.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		jt.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-time.After(timeout):
+	}
+	log.Printf("Jobs still running after %v, canceling them.\n", timeout)
+	jt.cancel()
+	select {
+	case <-finished:
+	case <-time.After(grace):
+	}
+	var stuck []job
+	for _, j := range jt.list() {
+		if j.Status == jobRunning {
+			stuck = append(stuck, j)
+		}
+	}
+	return stuck
+}
+
+// get returns a copy of the job with the given id.
+func (jt *jobTracker) get(id string) (job, bool) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	j, ok := jt.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// list returns copies of all known jobs, oldest first.
+func (jt *jobTracker) list() []job {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	jobs := make([]job, 0, len(jt.jobs))
+	for _, j := range jt.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].seq < jobs[b].seq })
+	return jobs
+}
+
+// writeJSON writes v as the JSON body of a reply with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("cannot write JSON response: %v\n", err)
+	}
+}
+
+// writeError writes a JSON error reply with the given status.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseEmbargoRequest(t *testing.T) {
+	file := "gs://scraper-mlab-sandbox/sidestream/2017/05/29/20170529T000000Z-mlab1-atl02-sidestream-0000.tgz"
+	tests := []struct {
+		query   string
+		wantErr bool
+		want    *embargoRequest
+	}{
+		{query: "", wantErr: true},
+		{query: "date=20170529&file=abc", wantErr: true},
+		{query: "date=2017-05-29", wantErr: true},
+		{query: "date=29990101", wantErr: true},
+		{query: "date=20170529&dataset=ndt", wantErr: true},
+		{query: "start=20170529", wantErr: true},
+		{query: "start=20170530&end=20170529", wantErr: true},
+		{query: "start=20150101&end=20170101", wantErr: true},
+		{query: "file=" + url.QueryEscape(base64.StdEncoding.EncodeToString([]byte("gs://bucket"))), wantErr: true},
+		{query: "file=" + url.QueryEscape(base64.StdEncoding.EncodeToString([]byte("gs://bucket/ndt/a.tgz"))), wantErr: true},
+		{
+			query: "date=20170529",
+			want:  &embargoRequest{Kind: kindDay, Dataset: "sidestream", Dates: []string{"20170529"}},
+		},
+		{
+			query: "start=20170530&end=20170601",
+			want:  &embargoRequest{Kind: kindRange, Dataset: "sidestream", Dates: []string{"20170530", "20170531", "20170601"}},
+		},
+		{
+			query: "file=" + url.QueryEscape(base64.StdEncoding.EncodeToString([]byte(file))),
+			want:  &embargoRequest{Kind: kindFile, Dataset: "sidestream", File: file[len("gs://scraper-mlab-sandbox/"):]},
+		},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := parseEmbargoRequest(query)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseEmbargoRequest(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseEmbargoRequest(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestJobTracker(t *testing.T) {
+	jt := newJobTracker()
+	j, err := jt.start("embargo", []string{"sidestream/20170529", "sidestream/20170530"}, nil)
+	if err != nil {
+		t.Fatal("cannot start a job")
+	}
+	if _, err := jt.start("embargo", []string{"sidestream/20170530"}, nil); err != errJobConflict {
+		t.Errorf("start() overlapping a running job = %v, want %v", err, errJobConflict)
+	}
+	jt.done(j, nil, nil)
+	if _, err := jt.start("embargo", []string{"sidestream/20170530"}, nil); err != nil {
+		t.Error("cannot start a job once the overlapping one is done")
+	}
+	got, ok := jt.get(j.ID)
+	if !ok || got.Status != jobSucceeded || got.Finished == nil {
+		t.Errorf("get(%s) = %+v, %v, want a succeeded job", j.ID, got, ok)
+	}
+	if jobs := jt.list(); len(jobs) != 2 || jobs[0].ID != j.ID || jobs[1].Status != jobRunning {
+		t.Errorf("list() = %+v, want the finished job then the running one", jobs)
+	}
+}
+
+func TestJobTrackerFileWithinDay(t *testing.T) {
+	file := &embargoRequest{Kind: kindFile, Dataset: "sidestream",
+		File: "sidestream/2017/05/29/20170529T000000Z-mlab1-atl02-sidestream-0000.tgz"}
+	day := &embargoRequest{Kind: kindDay, Dataset: "sidestream", Dates: []string{"20170528", "20170529"}}
+	if within := file.within(); !reflect.DeepEqual(within, []string{"sidestream/20170529"}) {
+		t.Fatalf("within() = %v, want [sidestream/20170529]", within)
+	}
+
+	jt := newJobTracker()
+	j, err := jt.start("embargo", file.keys(), file.within())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jt.start("embargo", day.keys(), day.within()); err != errJobConflict {
+		t.Errorf("start() of the day of a running file = %v, want %v", err, errJobConflict)
+	}
+	other := &embargoRequest{Kind: kindFile, Dataset: "sidestream",
+		File: "sidestream/2017/05/29/20170529T000000Z-mlab1-atl02-sidestream-0001.tgz"}
+	o, err := jt.start("embargo", other.keys(), other.within())
+	if err != nil {
+		t.Errorf("start() of another file of the same day = %v", err)
+	}
+	jt.done(j, nil, nil)
+	jt.done(o, nil, nil)
+	d, err := jt.start("embargo", day.keys(), day.within())
+	if err != nil {
+		t.Fatalf("start() of the day once its files are done = %v", err)
+	}
+	if _, err := jt.start("embargo", file.keys(), file.within()); err != errJobConflict {
+		t.Errorf("start() of a file of a running day = %v, want %v", err, errJobConflict)
+	}
+	jt.done(d, nil, nil)
+}
+
+func TestJobTrackerDrain(t *testing.T) {
+	jt := newJobTracker()
+	quick, _ := jt.start("embargo", []string{"sidestream/20170529"}, nil)
+	slow, _ := jt.start("embargo", []string{"sidestream/20170530"}, nil)
+	go jt.done(quick, nil, nil)
+	go func() {
+		// The slow job only stops when canceled.
+		<-jt.ctx.Done()
+		jt.done(slow, jt.ctx.Err(), []string{"sidestream/20170530"})
+	}()
+
+	if stuck := jt.drain(10*time.Millisecond, time.Second); len(stuck) != 0 {
+		t.Errorf("drain() = %+v, want no stuck jobs", stuck)
+	}
+	if _, err := jt.start("embargo", []string{"sidestream/20170531"}, nil); err != errShuttingDown {
+		t.Errorf("start() after drain = %v, want %v", err, errShuttingDown)
+	}
+	got, _ := jt.get(slow.ID)
+	if got.Status != jobInterrupted || len(got.Interrupted) != 1 {
+		t.Errorf("slow job = %+v, want it interrupted", got)
+	}
+}
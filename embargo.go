@@ -8,7 +8,8 @@ package embargo
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -16,14 +17,16 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"golang.org/x/net/context"
-	storage "google.golang.org/api/storage/v1"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/m-lab/etl-embargo/metrics"
+	"github.com/m-lab/etl-embargo/tracing"
 )
 
 // EmbargoConfig is a struct that performs all embargo procedures.
@@ -31,8 +34,41 @@ type EmbargoConfig struct {
 	sourceBucket      string
 	destPrivateBucket string
 	destPublicBucket  string
-	whitelistChecker  WhitelistChecker
-	embargoService    *storage.Service
+	store             ObjectStore
+	// mu guards whitelistChecker and clientNetworks, which reloads replace
+	// while the jobs read them. The values they point to are not changed.
+	mu               sync.RWMutex
+	whitelistChecker *WhitelistChecker
+	// reloadMu serializes the reloads and the diffs of the whitelist.
+	reloadMu sync.Mutex
+	// siteIPURL and siteIPFile tell where the whitelist was loaded from,
+	// so that it can be reloaded from the same place.
+	siteIPURL  string
+	siteIPFile string
+	// preserveHeaders makes SplitFile keep the headers and the entries
+	// other than regular files of the input archives.
+	preserveHeaders bool
+	// output is the codec of the outputs, or nil for the one of the input.
+	output *Codec
+	// inspectContent makes SplitFile decide from the content of the web100
+	// files as well as from their names.
+	inspectContent bool
+	// clientNetworks are the client networks whose data is withheld or
+	// embargoed, loaded from clientNetworksSource, a URL or a local file,
+	// and cached in clientNetworksCache.
+	clientNetworks       *ClientNetworks
+	clientNetworksSource string
+	clientNetworksCache  WhitelistCache
+	// anonymizer, if set, publishes anonymized copies of embargoed files.
+	anonymizer *Anonymizer
+	// whitelistApprovalRequired makes reloads that remove whole sites wait
+	// for the checksum of the new whitelist to be whitelistApproved.
+	whitelistApprovalRequired bool
+	whitelistApproved         string
+	// whitelistLoader loads the whitelist from siteIPURL, keeping the last
+	// valid list in whitelistCache.
+	whitelistLoader *WhitelistLoader
+	whitelistCache  WhitelistCache
 }
 
 // EmbargoSingleton is the singleton object that is the pointer of the EmbargoConfig object.
@@ -50,7 +86,66 @@ func init() {
 	EmbargoSingleton = nil
 }
 
+// NewEmbargoConfig creates an EmbargoConfig for the given buckets, whitelist
+// and store. The store may be nil if only SplitFile is used.
+func NewEmbargoConfig(sourceBucket, privateBucket, publicBucket string, whitelist WhitelistChecker, store ObjectStore) *EmbargoConfig {
+	return &EmbargoConfig{
+		sourceBucket:      sourceBucket,
+		destPrivateBucket: privateBucket,
+		destPublicBucket:  publicBucket,
+		store:             store,
+		whitelistChecker:  &whitelist,
+		clientNetworks:    &ClientNetworks{},
+	}
+}
+
+// SetPreserveHeaders sets whether SplitFile copies the tar headers of the
+// input unchanged, including owners, access and change times and PAX or GNU
+// extensions, and writes the entries that are not regular files, like
+// directories and symlinks, to both outputs. By default only the name, size,
+// mode and modification time of regular files are kept.
+func (ec *EmbargoConfig) SetPreserveHeaders(preserve bool) {
+	ec.preserveHeaders = preserve
+}
+
+// SetInspectContent sets whether SplitFile reads the local addresses of the
+// connections in the web100 files. Files whose name has no IP, like the
+// legacy *_ALL0.web100 files, are then public if all their local addresses
+// are whitelisted, and files whose content does not match their name are
+// embargoed.
+func (ec *EmbargoConfig) SetInspectContent(inspect bool) {
+	ec.inspectContent = inspect
+}
+
+// SetOutputCodec sets the codec, by name, of the outputs of all archives.
+// An empty name writes the outputs in the format of the input.
+func (ec *EmbargoConfig) SetOutputCodec(name string) error {
+	if name == "" {
+		ec.output = nil
+		return nil
+	}
+	codec := CodecByName(name)
+	if codec == nil || codec.NewWriter == nil {
+		return fmt.Errorf("no codec writing %q", name)
+	}
+	ec.output = codec
+	return nil
+}
+
 // GetEmbargoConfig creates a new EmbargoConfig and returns it.
+// Tar headers are preserved if EMBARGO_PRESERVE_HEADERS is "true", and the
+// outputs are written with the codec named by EMBARGO_OUTPUT_CODEC, if set.
+// The content of the web100 files is inspected if EMBARGO_INSPECT_CONTENT is
+// "true", and the client networks are loaded from EMBARGO_CLIENT_NETWORKS,
+// a URL or a local file, if set. Anonymized copies of the embargoed files
+// are published if EMBARGO_ANONYMIZE is "truncate", or "hash" with the key
+// EMBARGO_ANONYMIZE_KEY. If EMBARGO_WHITELIST_REQUIRE_APPROVAL is "true",
+// reloads removing whole sites need EMBARGO_WHITELIST_APPROVED_SHA256 to be
+// the checksum of the new whitelist. The last valid whitelist is cached in
+// EMBARGO_WHITELIST_CACHE, gs://bucket/name or a local file, by default
+// WhitelistCacheName in the private bucket, and used if the URL fails. The
+// client networks are cached likewise in EMBARGO_CLIENT_NETWORKS_CACHE, by
+// default ClientNetworksCacheName.
 func GetEmbargoConfig(siteIPFile string) (*EmbargoConfig, error) {
 	if EmbargoSingleton != nil {
 		return EmbargoSingleton, nil
@@ -61,162 +156,415 @@ func GetEmbargoConfig(siteIPFile string) (*EmbargoConfig, error) {
 		sourceBucket:      "scraper-" + project,
 		destPrivateBucket: "embargo-" + project,
 		destPublicBucket:  "archive-" + project,
+		whitelistChecker:  &WhitelistChecker{},
+		clientNetworks:    &ClientNetworks{},
 	}
 
 	jsonURL, ok := projectToURL[project]
 	// The project must be one of "mlab-sandbox", "mlab-staging", "mlab-oti", or "mlab-testing".
 	if !ok {
-		return nil, errors.New("this job is running in wrong project")
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProject, project)
 	}
 	log.Printf("json file of site IPs: %s", jsonURL)
-	if siteIPFile == "" {
-		err := ec.whitelistChecker.LoadFromURL(jsonURL)
+	ec.siteIPURL = jsonURL
+	ec.siteIPFile = siteIPFile
+	ec.preserveHeaders = os.Getenv("EMBARGO_PRESERVE_HEADERS") == "true"
+	ec.inspectContent = os.Getenv("EMBARGO_INSPECT_CONTENT") == "true"
+	ec.SetClientNetworksSource(os.Getenv("EMBARGO_CLIENT_NETWORKS"))
+	ec.SetWhitelistApproval(os.Getenv("EMBARGO_WHITELIST_REQUIRE_APPROVAL") == "true",
+		os.Getenv("EMBARGO_WHITELIST_APPROVED_SHA256"))
+	if method := os.Getenv("EMBARGO_ANONYMIZE"); method != "" {
+		anonymizer, err := NewAnonymizer(method, []byte(os.Getenv("EMBARGO_ANONYMIZE_KEY")))
 		if err != nil {
-			log.Printf("Cannot load site IP list from GCS.\n")
-			return nil, err
-		}
-	} else {
-		err := ec.whitelistChecker.LoadFromLocalWhitelist(siteIPFile)
-		if err != nil {
-			log.Printf("Cannot load site IP file from local.\n")
 			return nil, err
 		}
+		ec.anonymizer = anonymizer
+	}
+	if err := ec.SetOutputCodec(os.Getenv("EMBARGO_OUTPUT_CODEC")); err != nil {
+		return nil, err
 	}
-	ec.embargoService = CreateService()
-	if ec.embargoService == nil {
+	service := CreateService()
+	if service == nil {
 		log.Printf("Cannot create storage service.\n")
 		return nil, errors.New("cannot create storage service")
 	}
+	ec.store = NewTracingStore(NewRetryingStore(NewGCSStore(service), DefaultRetryPolicy))
+	ec.SetWhitelistCache(ec.cacheFromEnv("EMBARGO_WHITELIST_CACHE", WhitelistCacheName))
+	ec.SetClientNetworksCache(ec.cacheFromEnv("EMBARGO_CLIENT_NETWORKS_CACHE", ClientNetworksCacheName))
+	err := ec.ReloadWhitelist()
+	if errors.Is(err, ErrWhitelistNotApproved) && len(ec.Whitelist().keys()) > 0 {
+		// The last approved whitelist is in use until the new one is.
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
 	EmbargoSingleton = ec
 	return ec, nil
 }
 
 // UpdateWhitelist loads the site IP json file again and updates the whitelist in memory.
 func UpdateWhitelist() error {
-	_, err := GetEmbargoConfig("")
+	if EmbargoSingleton == nil {
+		_, err := GetEmbargoConfig("")
+		return err
+	}
+	return EmbargoSingleton.ReloadWhitelist()
+}
+
+// ReloadWhitelist loads the whitelist again from the URL or local file it was
+// first loaded from, and the client networks too. The whitelist in use, or
+// at startup the last approved one, is kept if the new one removes whole
+// sites without approval, see SetWhitelistApproval. If the URL fails, the
+// last accepted list is used, see WhitelistLoader. If the client networks
+// cannot be loaded, the error is only logged and those in use, or the
+// cached ones, are kept.
+func (ec *EmbargoConfig) ReloadWhitelist() error {
+	ec.reloadMu.Lock()
+	defer ec.reloadMu.Unlock()
+	ctx := context.Background()
+	if err := ec.reloadClientNetworks(ctx); err != nil {
+		// The whitelist is reloaded anyway.
+		log.Printf("Cannot load client networks, keeping those in use: %v\n", err)
+	}
+	fetched, candidate, err := ec.fetchWhitelist(ctx, "")
+	if err != nil {
+		if ec.siteIPFile != "" {
+			log.Printf("Cannot load site IP file from local.\n")
+			return err
+		}
+		log.Printf("Cannot load site IP list from GCS.\n")
+		return ec.useAcceptedWhitelist(ctx, err)
+	}
+	base := ec.approvedWhitelist(ctx)
+	if err := ec.approve(base, base.DiffSites(candidate)); err != nil {
+		log.Printf("Keeping the whitelist in use: %v\n", err)
+		if len(ec.Whitelist().keys()) == 0 {
+			ec.setWhitelist(base)
+		}
+		return err
+	}
+	ec.acceptWhitelist(ctx, fetched)
+	ec.setWhitelist(candidate)
+	metrics.WhitelistStale.Set(0)
+	metrics.WhitelistValidatedTimestamp.Set(float64(fetched.Validated.Unix()))
+	metrics.LastSuccessTimestamp.WithLabelValues("sidestream", "reload").SetToCurrentTime()
+	return nil
+}
+
+// useAcceptedWhitelist uses the last accepted whitelist after the URL failed
+// with err, which it returns if there is no such list.
+func (ec *EmbargoConfig) useAcceptedWhitelist(ctx context.Context, err error) error {
+	accepted := ec.urlLoader().Fallback(ctx)
+	if accepted == nil {
+		return err
+	}
+	checker, err := accepted.checker()
 	if err != nil {
 		return err
 	}
+	ec.setWhitelist(checker)
+	metrics.WhitelistStale.Set(1)
+	metrics.WhitelistValidatedTimestamp.Set(float64(accepted.Validated.Unix()))
 	return nil
 }
 
+// Whitelist returns the whitelist currently used for embargo decisions. A
+// reload replaces it rather than changing it, so it must not be changed.
+func (ec *EmbargoConfig) Whitelist() *WhitelistChecker {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	return ec.whitelistChecker
+}
+
+// setWhitelist replaces the whitelist used for embargo decisions.
+func (ec *EmbargoConfig) setWhitelist(wc *WhitelistChecker) {
+	ec.mu.Lock()
+	ec.whitelistChecker = wc
+	ec.mu.Unlock()
+	metrics.WhitelistSize.Set(float64(len(wc.keys())))
+}
+
+// DatePrefix returns the object prefix of one day of a dataset.
+// The date is string in format yyyymmdd, the prefix is like sidestream/yyyy/mm/dd
+func DatePrefix(dataset, date string) string {
+	return dataset + "/" + date[0:4] + "/" + date[4:6] + "/" + date[6:8]
+}
+
 // WriteResults writes results to GCS.
-func (ec *EmbargoConfig) WriteResults(tarfileName string, embargoBuf, publicBuf bytes.Buffer) error {
-	embargoTarfileName := strings.Replace(tarfileName, ".tgz", "-e.tgz", -1)
-	publicObject := &storage.Object{Name: tarfileName}
-	embargoObject := &storage.Object{Name: embargoTarfileName}
-	if _, err := ec.embargoService.Objects.Insert(ec.destPublicBucket, publicObject).Media(&publicBuf).Do(); err != nil {
+func (ec *EmbargoConfig) WriteResults(ctx context.Context, tarfileName string, embargoBuf, publicBuf bytes.Buffer) error {
+	embargoTarfileName := EmbargoedName(tarfileName)
+	if err := ec.store.WriteObject(ctx, ec.destPublicBucket, tarfileName, publicBuf.Bytes(), ""); err != nil {
+		err = storageError("write", ec.destPublicBucket, tarfileName, err)
+		log.Printf("Objects insert failed: %v\n", err)
+		return err
+	}
+	metrics.Metrics_embargoTarOutputTotal.WithLabelValues("sidestream", "public").Inc()
+	metrics.OutputBytesTotal.WithLabelValues("sidestream", "public").Add(float64(publicBuf.Len()))
+
+	if err := ec.store.WriteObject(ctx, ec.destPrivateBucket, embargoTarfileName, embargoBuf.Bytes(), ""); err != nil {
+		err = storageError("write", ec.destPrivateBucket, embargoTarfileName, err)
 		log.Printf("Objects insert failed: %v\n", err)
 		return err
-	} else {
-		metrics.Metrics_embargoTarOutputTotal.WithLabelValues("sidestream", "public").Inc()
 	}
+	metrics.Metrics_embargoTarOutputTotal.WithLabelValues("sidestream", "private").Inc()
+	metrics.OutputBytesTotal.WithLabelValues("sidestream", "private").Add(float64(embargoBuf.Len()))
+	return nil
+}
 
-	if _, err := ec.embargoService.Objects.Insert(ec.destPrivateBucket, embargoObject).Media(&embargoBuf).Do(); err != nil {
+// writeWithheld writes the withheld members of tarfileName to the private
+// bucket.
+func (ec *EmbargoConfig) writeWithheld(ctx context.Context, tarfileName string, withheldBuf bytes.Buffer) error {
+	withheldTarfileName := WithheldName(tarfileName)
+	if err := ec.store.WriteObject(ctx, ec.destPrivateBucket, withheldTarfileName, withheldBuf.Bytes(), ""); err != nil {
+		err = storageError("write", ec.destPrivateBucket, withheldTarfileName, err)
 		log.Printf("Objects insert failed: %v\n", err)
 		return err
-	} else {
-		metrics.Metrics_embargoTarOutputTotal.WithLabelValues("sidestream", "private").Inc()
 	}
+	metrics.Metrics_embargoTarOutputTotal.WithLabelValues("sidestream", "withheld").Inc()
+	metrics.OutputBytesTotal.WithLabelValues("sidestream", "withheld").Add(float64(withheldBuf.Len()))
 	return nil
 }
 
+// InterruptedPrefix is the prefix, in the private bucket, of the records of
+// jobs interrupted by a shutdown.
+const InterruptedPrefix = "interrupted/"
+
+// RecordInterrupted writes the keys that the job did not process to
+// InterruptedPrefix + jobID + ".json" in the private bucket, so that they
+// can be retried.
+// It is called after the job context was canceled, so it takes its own ctx.
+func (ec *EmbargoConfig) RecordInterrupted(ctx context.Context, jobID, action string, keys []string) error {
+	record, err := json.Marshal(struct {
+		Job         string   `json:"job"`
+		Action      string   `json:"action"`
+		Interrupted []string `json:"interrupted"`
+		Time        string   `json:"time"`
+	}{jobID, action, keys, time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		return err
+	}
+	if err := ec.store.WriteObject(ctx, ec.destPrivateBucket, InterruptedPrefix+jobID+".json", record, "application/json"); err != nil {
+		err = storageError("write", ec.destPrivateBucket, InterruptedPrefix+jobID+".json", err)
+		log.Printf("Objects insert failed: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// outputCodec returns the codec of the outputs of an archive in the format
+// of input: the one set with SetOutputCodec, else input if it can write,
+// else gzip.
+func (ec *EmbargoConfig) outputCodec(input *Codec) *Codec {
+	switch {
+	case ec.output != nil:
+		return ec.output
+	case input != nil && input.NewWriter != nil:
+		return input
+	}
+	return GzipCodec
+}
+
 // SplitFile splits one tar files into 2 buffers.
-func (ec *EmbargoConfig) SplitFile(content io.Reader, moreThanOneYear bool) (bytes.Buffer, bytes.Buffer, error) {
-	var embargoBuf bytes.Buffer
-	var publicBuf bytes.Buffer
+// The archive may be compressed with any registered codec; the outputs are
+// compressed with the codec given by outputCodec.
+// Members withheld for the client networks of their connections are in
+// neither buffer; EmbargoOneTar writes them to a separate archive.
+// It stops between tar members and returns ctx.Err() once ctx is done.
+func (ec *EmbargoConfig) SplitFile(ctx context.Context, content io.Reader, moreThanOneYear bool) (bytes.Buffer, bytes.Buffer, error) {
+	out, err := ec.splitArchive(ctx, content, moreThanOneYear)
+	if err != nil {
+		return bytes.Buffer{}, bytes.Buffer{}, err
+	}
+	return out.private.buf, out.public.buf, nil
+}
+
+// archiveWriter writes one output archive of splitArchive.
+type archiveWriter struct {
+	side    string
+	buf     bytes.Buffer
+	zw      io.WriteCloser
+	tw      *tar.Writer
+	members int
+}
+
+func newArchiveWriter(side string, codec *Codec) (*archiveWriter, error) {
+	w := &archiveWriter{side: side}
+	zw, err := codec.NewWriter(&w.buf)
+	if err != nil {
+		return nil, err
+	}
+	w.zw = zw
+	w.tw = tar.NewWriter(zw)
+	return w, nil
+}
+
+// add writes one member.
+func (w *archiveWriter) add(hdr *tar.Header, data []byte) error {
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		log.Printf("cannot write the %s header of %s: %v\n", w.side, hdr.Name, err)
+		return err
+	}
+	if _, err := w.tw.Write(data); err != nil {
+		log.Printf("cannot write the %s content of %s to a buffer: %v\n", w.side, hdr.Name, err)
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		w.members++
+	}
+	return nil
+}
+
+// close flushes the tar and compressed streams to buf.
+func (w *archiveWriter) close() error {
+	if err := w.tw.Close(); err != nil {
+		log.Println("cannot close tar writer", err)
+		return err
+	}
+	if err := w.zw.Close(); err != nil {
+		log.Println("cannot close tar writer", err)
+		return err
+	}
+	return nil
+}
+
+// splitOutputs are the outputs of splitArchive.
+type splitOutputs struct {
+	private, public, withheld *archiveWriter
+	// codec is the codec of the outputs.
+	codec *Codec
+	stats *TarStats
+	// reasons counts the members by reason of the decision.
+	reasons map[string]int
+}
+
+// attributes describe the members of the outputs, for the split span.
+func (o *splitOutputs) attributes() []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.Int("skipped_non_regular", o.stats.SkippedNonRegular),
+		attribute.Int("parse_failures", o.stats.ParseFailures),
+	}
+	for side, s := range o.stats.Sides {
+		attrs = append(attrs, attribute.Int("members."+side, s.Members))
+	}
+	for reason, n := range o.reasons {
+		attrs = append(attrs, attribute.Int("decisions."+reason, n))
+	}
+	return attrs
+}
+
+// writer returns the output of side.
+func (o *splitOutputs) writer(side string) *archiveWriter {
+	switch side {
+	case sidePublic:
+		return o.public
+	case sideWithheld:
+		return o.withheld
+	}
+	return o.private
+}
+
+// splitArchive is SplitFile, also returning the withheld members, the codec
+// of the outputs and the statistics of the members.
+func (ec *EmbargoConfig) splitArchive(ctx context.Context, content io.Reader, moreThanOneYear bool) (*splitOutputs, error) {
 	// Create tar reader
-	zipReader, err := gzip.NewReader(content)
+	zipReader, inputCodec, err := OpenArchive(content)
 	if err != nil {
-		log.Printf("zip reader failed to be created: %v\n", err)
-		return embargoBuf, publicBuf, err
+		log.Printf("archive reader failed to be created: %v\n", err)
+		return nil, err
 	}
 	defer zipReader.Close()
 	unzippedBytes, err := ioutil.ReadAll(zipReader)
 	if err != nil {
-		log.Printf("cannot read the bytes from zip reader: %v\n", err)
-		return embargoBuf, publicBuf, err
+		log.Printf("cannot read the bytes from %s reader: %v\n", inputCodec.Name, err)
+		return nil, fmt.Errorf("%w: %v", ErrCorruptArchive, err)
 	}
 	unzippedReader := bytes.NewReader(unzippedBytes)
 	tarReader := tar.NewReader(unzippedReader)
 
-	embargoGzw := gzip.NewWriter(&embargoBuf)
-	publicGzw := gzip.NewWriter(&publicBuf)
-	embargoTw := tar.NewWriter(embargoGzw)
-	publicTw := tar.NewWriter(publicGzw)
+	out := &splitOutputs{codec: ec.outputCodec(inputCodec), stats: NewTarStats(), reasons: make(map[string]int)}
+	out.stats.Archives = 1
+	if out.private, err = newArchiveWriter(sidePrivate, out.codec); err != nil {
+		return nil, err
+	}
+	if out.public, err = newArchiveWriter(sidePublic, out.codec); err != nil {
+		return nil, err
+	}
+	if out.withheld, err = newArchiveWriter(sideWithheld, out.codec); err != nil {
+		return nil, err
+	}
 
 	// Handle the small files inside one tar file.
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			log.Printf("can not read the header file correctly: %v\n", err)
-			return embargoBuf, publicBuf, err
+			return nil, fmt.Errorf("%w: %v", ErrCorruptArchive, err)
 		}
 		if header.Typeflag != tar.TypeReg {
+			if !ec.preserveHeaders {
+				out.stats.SkippedNonRegular++
+				continue
+			}
+			// Both outputs keep the layout of the input.
+			data, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				log.Printf("cannot read the tar file: %v\n", err)
+				return nil, fmt.Errorf("%w: %v", ErrCorruptArchive, err)
+			}
+			for _, w := range []*archiveWriter{out.public, out.private} {
+				if err := w.add(header, data); err != nil {
+					return nil, err
+				}
+			}
 			continue
 		}
 		basename := filepath.Base(header.Name)
-		info := header.FileInfo()
 		hdr := new(tar.Header)
-		hdr.Name = header.Name
-		hdr.Size = info.Size()
-		hdr.Mode = int64(info.Mode())
-		hdr.ModTime = info.ModTime()
-		hdr.Typeflag = tar.TypeReg
+		if ec.preserveHeaders {
+			*hdr = *header
+		} else {
+			info := header.FileInfo()
+			hdr.Name = header.Name
+			hdr.Size = info.Size()
+			hdr.Mode = int64(info.Mode())
+			hdr.ModTime = info.ModTime()
+			hdr.Typeflag = tar.TypeReg
+		}
 		output, err := ioutil.ReadAll(tarReader)
 		if err != nil {
 			log.Printf("cannot read the tar file: %v\n", err)
-			return embargoBuf, publicBuf, err
+			return nil, fmt.Errorf("%w: %v", ErrCorruptArchive, err)
 		}
-		if moreThanOneYear || !strings.Contains(basename, "web100") || ec.whitelistChecker.CheckInWhiteList(basename) {
-			// put this file to a public buffer
-			if strings.Contains(basename, "web100") {
-				metrics.Metrics_embargoFileTotal.WithLabelValues("sidestream", "public").Inc()
-			}
-			if err := publicTw.WriteHeader(hdr); err != nil {
-				log.Printf("cannot write the public header: %v\n", err)
-				return embargoBuf, publicBuf, err
-			}
-			if _, err := publicTw.Write([]byte(output)); err != nil {
-				log.Printf("cannot write the public content to a buffer: %v\n", err)
-				return embargoBuf, publicBuf, err
-			}
-		} else {
-			// put this file to a private buffer
-			if strings.Contains(basename, "web100") {
-				metrics.Metrics_embargoFileTotal.WithLabelValues("sidestream", "private").Inc()
-			}
-			if err := embargoTw.WriteHeader(hdr); err != nil {
-				log.Printf("cannot write the embargoed header: %v\n", err)
-				return embargoBuf, publicBuf, err
-			}
-			if _, err := embargoTw.Write([]byte(output)); err != nil {
-				log.Printf("cannot write the embargoed content to a buffer: %v\n", err)
-				return embargoBuf, publicBuf, err
+		side, reason := ec.decide(basename, output, moreThanOneYear)
+		metrics.EmbargoDecisionsTotal.WithLabelValues(side, reason).Inc()
+		out.reasons[reason]++
+		if strings.Contains(basename, "web100") {
+			metrics.Metrics_embargoFileTotal.WithLabelValues("sidestream", side).Inc()
+		}
+		if err := out.writer(side).add(hdr, output); err != nil {
+			return nil, err
+		}
+		out.stats.addMember(basename, side, int64(len(output)))
+		if ec.anonymizer != nil && reason == reasonNotWhitelisted {
+			if err := ec.addAnonymized(out, hdr, output); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	if err := publicTw.Close(); err != nil {
-		log.Println("cannot close tar writer", err)
-		return embargoBuf, publicBuf, err
-	}
-	if err := embargoTw.Close(); err != nil {
-		log.Println("cannot close tar writer", err)
-		return embargoBuf, publicBuf, err
-	}
-	if err := publicGzw.Close(); err != nil {
-		log.Println("cannot close tar writer", err)
-		return embargoBuf, publicBuf, err
-	}
-	if err := embargoGzw.Close(); err != nil {
-		log.Println("cannot close tar writer", err)
-		return embargoBuf, publicBuf, err
+	for _, w := range []*archiveWriter{out.public, out.private, out.withheld} {
+		if err := w.close(); err != nil {
+			return nil, err
+		}
 	}
-	return embargoBuf, publicBuf, nil
+	return out, nil
 }
 
 // EmbargoOneTar processes one tar file, splits it to 2 files. The embargoed files
@@ -225,27 +573,66 @@ func (ec *EmbargoConfig) SplitFile(content io.Reader, moreThanOneYear bool) (byt
 // The private file will have a different name, so it can be copied to public
 // bucket directly when it becomes one year old.
 // The tarfileName is like 20170516T000000Z-mlab1-atl06-sidestream-0000.tgz
-func (ec *EmbargoConfig) EmbargoOneTar(content io.Reader, tarfileName string, moreThanOneYear bool) error {
-	embargoBuf, publicBuf, err := ec.SplitFile(content, moreThanOneYear)
+// The outputs keep its extension, unless they are written in another format.
+// Members withheld for their client networks, if any, are saved in the
+// private bucket under WithheldName, which unembargo does not copy.
+// It returns the statistics of the members, which are logged and saved in
+// the private bucket under StatsName.
+func (ec *EmbargoConfig) EmbargoOneTar(ctx context.Context, content io.Reader, tarfileName string, moreThanOneYear bool) (*TarStats, error) {
+	start := time.Now()
+	splitCtx, span := tracing.Start(ctx, "embargo.split", attribute.String("object", tarfileName))
+	out, err := ec.splitArchive(splitCtx, content, moreThanOneYear)
+	if err == nil {
+		span.SetAttributes(out.attributes()...)
+	}
+	tracing.End(span, err)
 	if err != nil {
 		metrics.Metrics_embargoTarInputTotal.WithLabelValues("sidestream", "error").Inc()
-		return err
+		return nil, err
 	}
-	if err = ec.WriteResults(tarfileName, embargoBuf, publicBuf); err != nil {
+	metrics.OperationDuration.WithLabelValues("split").Observe(time.Since(start).Seconds())
+	start = time.Now()
+	if err = ec.writeOutputs(ctx, tarfileName, out); err != nil {
 		metrics.Metrics_embargoTarInputTotal.WithLabelValues("sidestream", "error").Inc()
-		return err
+		return nil, err
 	}
+	metrics.OperationDuration.WithLabelValues("upload").Observe(time.Since(start).Seconds())
 
 	metrics.Metrics_embargoTarInputTotal.WithLabelValues("sidestream", "success").Inc()
-	return nil
+	metrics.LastSuccessTimestamp.WithLabelValues("sidestream", "embargo").SetToCurrentTime()
+	return out.stats, nil
+}
+
+// writeOutputs writes the outputs of tarfileName, its withheld members if
+// any, and its statistics.
+func (ec *EmbargoConfig) writeOutputs(ctx context.Context, tarfileName string, out *splitOutputs) (err error) {
+	name := outputName(tarfileName, out.codec)
+	ctx, span := tracing.Start(ctx, "embargo.write", attribute.String("object", name),
+		attribute.Int("bytes.public", out.public.buf.Len()),
+		attribute.Int("bytes.private", out.private.buf.Len()),
+		attribute.Int("bytes.withheld", out.withheld.buf.Len()))
+	defer func() { tracing.End(span, err) }()
+
+	if err = ec.WriteResults(ctx, name, out.private.buf, out.public.buf); err != nil {
+		return err
+	}
+	if out.withheld.members > 0 {
+		if err = ec.writeWithheld(ctx, name, out.withheld.buf); err != nil {
+			return err
+		}
+	}
+	log.Printf("%s: %s\n", tarfileName, out.stats)
+	return ec.writeStats(ctx, name, out.stats)
 }
 
 // EmbargoOneDayData do embargo for one day files.
 // The input date is string in format yyyymmdd
 // The cutoffDate is integer in format yyyymmdd
+// It stops between tar files and pages of the listing, and returns ctx.Err()
+// once ctx is done.
 // TODO: handle midway crash. Since the source bucket is unchanged, if it failed
 // in the middle, we just rerun it for that specific day.
-func (ec *EmbargoConfig) EmbargoOneDayData(date string, cutoffDate int) error {
+func (ec *EmbargoConfig) EmbargoOneDayData(ctx context.Context, date string, cutoffDate int) (err error) {
 	f, err := os.OpenFile("EmbargoLogfile", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatalf("error opening file: %v", err)
@@ -255,65 +642,136 @@ func (ec *EmbargoConfig) EmbargoOneDayData(date string, cutoffDate int) error {
 
 	log.SetOutput(f)
 
-	// TODO: Create service in a Singleton object, and reuse them for all GCS requests.
-
-	if ec.embargoService == nil {
+	if ec.store == nil {
 		log.Printf("Storage service was not initialized.\n")
 		return fmt.Errorf("storage service was not initialized")
 	}
 
-	sourceFiles := ec.embargoService.Objects.List(ec.sourceBucket)
-	sourceFiles.Prefix("sidestream/" + date[0:4] + "/" + date[4:6] + "/" + date[6:8])
-	sourceFilesList, err := sourceFiles.Context(context.Background()).Do()
-	if err != nil {
-		log.Printf("Objects List of source bucket failed: %v\n", err)
-		return err
+	if len(date) < 8 {
+		return fmt.Errorf("%w: %q", ErrInvalidDate, date)
 	}
 	dateInteger, err := strconv.Atoi(date[0:8])
 	if err != nil {
 		log.Printf("Cannot get valid date: %v\n", err)
-		return err
+		return fmt.Errorf("%w: %q", ErrInvalidDate, date)
 	}
 	moreThanOneYear := dateInteger < cutoffDate
-	for _, oneItem := range sourceFilesList.Items {
-		if !strings.Contains(oneItem.Name, "tgz") || !strings.Contains(oneItem.Name, "sidestream") {
+	day := NewTarStats()
+	ctx, span := tracing.Start(ctx, "embargo.day", attribute.String("date", date))
+	defer func() {
+		span.SetAttributes(attribute.Int("archives", day.Archives))
+		tracing.End(span, err)
+	}()
+	sourceFiles, err := ec.store.ListObjects(ctx, ec.sourceBucket, DatePrefix("sidestream", date))
+	if err != nil {
+		log.Printf("Objects List of source bucket failed: %v\n", err)
+		return storageError("list", ec.sourceBucket, DatePrefix("sidestream", date), err)
+	}
+	for _, oneItem := range sourceFiles {
+		if !IsArchiveName(oneItem.Name) || !strings.Contains(oneItem.Name, "sidestream") {
 			continue
 		}
-
-		fileContent, err := ec.embargoService.Objects.Get(ec.sourceBucket, oneItem.Name).Download()
-		if err != nil {
-			log.Printf("fail to read a tar file from the bucket: %v\n", err)
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		if err := ec.EmbargoOneTar(fileContent.Body, oneItem.Name, moreThanOneYear); err != nil {
+		stats, err := ec.embargoObject(ctx, oneItem.Name, moreThanOneYear)
+		if err != nil {
 			return err
 		}
+		day.Merge(stats)
 	}
+	log.Printf("day %s: %s\n", date, day)
 	return nil
 }
 
-// EmbargoSingleFile embargo the input file.
-func (ec *EmbargoConfig) EmbargoSingleFile(filename string) error {
-	if !strings.Contains(filename, "tgz") || !strings.Contains(filename, "sidestream") {
-		return errors.New("not a proper sidestream file")
-	}
+// embargoObject downloads one tar file from the source bucket and embargoes it.
+func (ec *EmbargoConfig) embargoObject(ctx context.Context, filename string, moreThanOneYear bool) (stats *TarStats, err error) {
+	ctx, span := tracing.Start(ctx, "embargo.tarball", attribute.String("object", filename))
+	defer func() { tracing.End(span, err) }()
 
-	fileContent, err := ec.embargoService.Objects.Get(ec.sourceBucket, filename).Download()
+	start := time.Now()
+	downloadCtx, download := tracing.Start(ctx, "embargo.download", attribute.String("object", filename))
+	fileContent, err := ec.store.ReadObject(downloadCtx, ec.sourceBucket, filename)
+	download.SetAttributes(attribute.Int("bytes", len(fileContent)))
+	tracing.End(download, err)
 	if err != nil {
-		log.Printf("fail to read tar file from the bucket: %v\n", err)
-		return err
+		log.Printf("fail to read a tar file from the bucket: %v\n", err)
+		return nil, storageError("read", ec.sourceBucket, filename, err)
+	}
+	metrics.OperationDuration.WithLabelValues("download").Observe(time.Since(start).Seconds())
+	return ec.EmbargoOneTar(ctx, bytes.NewReader(fileContent), filename, moreThanOneYear)
+}
+
+// EmbargoSingleFile embargo the input file.
+func (ec *EmbargoConfig) EmbargoSingleFile(ctx context.Context, filename string) error {
+	if !IsArchiveName(filename) || !strings.Contains(filename, "sidestream") {
+		return fmt.Errorf("%w: not a proper sidestream file: %q", ErrInvalidFilename, filename)
 	}
+
 	baseName := filepath.Base(filename)
+	if len(baseName) < 8 {
+		return fmt.Errorf("%w: no date in %q", ErrInvalidFilename, filename)
+	}
 	dateInteger, err := strconv.Atoi(baseName[0:8])
 	if err != nil {
 		log.Printf("fail to get valid date from filename: %v\n", err)
-		return err
+		return fmt.Errorf("%w: no date in %q", ErrInvalidFilename, filename)
 	}
 
 	moreThanOneYear := dateInteger < FormatDateAsInt(time.Now().AddDate(-1, 0, 0))
 
-	if err := ec.EmbargoOneTar(fileContent.Body, filename, moreThanOneYear); err != nil {
-		return err
+	_, err = ec.embargoObject(ctx, filename, moreThanOneYear)
+	return err
+}
+
+// DayReport describes whether the embargo outputs of one day are complete.
+type DayReport struct {
+	Date           string   `json:"date"`
+	Sources        int      `json:"sources"`
+	MissingPublic  []string `json:"missing_public"`
+	MissingPrivate []string `json:"missing_private"`
+}
+
+// Complete reports whether every source tar file has both outputs.
+func (dr *DayReport) Complete() bool {
+	return len(dr.MissingPublic) == 0 && len(dr.MissingPrivate) == 0
+}
+
+// VerifyOneDay checks that every sidestream tar file of the date (yyyymmdd)
+// in the source bucket has its public and private outputs.
+func (ec *EmbargoConfig) VerifyOneDay(ctx context.Context, date string) (*DayReport, error) {
+	if ec.store == nil {
+		return nil, fmt.Errorf("storage service was not initialized")
 	}
-	return nil
+	prefix := DatePrefix("sidestream", date)
+	sources, err := objectNames(ctx, ec.store, ec.sourceBucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	public, err := objectNames(ctx, ec.store, ec.destPublicBucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	private, err := objectNames(ctx, ec.store, ec.destPrivateBucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	report := &DayReport{Date: date, MissingPublic: []string{}, MissingPrivate: []string{}}
+	for name := range sources {
+		if !IsArchiveName(name) || !strings.Contains(name, "sidestream") {
+			continue
+		}
+		report.Sources++
+		codec, _ := codecForName(name)
+		output := outputName(name, ec.outputCodec(codec))
+		if !public[output] {
+			report.MissingPublic = append(report.MissingPublic, name)
+		}
+		if !private[EmbargoedName(output)] {
+			report.MissingPrivate = append(report.MissingPrivate, name)
+		}
+	}
+	sort.Strings(report.MissingPublic)
+	sort.Strings(report.MissingPrivate)
+	return report, nil
 }
@@ -3,21 +3,37 @@
 package embargo
 
 import (
-	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
 	"log"
-	"net/http"
+	"net"
 	"os"
+	"sort"
 	"strings"
 	"time"
+
+	"github.com/m-lab/etl/web100"
 )
 
 // WhitelistChecker is a struct containing map EmbargoWhiteList which is the list
 // of M-Lab site IP EXCEPT the Samknows sites.
 type WhitelistChecker struct {
 	EmbargoWhiteList map[string]struct{}
+	// Hostnames maps the IPs to the hostnames of their machines, when the
+	// list gives them.
+	Hostnames map[string]string
+	// Checksum is the hex SHA-256 of the list the IPs were loaded from.
+	Checksum string
+	// Entries are the networks, and the IPs valid for some dates only, of
+	// a local whitelist.
+	Entries []WhitelistEntry
+	// Sites maps the IPs and the networks of a local whitelist to their
+	// site, when annotated.
+	Sites map[string]string
 }
 
 // FormatDateAsInt return a date in interger as format yyyymmdd.
@@ -33,68 +49,77 @@ type Site struct {
 }
 
 // FilterSiteIPs parses bytes and returns array of struct with site IPs
-// filtering out all samknows sites.
+// filtering out all samknows sites. The IPv6 addresses are normalized like
+// the IPs of the file names.
 // TODO: make the filter use positive checks, including the list of things
 // other than samknows, rather than excluding samknows.
 func FilterSiteIPs(body []byte) (map[string]struct{}, error) {
+	filteredIPList, _, err := filterSites(body)
+	return filteredIPList, err
+}
+
+// filterSites is FilterSiteIPs, also returning the hostnames of the IPs.
+func filterSites(body []byte) (map[string]struct{}, map[string]string, error) {
 	sites := make([]Site, 0)
 	filteredIPList := make(map[string]struct{})
+	hostnames := make(map[string]string)
 	if err := json.Unmarshal(body, &sites); err != nil {
 		log.Printf("Cannot parse site IP json files.")
-		return nil, errors.New("cannot parse site IP json files")
+		return nil, nil, errors.New("cannot parse site IP json files")
 	}
 
 	for _, site := range sites {
 		if strings.Contains(site.Hostname, "samknows") {
 			continue
 		}
-		if site.Ipv4 != "" {
-			filteredIPList[site.Ipv4] = struct{}{}
-		}
-		if site.Ipv6 != "" {
-			filteredIPList[site.Ipv6] = struct{}{}
+		for _, ip := range []string{site.Ipv4, site.Ipv6} {
+			if ip == "" {
+				continue
+			}
+			// Normalized like the IPs of the file names and the local lists.
+			if normalized, err := web100.NormalizeIPv6(ip); err == nil {
+				ip = normalized
+			}
+			filteredIPList[ip] = struct{}{}
+			hostnames[ip] = site.Hostname
 		}
 	}
 	log.Printf("Load whitelist with length %d", len(filteredIPList))
-	return filteredIPList, nil
+	return filteredIPList, hostnames, nil
+}
+
+// checksum returns the hex SHA-256 of content.
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
 }
 
-// LoadFromGCS loads the embargo IP whitelist from public URL.
-// TODO: add unittest for this func.
+// LoadFromURL loads the embargo IP whitelist from public URL. It fails if
+// the URL cannot be fetched in time, does not return 200 OK, or returns
+// something else than JSON or text.
 func (wc *WhitelistChecker) LoadFromURL(jsonURL string) error {
-	resp, err := http.Get(jsonURL)
+	loaded, err := NewWhitelistLoader(jsonURL, nil).Load(context.Background())
 	if err != nil {
 		log.Printf("cannot download site IP json file.\n")
 		return err
 	}
-	defer resp.Body.Close()
-
-	var body []byte
-	body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Cannot read site IP json files.\n")
-		return err
-	}
-
-	wc.EmbargoWhiteList, err = FilterSiteIPs(body)
-	return err
+	*wc = *loaded
+	return nil
 }
 
-// LoadFromLocalWhitelist loads embargo IP whitelist from a local file.
+// LoadFromLocalWhitelist loads embargo IP whitelist from a local file, in
+// the format of ParseWhitelist.
 func (wc *WhitelistChecker) LoadFromLocalWhitelist(path string) error {
 	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-
-	whiteList := make(map[string]struct{})
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		oneLine := strings.TrimSuffix(scanner.Text(), "\n")
-		whiteList[oneLine] = struct{}{}
+	loaded, err := readWhitelist(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
 	}
-	wc.EmbargoWhiteList = whiteList
+	*wc = *loaded
 	return nil
 }
 
@@ -102,9 +127,88 @@ func (wc *WhitelistChecker) LoadFromLocalWhitelist(path string) error {
 // The filename is like: 20170225T23:00:00Z_4.34.58.34_0.web100
 // file with IP that is in the site IP list, return true
 // file with IP not in the site IP list, return false
+// The entries valid for some dates only are checked on the date of the file.
 func (wc *WhitelistChecker) CheckInWhiteList(fileName string) bool {
 	fn := FileName{Name: fileName}
 	localIP := fn.GetLocalIP()
-	_, ok := wc.EmbargoWhiteList[localIP]
-	return ok
+	return localIP != "" && wc.CheckIPOn(localIP, fileDay(fileName))
+}
+
+// CheckIP checks whether ip, normalized like the IPs of the file names, is
+// in the embargo whitelist today.
+func (wc *WhitelistChecker) CheckIP(ip string) bool {
+	return wc.CheckIPOn(ip, time.Now().UTC())
+}
+
+// CheckIPOn checks whether ip, normalized like the IPs of the file names, is
+// in the embargo whitelist on day.
+func (wc *WhitelistChecker) CheckIPOn(ip string, day time.Time) bool {
+	if _, ok := wc.EmbargoWhiteList[ip]; ok {
+		return true
+	}
+	if len(wc.Entries) == 0 {
+		return false
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for i := range wc.Entries {
+		if wc.Entries[i].Network.Contains(addr) && wc.Entries[i].validOn(day) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileDay returns the date at the start of the file name, or today if it
+// has none.
+func fileDay(fileName string) time.Time {
+	fn := FileName{Name: fileName}
+	day, err := time.Parse("20060102", fn.GetDate())
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return day
+}
+
+// keys returns the IPs and the networks of the whitelist.
+func (wc *WhitelistChecker) keys() map[string]struct{} {
+	if len(wc.Entries) == 0 {
+		return wc.EmbargoWhiteList
+	}
+	keys := make(map[string]struct{}, len(wc.EmbargoWhiteList)+len(wc.Entries))
+	for ip := range wc.EmbargoWhiteList {
+		keys[ip] = struct{}{}
+	}
+	for i := range wc.Entries {
+		keys[wc.Entries[i].Key()] = struct{}{}
+	}
+	return keys
+}
+
+// IPs returns the IPs and the networks in the whitelist, sorted.
+func (wc *WhitelistChecker) IPs() []string {
+	return sortedKeys(wc.keys())
+}
+
+// Diff returns the IPs and networks that are in candidate but not in wc
+// (added), and those that are in wc but not in candidate (removed), both
+// sorted.
+func (wc *WhitelistChecker) Diff(candidate *WhitelistChecker) (added, removed []string) {
+	added, removed = []string{}, []string{}
+	current, next := wc.keys(), candidate.keys()
+	for ip := range next {
+		if _, ok := current[ip]; !ok {
+			added = append(added, ip)
+		}
+	}
+	for ip := range current {
+		if _, ok := next[ip]; !ok {
+			removed = append(removed, ip)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
 }
@@ -1,7 +1,14 @@
 package embargo_test
 
 import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/m-lab/etl-embargo"
 )
@@ -46,6 +53,24 @@ func TestFilterSiteIPs(t *testing.T) {
 	}
 }
 
+func TestFilterSiteIPsNormalizes(t *testing.T) {
+	body := []byte(`[{"hostname": "mlab1.lhr01.measurement-lab.org", "ipv4": "", "ipv6": "2001:4C08:2003:2:0:0:0:148"}]`)
+	fromURL, err := embargo.FilterSiteIPs(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFile, err := embargo.ParseWhitelist(strings.NewReader("2001:4C08:2003:2:0:0:0:148\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromURL, fromFile.EmbargoWhiteList) {
+		t.Errorf("FilterSiteIPs() = %v, ParseWhitelist() = %v", fromURL, fromFile.EmbargoWhiteList)
+	}
+	if _, ok := fromURL["2001:4c08:2003:2::148"]; !ok {
+		t.Errorf("FilterSiteIPs() = %v, want 2001:4c08:2003:2::148", fromURL)
+	}
+}
+
 func TestCheckInWhiteList(t *testing.T) {
 	ipChecker := new(embargo.WhitelistChecker)
 	ipChecker.LoadFromLocalWhitelist("testdata/whitelist")
@@ -62,3 +87,110 @@ func TestCheckInWhiteList(t *testing.T) {
 	}
 	return
 }
+
+func TestWhitelistDiff(t *testing.T) {
+	current := new(embargo.WhitelistChecker)
+	if err := current.LoadFromLocalWhitelist("testdata/whitelist"); err != nil {
+		t.Fatal(err)
+	}
+	candidate := &embargo.WhitelistChecker{EmbargoWhiteList: map[string]struct{}{
+		"213.244.128.170":       {},
+		"2001:4c08:2003:2::148": {},
+		"196.49.14.227":         {},
+	}}
+	added, removed := current.Diff(candidate)
+	if len(added) != 1 || added[0] != "196.49.14.227" {
+		t.Errorf("Diff() added = %v, want [196.49.14.227]", added)
+	}
+	if len(removed) != 4 || removed[0] != "2001:4c08:2003:2::161" {
+		t.Errorf("Diff() removed = %v, want 4 IPs", removed)
+	}
+	if ips := candidate.IPs(); len(ips) != 3 || ips[0] != "196.49.14.227" {
+		t.Errorf("IPs() = %v, want sorted IPs", ips)
+	}
+
+	// After a restart, with no whitelist in use yet, a list removing sites
+	// is compared with the approved one of the cache.
+	dir := t.TempDir()
+	source := filepath.Join(dir, "whitelist")
+	cache := embargo.NewFileWhitelistCache(filepath.Join(dir, "whitelist.json"))
+	load := func(list string) (*embargo.EmbargoConfig, error) {
+		if err := ioutil.WriteFile(source, []byte(list), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ec := embargo.NewEmbargoConfig("", "", "", embargo.WhitelistChecker{}, nil)
+		ec.SetWhitelistSource(source)
+		ec.SetWhitelistCache(cache)
+		ec.SetWhitelistApproval(true, "")
+		return ec, ec.ReloadWhitelist()
+	}
+	if _, err := load("213.244.128.170 site=lhr01\n196.49.14.227 site=acc02\n"); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := load("196.49.14.227 site=acc02\n")
+	if !errors.Is(err, embargo.ErrWhitelistNotApproved) {
+		t.Errorf("ReloadWhitelist() after a restart = %v, want ErrWhitelistNotApproved", err)
+	}
+	diff, err := restarted.DiffWhitelist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.NeedsApproval || !reflect.DeepEqual(diff.RemovedSites, []string{"lhr01"}) {
+		t.Errorf("DiffWhitelist() after a restart = %+v, want lhr01 removed and approval needed", diff)
+	}
+}
+
+func TestLoadAnnotatedWhitelist(t *testing.T) {
+	wc := new(embargo.WhitelistChecker)
+	if err := wc.LoadFromLocalWhitelist("testdata/whitelist_annotated"); err != nil {
+		t.Fatal(err)
+	}
+	march := time.Date(2017, 3, 15, 0, 0, 0, 0, time.UTC)
+	february := time.Date(2017, 2, 28, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		ip   string
+		day  time.Time
+		want bool
+	}{
+		{"213.244.128.170", march, true},
+		{"2001:4c08:2003:2::148", march, true},
+		{"196.49.14.42", march, true},
+		{"196.49.14.42", february, false},
+		{"196.49.14.64", march, false},
+		{"4.34.58.34", february, true},
+		{"4.34.58.34", march, false},
+	} {
+		if got := wc.CheckIPOn(tt.ip, tt.day); got != tt.want {
+			t.Errorf("CheckIPOn(%s, %s) = %v, want %v", tt.ip, tt.day.Format("2006-01-02"), got, tt.want)
+		}
+	}
+	if !wc.CheckInWhiteList("20170228T23:00:00Z_4.34.58.34_0.web100.gz") ||
+		wc.CheckInWhiteList("20170301T23:00:00Z_4.34.58.34_0.web100.gz") {
+		t.Error("CheckInWhiteList() does not check the date of the file")
+	}
+	want := []string{"196.49.14.0/26", "2001:4c08:2003:2::148", "213.244.128.170", "4.34.58.34"}
+	if ips := wc.IPs(); !reflect.DeepEqual(ips, want) {
+		t.Errorf("IPs() = %v, want %v", ips, want)
+	}
+	if wc.Sites["196.49.14.0/26"] != "acc02" || wc.Entries[0].Reason != "new site, whole range" {
+		t.Errorf("annotations %v %+v", wc.Sites, wc.Entries)
+	}
+}
+
+func TestParseWhitelistErrors(t *testing.T) {
+	for list, want := range map[string]string{
+		"1.2.3.4\nnot-an-ip\n":                                    "line 2: ",
+		"# comment\n\n10.0.0.0/33\n":                              "line 3: ",
+		"1.2.3.4 owner=me\n":                                      "line 1: unknown annotation",
+		"1.2.3.4 valid-from=2017-13-01\n":                         "line 1: bad valid-from date",
+		"1.2.3.4 valid-from=2017-03-01 valid-until=2017-02-01\n":  "line 1: valid-until",
+		"1.2.3.4 reason=\"unterminated\n":                         "line 1: unterminated quote",
+		"1.2.3.4 site\n":                                          "line 1: want key=value",
+		"1.2.3.4\n" + strings.Repeat("x", bufio.MaxScanTokenSize): "token too long",
+	} {
+		_, err := embargo.ParseWhitelist(strings.NewReader(list))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ParseWhitelist(%.40q) = %v, want %q", list, err, want)
+		}
+	}
+}
@@ -1,17 +1,25 @@
 package embargo_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	embargo "github.com/m-lab/etl-embargo"
 )
 
 func cleanUpBucket(bucketName string) {
-	if !embargo.DeleteFiles(bucketName, "") {
+	if !embargo.DeleteFiles(context.Background(), bucketName, "") {
 		fmt.Printf("Delete file failed, Please delete files in %s before rerunning the test.\n", bucketName)
 	}
 }
@@ -25,18 +33,29 @@ func TestEmbargo(t *testing.T) {
 	sourceBucket := "scraper-mlab-testing"
 	privateBucket := "embargo-mlab-testing"
 	publicBucket := "archive-mlab-testing"
-	embargo.DeleteFiles(sourceBucket, "")
-	embargo.UploadFile(sourceBucket, "testdata/20170315T000000Z-mlab3-sea03-sidestream-0000.tgz", "sidestream/2017/03/15/")
-	if testConfig.EmbargoOneDayData("20170315", 20160822) != nil {
+	embargo.DeleteFiles(context.Background(), sourceBucket, "")
+	embargo.UploadFile(context.Background(), sourceBucket, "testdata/20170315T000000Z-mlab3-sea03-sidestream-0000.tgz", "sidestream/2017/03/15/")
+	if testConfig.EmbargoOneDayData(context.Background(), "20170315", 20160822) != nil {
 		t.Error("Did not perform embargo correctly.\n")
 	}
 
 	// Verify that there are expected outputs in the destination buckets.
-	if !embargo.CompareBuckets(privateBucket, "embargoed-golden-data-mlab-testing") {
-		t.Error("Did not generate embargoed data correctly.\n")
+	// The statistics, under embargo.StatsPrefix, are checked apart.
+	store := embargo.NewGCSStore(embargo.CreateService())
+	opts := embargo.CompareOptions{Prefix: "sidestream/", TarMembers: true}
+	for bucket, golden := range map[string]string{
+		privateBucket: "embargoed-golden-data-mlab-testing",
+		publicBucket:  "embargo-output-golden-mlab-testing",
+	} {
+		diff, err := embargo.NewBucket(bucket, store, nil).Compare(context.Background(), embargo.NewBucket(golden, store, nil), opts)
+		if err != nil {
+			t.Errorf("Cannot compare %s to %s: %v", bucket, golden, err)
+		} else if !diff.Same() {
+			t.Errorf("Did not generate %s correctly: %s", bucket, diff)
+		}
 	}
-	if !embargo.CompareBuckets(publicBucket, "embargo-output-golden-mlab-testing") {
-		t.Error("Did not generate public data correctly.\n")
+	if stats, err := testConfig.DayStats(context.Background(), "20170315"); err != nil || stats.Archives != 1 {
+		t.Errorf("Did not write the statistics of 20170315: %+v, %v", stats, err)
 	}
 
 	cleanUpBucket(sourceBucket)
@@ -64,7 +83,7 @@ func TestSplitTarFile(t *testing.T) {
 	}
 	defer file.Close()
 
-	privateBuf, publicBuf, err := testConfig.SplitFile(file, false)
+	privateBuf, publicBuf, err := testConfig.SplitFile(context.Background(), file, false)
 	if err != nil {
 		t.Error("Did not perform embargo correctly.\n")
 	}
@@ -88,3 +107,110 @@ func TestSplitTarFile(t *testing.T) {
 		t.Error("Private data not correct.\n")
 	}
 }
+
+func TestSplitFileCanceled(t *testing.T) {
+	var whitelist embargo.WhitelistChecker
+	if err := whitelist.LoadFromLocalWhitelist("testdata/whitelist_full"); err != nil {
+		t.Fatal(err)
+	}
+	testConfig := embargo.NewEmbargoConfig("", "", "", whitelist, nil)
+	file, err := os.Open("testdata/20170315T000000Z-mlab3-sea03-sidestream-0000.tgz")
+	if err != nil {
+		t.Fatal("cannot open test data.")
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := testConfig.SplitFile(ctx, file, false); err != context.Canceled {
+		t.Errorf("SplitFile() with canceled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+// readHeaders returns the headers of the gzipped tar archive content.
+func readHeaders(t *testing.T, content []byte) []*tar.Header {
+	zr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	var headers []*tar.Header
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return headers
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, header)
+	}
+}
+
+func TestSplitFilePreserveHeaders(t *testing.T) {
+	var whitelist embargo.WhitelistChecker
+	if err := whitelist.LoadFromLocalWhitelist("testdata/whitelist"); err != nil {
+		t.Fatal(err)
+	}
+	testConfig := embargo.NewEmbargoConfig("", "", "", whitelist, nil)
+	testConfig.SetPreserveHeaders(true)
+
+	// An archive with the entries and extensions the testdata lacks.
+	var synthetic bytes.Buffer
+	zw := gzip.NewWriter(&synthetic)
+	tw := tar.NewWriter(zw)
+	modTime := time.Date(2017, 3, 15, 17, 58, 0, 0, time.UTC)
+	longDir := "2017/03/15/" + strings.Repeat("d", 120) + "/"
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: longDir, Mode: 0755, ModTime: modTime, Format: tar.FormatGNU},
+		{Typeflag: tar.TypeReg, Name: longDir + "20170315T17:00:00Z_213.244.128.144_0.web100", Mode: 0640, Uid: 1000, Gid: 1000, Uname: "mlab", Gname: "mlab", ModTime: modTime, Size: 4, Format: tar.FormatGNU},
+		{Typeflag: tar.TypeSymlink, Name: "latest", Linkname: longDir, ModTime: modTime, Format: tar.FormatPAX},
+		{Typeflag: tar.TypeReg, Name: "20170315T17:00:00Z_4.34.58.34_0.web100", Mode: 0644, ModTime: modTime, AccessTime: modTime, ChangeTime: modTime, Size: 4, PAXRecords: map[string]string{"MLAB.comment": "sidestream"}, Format: tar.FormatPAX},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Size > 0 {
+			tw.Write([]byte("data"))
+		}
+	}
+	tw.Close()
+	zw.Close()
+
+	inputs := map[string][]byte{"synthetic": synthetic.Bytes()}
+	paths, _ := filepath.Glob("testdata/*.tgz")
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs[path] = content
+	}
+	for name, content := range inputs {
+		privateBuf, publicBuf, err := testConfig.SplitFile(context.Background(), bytes.NewReader(content), false)
+		if err != nil {
+			t.Fatalf("SplitFile(%s) = %v", name, err)
+		}
+		public := readHeaders(t, publicBuf.Bytes())
+		private := readHeaders(t, privateBuf.Bytes())
+		for _, h := range readHeaders(t, content) {
+			inPublic := len(public) > 0 && reflect.DeepEqual(public[0], h)
+			if inPublic {
+				public = public[1:]
+			}
+			inPrivate := len(private) > 0 && reflect.DeepEqual(private[0], h)
+			if inPrivate {
+				private = private[1:]
+			}
+			if h.Typeflag == tar.TypeReg && inPublic == inPrivate {
+				t.Errorf("%s: file %s is in public: %v, in private: %v, want it in one output with the same header", name, h.Name, inPublic, inPrivate)
+			}
+			if h.Typeflag != tar.TypeReg && !(inPublic && inPrivate) {
+				t.Errorf("%s: entry %s is in public: %v, in private: %v, want it in both with the same header", name, h.Name, inPublic, inPrivate)
+			}
+		}
+		if len(public)+len(private) != 0 {
+			t.Errorf("%s: outputs have %d headers that are not in the input", name, len(public)+len(private))
+		}
+	}
+}
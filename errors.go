@@ -0,0 +1,70 @@
+// Errors returned by the embargo operations. Callers tell them apart with
+// errors.Is and errors.As.
+package embargo
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidFilename means a file name does not have the expected format.
+	ErrInvalidFilename = errors.New("invalid filename")
+	// ErrInvalidDate means a date is not a valid yyyymmdd date in range.
+	ErrInvalidDate = errors.New("invalid date")
+	// ErrNotEligibleYet means the data is less than one year old, so it
+	// cannot be unembargoed.
+	ErrNotEligibleYet = errors.New("date is too new, not qualified for unembargo")
+	// ErrUnknownProject means the service runs in a project it has no
+	// configuration for.
+	ErrUnknownProject = errors.New("this job is running in wrong project")
+	// ErrSourceMissing means an object to process does not exist.
+	ErrSourceMissing = errors.New("source object missing")
+	// ErrCorruptArchive means an input archive cannot be read.
+	ErrCorruptArchive = errors.New("corrupt archive")
+	// ErrStorage means a storage operation failed. Errors matching it are
+	// *StorageError values, which give the details.
+	ErrStorage = errors.New("storage error")
+)
+
+// StorageError records a failed storage operation and its cause.
+// It matches ErrStorage, and also ErrSourceMissing when the object does
+// not exist.
+type StorageError struct {
+	Op     string
+	Bucket string
+	Object string
+	Err    error
+}
+
+func (e *StorageError) Error() string {
+	if e.Object == "" {
+		return fmt.Sprintf("%s gs://%s failed: %v", e.Op, e.Bucket, e.Err)
+	}
+	return fmt.Sprintf("%s gs://%s/%s failed: %v", e.Op, e.Bucket, e.Object, e.Err)
+}
+
+// Unwrap returns the cause of the failure.
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether e matches ErrStorage or ErrSourceMissing.
+func (e *StorageError) Is(target error) bool {
+	switch target {
+	case ErrStorage:
+		return true
+	case ErrSourceMissing:
+		return ClassifyError(e.Err) == ClassNotFound
+	}
+	return false
+}
+
+// storageError wraps err in a StorageError, unless it is nil or the
+// context was canceled, in which case it is returned unchanged.
+func storageError(op, bucket, object string, err error) error {
+	if err == nil || ClassifyError(err) == ClassCanceled {
+		return err
+	}
+	return &StorageError{Op: op, Bucket: bucket, Object: object, Err: err}
+}
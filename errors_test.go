@@ -0,0 +1,72 @@
+package embargo_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+func TestStorageError(t *testing.T) {
+	missing := &embargo.StorageError{Op: "read", Bucket: "b", Object: "o", Err: &googleapi.Error{Code: http.StatusNotFound}}
+	if !errors.Is(missing, embargo.ErrStorage) || !errors.Is(missing, embargo.ErrSourceMissing) {
+		t.Errorf("%v should match ErrStorage and ErrSourceMissing", missing)
+	}
+	denied := &embargo.StorageError{Op: "write", Bucket: "b", Object: "o", Err: &googleapi.Error{Code: http.StatusForbidden}}
+	if !errors.Is(denied, embargo.ErrStorage) || errors.Is(denied, embargo.ErrSourceMissing) {
+		t.Errorf("%v should match ErrStorage only", denied)
+	}
+	var gerr *googleapi.Error
+	if !errors.As(denied, &gerr) || gerr.Code != http.StatusForbidden {
+		t.Errorf("errors.As(%v) did not find the cause", denied)
+	}
+}
+
+func TestEmbargoErrors(t *testing.T) {
+	var whitelist embargo.WhitelistChecker
+	if err := whitelist.LoadFromLocalWhitelist("testdata/whitelist_full"); err != nil {
+		t.Fatal(err)
+	}
+	ec := embargo.NewEmbargoConfig("scraper", "embargo", "archive", whitelist, newFakeStore())
+	ctx := context.Background()
+
+	if err := ec.EmbargoSingleFile(ctx, "sidestream/2017/05/29/x.tgz"); !errors.Is(err, embargo.ErrInvalidFilename) {
+		t.Errorf("EmbargoSingleFile(short name) = %v, want %v", err, embargo.ErrInvalidFilename)
+	}
+	err := ec.EmbargoSingleFile(ctx, "sidestream/2017/05/29/20170529T000000Z-mlab1-atl06-sidestream-0000.tgz")
+	var serr *embargo.StorageError
+	if !errors.Is(err, embargo.ErrSourceMissing) || !errors.As(err, &serr) || serr.Bucket != "scraper" {
+		t.Errorf("EmbargoSingleFile(missing file) = %v, want %v from the source bucket", err, embargo.ErrSourceMissing)
+	}
+	if _, _, err := ec.SplitFile(ctx, strings.NewReader("not a tgz"), false); !errors.Is(err, embargo.ErrCorruptArchive) {
+		t.Errorf("SplitFile(garbage) = %v, want %v", err, embargo.ErrCorruptArchive)
+	}
+	// A tar file cut in the middle of a member.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "20170529T00:00:00Z_4.34.58.34_0.web100", Mode: 0644, Size: 2048})
+	tw.Write(make([]byte, 2048))
+	tw.Close()
+	if _, _, err := ec.SplitFile(ctx, bytes.NewReader(buf.Bytes()[:1024]), false); !errors.Is(err, embargo.ErrCorruptArchive) {
+		t.Errorf("SplitFile(truncated member) = %v, want %v", err, embargo.ErrCorruptArchive)
+	}
+}
+
+func TestUnembargoErrors(t *testing.T) {
+	uc := embargo.NewUnembargoConfig("embargo", "archive")
+	if err := uc.Unembargo(context.Background(), 20150101); !errors.Is(err, embargo.ErrInvalidDate) {
+		t.Errorf("Unembargo(20150101) = %v, want %v", err, embargo.ErrInvalidDate)
+	}
+	recent := embargo.FormatDateAsInt(time.Now())
+	if err := uc.Unembargo(context.Background(), recent); !errors.Is(err, embargo.ErrNotEligibleYet) {
+		t.Errorf("Unembargo(%d) = %v, want %v", recent, err, embargo.ErrNotEligibleYet)
+	}
+}
@@ -1,9 +1,15 @@
 // Parse filename and return componants like log-time, IP, etc.
 // Filename example: 20170315T01:00:00Z_173.205.3.39_0.web100
+// Archive example: 20170516T000000Z-mlab1-atl06-sidestream-0000.tgz
 package embargo
 
 import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/m-lab/etl-embargo/metrics"
 	"github.com/m-lab/etl/web100"
@@ -21,18 +27,264 @@ func (f *FileName) GetLocalIP() string {
 		return ""
 	}
 	ip, err := web100.NormalizeIPv6(f.Name[localIPStart+1 : localIPEnd])
+	if err == nil && net.ParseIP(ip) == nil {
+		err = fmt.Errorf("not an IP: %q", ip)
+	}
 	if err != nil {
-		metrics.IPv6ErrorsTotal.WithLabelValues(err.Error()).Inc()
+		// The error may quote the name, which comes from an untrusted
+		// archive, so it cannot be used as a label value.
+		metrics.IPv6ErrorsTotal.WithLabelValues("invalid_ip").Inc()
 		return ""
 	}
 	return ip
 }
 
+// GetDate returns the date yyyymmdd at the start of the name, or an empty
+// string if the name is too short.
 func (f *FileName) GetDate() string {
+	if len(f.Name) < 8 {
+		return ""
+	}
 	return f.Name[0:8]
 }
 
+// FileNameParser gives the local IP and the date yyyymmdd of a member name.
 type FileNameParser interface {
-	GetLocalIP()
-	GetDate()
+	GetLocalIP() string
+	GetDate() string
+}
+
+var (
+	_ FileNameParser = &FileName{}
+	_ FileNameParser = &MemberName{}
+)
+
+// Layouts of the times in member and archive names.
+const (
+	memberTimeLayout  = "20060102T15:04:05Z"
+	archiveTimeLayout = "20060102T150405Z"
+)
+
+// MemberName is a parsed member name, like
+// 20170315T01:00:00Z_173.205.3.39_0.web100.gz, or
+// 20161102T14:00:00Z_ALL0.tra for the legacy files of all connections.
+type MemberName struct {
+	// Time is the time the file starts at.
+	Time time.Time
+	// IP is the local IP, or nil if the name has none.
+	IP net.IP
+	// All is set for the files of all the connections, like ALL0.
+	All bool
+	// Index is the number of the file.
+	Index int
+	// Suffix is the kind of file, like "web100", "tra" or "snaplog".
+	Suffix string
+	// Compression is the extension of the compression of the file, like
+	// "gz", or empty.
+	Compression string
+}
+
+// ParseMemberName parses the base name of a member of a sidestream archive.
+func ParseMemberName(name string) (*MemberName, error) {
+	name = path.Base(name)
+	bad := func(format string, a ...interface{}) error {
+		return fmt.Errorf("%w: %q: %s", ErrInvalidFilename, name, fmt.Sprintf(format, a...))
+	}
+	layout := len(memberTimeLayout)
+	if len(name) <= layout || name[layout] != '_' {
+		return nil, bad("no time")
+	}
+	t, err := time.Parse(memberTimeLayout, name[:layout])
+	if err != nil {
+		return nil, bad("bad time: %v", err)
+	}
+	m := &MemberName{Time: t}
+
+	rest := name[layout+1:]
+	if i := strings.LastIndexByte(rest, '_'); i >= 0 {
+		ip, err := web100.NormalizeIPv6(rest[:i])
+		if err == nil {
+			m.IP = net.ParseIP(ip)
+		}
+		if m.IP == nil {
+			return nil, bad("bad IP %q", rest[:i])
+		}
+		rest = rest[i+1:]
+	}
+
+	parts := strings.Split(rest, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, bad("no suffix")
+	}
+	index := parts[0]
+	if strings.HasPrefix(index, "ALL") {
+		m.All = true
+		index = index[len("ALL"):]
+	}
+	if m.Index, err = parseDigits(index); err != nil {
+		return nil, bad("bad index %q", parts[0])
+	}
+	if m.Suffix = parts[1]; !isWord(m.Suffix) {
+		return nil, bad("bad suffix %q", parts[1])
+	}
+	if len(parts) == 3 {
+		if m.Compression = parts[2]; !isWord(m.Compression) {
+			return nil, bad("bad compression %q", parts[2])
+		}
+	}
+	return m, nil
+}
+
+// String formats m as a member name. IPv6 addresses are written like
+// sidestream does, with ":::" for "::".
+func (m *MemberName) String() string {
+	var b strings.Builder
+	b.WriteString(m.Time.UTC().Format(memberTimeLayout))
+	b.WriteByte('_')
+	if m.IP != nil {
+		b.WriteString(formatIP(m.IP))
+		b.WriteByte('_')
+	}
+	if m.All {
+		b.WriteString("ALL")
+	}
+	b.WriteString(strconv.Itoa(m.Index))
+	b.WriteByte('.')
+	b.WriteString(m.Suffix)
+	if m.Compression != "" {
+		b.WriteByte('.')
+		b.WriteString(m.Compression)
+	}
+	return b.String()
+}
+
+// GetLocalIP returns the normalized local IP, or an empty string.
+func (m *MemberName) GetLocalIP() string {
+	if m.IP == nil {
+		return ""
+	}
+	return m.IP.String()
+}
+
+// GetDate returns the date yyyymmdd of the file.
+func (m *MemberName) GetDate() string {
+	return m.Time.UTC().Format("20060102")
+}
+
+// formatIP writes ip like in the member names.
+func formatIP(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return strings.Replace(ip.String(), "::", ":::", 1)
+}
+
+// ArchiveName is a parsed archive name, like
+// 20170516T000000Z-mlab1-atl06-sidestream-0000.tgz, with "-e" for a private
+// output or "-w" for a withheld one, and any archive extension.
+type ArchiveName struct {
+	// Time is the time the archive starts at.
+	Time time.Time
+	// Machine and Site are like "mlab1" and "atl06".
+	Machine string
+	Site    string
+	// Experiment is like "sidestream".
+	Experiment string
+	// Sequence is the number of the archive within its time, written with
+	// SequenceWidth digits, at least 4.
+	Sequence      int
+	SequenceWidth int
+	// Embargoed is set for the private outputs, named with "-e", and
+	// Withheld for the withheld ones, named with "-w".
+	Embargoed bool
+	Withheld  bool
+	// Extension is the archive extension, like ".tgz" or ".tar.zst".
+	Extension string
+}
+
+// ParseArchiveName parses the base name of an archive.
+func ParseArchiveName(name string) (*ArchiveName, error) {
+	name = path.Base(name)
+	bad := func(format string, a ...interface{}) error {
+		return fmt.Errorf("%w: %q: %s", ErrInvalidFilename, name, fmt.Sprintf(format, a...))
+	}
+	_, ext := codecForName(name)
+	if ext == "" {
+		return nil, bad("not an archive")
+	}
+	a := &ArchiveName{Extension: ext}
+	stem := strings.TrimSuffix(name, ext)
+	switch {
+	case strings.HasSuffix(stem, "-e"):
+		a.Embargoed = true
+		stem = strings.TrimSuffix(stem, "-e")
+	case strings.HasSuffix(stem, "-w"):
+		a.Withheld = true
+		stem = strings.TrimSuffix(stem, "-w")
+	}
+
+	parts := strings.Split(stem, "-")
+	if len(parts) < 5 {
+		return nil, bad("want time-machine-site-experiment-sequence")
+	}
+	t, err := time.Parse(archiveTimeLayout, parts[0])
+	if err != nil {
+		return nil, bad("bad time: %v", err)
+	}
+	a.Time = t
+	a.Machine, a.Site = parts[1], parts[2]
+	a.Experiment = strings.Join(parts[3:len(parts)-1], "-")
+	for _, p := range parts[1 : len(parts)-1] {
+		if !isWord(p) {
+			return nil, bad("bad part %q", p)
+		}
+	}
+	sequence := parts[len(parts)-1]
+	if len(sequence) < 4 {
+		return nil, bad("bad sequence %q", sequence)
+	}
+	if a.Sequence, err = parseDigits(sequence); err != nil {
+		return nil, bad("bad sequence %q", sequence)
+	}
+	a.SequenceWidth = len(sequence)
+	return a, nil
+}
+
+// String formats a as an archive name. The name of a withheld archive is
+// formatted without WithheldPrefix.
+func (a *ArchiveName) String() string {
+	suffix := ""
+	switch {
+	case a.Embargoed:
+		suffix = "-e"
+	case a.Withheld:
+		suffix = "-w"
+	}
+	width := a.SequenceWidth
+	if width < 4 {
+		width = 4
+	}
+	return fmt.Sprintf("%s-%s-%s-%s-%0*d%s%s", a.Time.UTC().Format(archiveTimeLayout),
+		a.Machine, a.Site, a.Experiment, width, a.Sequence, suffix, a.Extension)
+}
+
+// parseDigits parses a non-negative decimal number, without sign.
+func parseDigits(s string) (int, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, fmt.Errorf("not a number: %q", s)
+	}
+	return strconv.Atoi(s)
+}
+
+// isWord reports whether s is a non-empty run of ASCII letters and digits.
+func isWord(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
 }
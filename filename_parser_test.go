@@ -1,7 +1,13 @@
 package embargo_test
 
 import (
+	"errors"
+	"net"
+	"path"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	embargo "github.com/m-lab/etl-embargo"
 )
@@ -33,3 +39,120 @@ func TestGetDate(t *testing.T) {
 		return
 	}
 }
+
+func TestParseMemberName(t *testing.T) {
+	tests := []struct {
+		name string
+		want embargo.MemberName
+		ip   string
+	}{
+		{"20170315T05:00:00Z_213.244.128.144_0.web100",
+			embargo.MemberName{Time: time.Date(2017, 3, 15, 5, 0, 0, 0, time.UTC), IP: net.ParseIP("213.244.128.144"), Suffix: "web100"},
+			"213.244.128.144"},
+		{"2017/03/15/mlab3.sea03/20170315T17:00:00Z_4.34.58.34_12.web100.gz",
+			embargo.MemberName{Time: time.Date(2017, 3, 15, 17, 0, 0, 0, time.UTC), IP: net.ParseIP("4.34.58.34"), Index: 12, Suffix: "web100", Compression: "gz"},
+			"4.34.58.34"},
+		{"20170225T23:00:00Z_2001:4c08:2003:3f:::230_ALL0.web100.gz",
+			embargo.MemberName{Time: time.Date(2017, 2, 25, 23, 0, 0, 0, time.UTC), IP: net.ParseIP("2001:4c08:2003:3f::230"), All: true, Suffix: "web100", Compression: "gz"},
+			"2001:4c08:2003:3f::230"},
+		{"20161102T14:00:00Z_ALL0.tra",
+			embargo.MemberName{Time: time.Date(2016, 11, 2, 14, 0, 0, 0, time.UTC), All: true, Suffix: "tra"},
+			""},
+	}
+	for _, tt := range tests {
+		got, err := embargo.ParseMemberName(tt.name)
+		if err != nil {
+			t.Errorf("ParseMemberName(%q) = %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("ParseMemberName(%q) = %+v, want %+v", tt.name, *got, tt.want)
+		}
+		if got.GetLocalIP() != tt.ip {
+			t.Errorf("ParseMemberName(%q).GetLocalIP() = %q, want %q", tt.name, got.GetLocalIP(), tt.ip)
+		}
+		if base := path.Base(tt.name); got.String() != base {
+			t.Errorf("ParseMemberName(%q).String() = %q, want %q", tt.name, got.String(), base)
+		}
+	}
+
+	for _, name := range []string{
+		"",
+		"20170315T05:00:00Z",
+		"20170315T25:00:00Z_213.244.128.144_0.web100",
+		"20170315T05:00:00Z_213.244.128_0.web100",
+		"20170315T05:00:00Z_213.244.128.144_x.web100",
+		"20170315T05:00:00Z_213.244.128.144_-1.web100",
+		"20170315T05:00:00Z_213.244.128.144_0",
+		"20170315T05:00:00Z_213.244.128.144_0.web100.gz.gz",
+		"20170315T05:00:00Z_ALL0.",
+	} {
+		if _, err := embargo.ParseMemberName(name); !errors.Is(err, embargo.ErrInvalidFilename) {
+			t.Errorf("ParseMemberName(%q) = %v, want ErrInvalidFilename", name, err)
+		}
+	}
+}
+
+func TestParseArchiveName(t *testing.T) {
+	tests := []struct {
+		name string
+		want embargo.ArchiveName
+	}{
+		{"20170516T000000Z-mlab1-atl06-sidestream-0000.tgz",
+			embargo.ArchiveName{Time: time.Date(2017, 5, 16, 0, 0, 0, 0, time.UTC), Machine: "mlab1", Site: "atl06", Experiment: "sidestream", SequenceWidth: 4, Extension: ".tgz"}},
+		{"sidestream/2017/03/15/20170315T000000Z-mlab3-sea03-sidestream-0001-e.tar.zst",
+			embargo.ArchiveName{Time: time.Date(2017, 3, 15, 0, 0, 0, 0, time.UTC), Machine: "mlab3", Site: "sea03", Experiment: "sidestream", Sequence: 1, SequenceWidth: 4, Embargoed: true, Extension: ".tar.zst"}},
+		{"withheld/sidestream/2017/03/15/20170315T000000Z-mlab3-sea03-sidestream-0001-w.tar.bz2",
+			embargo.ArchiveName{Time: time.Date(2017, 3, 15, 0, 0, 0, 0, time.UTC), Machine: "mlab3", Site: "sea03", Experiment: "sidestream", Sequence: 1, SequenceWidth: 4, Withheld: true, Extension: ".tar.bz2"}},
+		{"20170315T120000Z-mlab3-sea03-paris-traceroute-0012.tar.gz",
+			embargo.ArchiveName{Time: time.Date(2017, 3, 15, 12, 0, 0, 0, time.UTC), Machine: "mlab3", Site: "sea03", Experiment: "paris-traceroute", Sequence: 12, SequenceWidth: 4, Extension: ".tar.gz"}},
+		{"20170315T120000Z-mlab3-sea03-sidestream-00012.tar",
+			embargo.ArchiveName{Time: time.Date(2017, 3, 15, 12, 0, 0, 0, time.UTC), Machine: "mlab3", Site: "sea03", Experiment: "sidestream", Sequence: 12, SequenceWidth: 5, Extension: ".tar"}},
+	}
+	for _, tt := range tests {
+		got, err := embargo.ParseArchiveName(tt.name)
+		if err != nil {
+			t.Errorf("ParseArchiveName(%q) = %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("ParseArchiveName(%q) = %+v, want %+v", tt.name, *got, tt.want)
+		}
+		if base := path.Base(tt.name); got.String() != base {
+			t.Errorf("ParseArchiveName(%q).String() = %q, want %q", tt.name, got.String(), base)
+		}
+	}
+
+	for _, name := range []string{
+		"",
+		"20170516T000000Z-mlab1-atl06-sidestream-0000.json",
+		"20170516T000000Z-mlab1-atl06-0000.tgz",
+		"20170516-mlab1-atl06-sidestream-0000.tgz",
+		"20170516T000000Z-mlab1-atl06-sidestream-00.tgz",
+		"20170516T000000Z-mlab1-atl06-sidestream-00x0.tgz",
+		"20170516T000000Z-mlab1--sidestream-0000.tgz",
+		"20170516T000000Z-mlab1-atl06-sidestream-0000-w-e.tgz",
+		"20170516T000000Z-mlab1-atl06-sidestream-0000-x.tgz",
+	} {
+		if _, err := embargo.ParseArchiveName(name); !errors.Is(err, embargo.ErrInvalidFilename) {
+			t.Errorf("ParseArchiveName(%q) = %v, want ErrInvalidFilename", name, err)
+		}
+	}
+}
+
+func TestParseOutputNames(t *testing.T) {
+	input := "sidestream/2017/03/15/20170315T000000Z-mlab3-sea03-sidestream-0001.tgz"
+	for _, ext := range []string{".tgz", ".tar.gz", ".tar.zst", ".tar.bz2", ".tar"} {
+		name := strings.TrimSuffix(input, ".tgz") + ext
+		for _, output := range []string{name, embargo.EmbargoedName(name), embargo.WithheldName(name)} {
+			a, err := embargo.ParseArchiveName(output)
+			if err != nil {
+				t.Errorf("ParseArchiveName(%q) = %v", output, err)
+				continue
+			}
+			if a.String() != path.Base(output) {
+				t.Errorf("ParseArchiveName(%q).String() = %q", output, a.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package embargo_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+// tarMember is a regular member of a tar archive.
+type tarMember struct {
+	name    string
+	content string
+}
+
+// listRegular returns the regular members of the tar archive content.
+func listRegular(content []byte) ([]tarMember, error) {
+	r, _, err := embargo.OpenArchive(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	var members []tarMember
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, tarMember{header.Name, string(b)})
+	}
+}
+
+func FuzzSplitFile(f *testing.F) {
+	// The testdata archives are too large to be mutated efficiently, so
+	// the seeds are small archives of their first members, truncated.
+	inputs, _ := filepath.Glob("testdata/*.tgz")
+	for _, path := range inputs {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		members, err := listRegular(content)
+		if err != nil {
+			f.Fatal(err)
+		}
+		if len(members) > 3 {
+			members = members[:3]
+		}
+		seed := make(map[string]string)
+		var order []string
+		for _, m := range members {
+			if len(m.content) > 64 {
+				m.content = m.content[:64]
+			}
+			seed[m.name] = m.content
+			order = append(order, m.name)
+		}
+		f.Add(makeTgz(f, gzip.BestSpeed, seed, order...), false)
+	}
+	f.Add(makeTgz(f, gzip.BestSpeed, map[string]string{"20170315T17:00:00Z_2001:668:1f:1d:::43_0.web100": "x"}, "20170315T17:00:00Z_2001:668:1f:1d:::43_0.web100"), true)
+	f.Add([]byte{0x1f, 0x8b}, false)
+
+	var whitelist embargo.WhitelistChecker
+	if err := whitelist.LoadFromLocalWhitelist("testdata/whitelist"); err != nil {
+		f.Fatal(err)
+	}
+	ec := embargo.NewEmbargoConfig("", "", "", whitelist, nil)
+
+	f.Fuzz(func(t *testing.T, content []byte, moreThanOneYear bool) {
+		private, public, err := ec.SplitFile(context.Background(), bytes.NewReader(content), moreThanOneYear)
+		if err != nil {
+			return
+		}
+		input, err := listRegular(content)
+		if err != nil {
+			t.Fatalf("SplitFile() accepted an archive that cannot be read: %v", err)
+		}
+		privateMembers, err := listRegular(private.Bytes())
+		if err != nil {
+			t.Fatalf("cannot read the private output: %v", err)
+		}
+		publicMembers, err := listRegular(public.Bytes())
+		if err != nil {
+			t.Fatalf("cannot read the public output: %v", err)
+		}
+		// Every input member is in exactly one output, in the input order.
+		for _, m := range input {
+			switch {
+			case len(publicMembers) > 0 && publicMembers[0] == m:
+				publicMembers = publicMembers[1:]
+			case len(privateMembers) > 0 && privateMembers[0] == m:
+				privateMembers = privateMembers[1:]
+			default:
+				t.Fatalf("input member %q is in no output", m.name)
+			}
+		}
+		if len(publicMembers)+len(privateMembers) != 0 {
+			t.Fatalf("outputs have members that are not in the input: %d public, %d private", len(publicMembers), len(privateMembers))
+		}
+	})
+}
+
+func FuzzFileName(f *testing.F) {
+	inputs, _ := filepath.Glob("testdata/*.tgz")
+	for _, path := range inputs {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		members, err := listRegular(content)
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, m := range members {
+			f.Add(filepath.Base(m.name))
+		}
+	}
+	for _, name := range []string{
+		"20170315T17:00:00Z_2001:668:1f:1d:::43_0.web100",
+		"20170225T23:00:00Z_2001:4c08:2003:3f:::230_ALL0.web100.gz",
+		"20170225T23:00:00Z_ALL0.web100.gz",
+		"20170516T000000Z-mlab1-atl06-sidestream-0000-e.tgz",
+		"_::::::::_", "2017", "_", "",
+	} {
+		f.Add(name)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		fn := embargo.FileName{Name: name}
+		if ip := fn.GetLocalIP(); ip != "" && net.ParseIP(ip) == nil {
+			t.Errorf("GetLocalIP(%q) = %q, not an IP", name, ip)
+		}
+		if date := fn.GetDate(); date != "" && !strings.HasPrefix(name, date) {
+			t.Errorf("GetDate(%q) = %q, not a prefix of the name", name, date)
+		}
+		// A parsed name is formatted to a name that parses the same.
+		if m, err := embargo.ParseMemberName(name); err == nil {
+			again, err := embargo.ParseMemberName(m.String())
+			if err != nil || !reflect.DeepEqual(again, m) {
+				t.Errorf("ParseMemberName(%q) = %+v, formatted as %q, which parses as %+v, %v", name, m, m.String(), again, err)
+			}
+		}
+		if a, err := embargo.ParseArchiveName(name); err == nil {
+			again, err := embargo.ParseArchiveName(a.String())
+			if err != nil || !reflect.DeepEqual(again, a) {
+				t.Errorf("ParseArchiveName(%q) = %+v, formatted as %q, which parses as %+v, %v", name, a, a.String(), again, err)
+			}
+		}
+	})
+}
@@ -4,334 +4,437 @@
 package embargo
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"io/ioutil"
+	"log"
 	"path/filepath"
+	"sort"
+	"sync"
 
-	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	storage "google.golang.org/api/storage/v1"
 )
 
 // CreateService creates GCS service used by the following functions.
+// The service outlives any single request, so it is not bound to a context;
+// every call made with it is.
 func CreateService() *storage.Service {
 	// This scope allows the application full control over resources in Google Cloud Storage
 	var scope = storage.DevstorageFullControlScope
 	client, err := google.DefaultClient(context.Background(), scope)
 	if err != nil {
-		fmt.Printf("Unable to get default storage client: %v \n", err)
+		log.Printf("Unable to get default storage client: %v \n", err)
 		return nil
 	}
 	service, err := storage.New(client)
 	if err != nil {
-		fmt.Printf("Unable to create storage service: %v\n", err)
+		log.Printf("Unable to create storage service: %v\n", err)
 		return nil
 	}
 	return service
 }
 
-// TODO: Create service in a Singleton object, and reuse them for all GCS requests.
+// ErrBucketNotEmpty is returned when deleting a bucket that still has objects.
+var ErrBucketNotEmpty = errors.New("bucket is not empty")
 
-// CreateBucket creates a new bucket. Return true if it already exsits or is created successfully.
-func CreateBucket(projectID string, bucketName string) bool {
-	service := CreateService()
-	if service == nil {
-		fmt.Printf("Storage service was not initialized.\n")
-		return false
+// Bucket is a client for one GCS bucket. Create it once, with NewBucket, and
+// reuse it for all the operations on that bucket.
+type Bucket struct {
+	// Name is the name of the bucket.
+	Name string
+	// service is used for the operations on the bucket itself, store for
+	// the operations on its objects.
+	service *storage.Service
+	store   ObjectStore
+}
+
+// NewBucket returns a client for the bucket name. Object operations go through
+// store; Create and Delete use service and fail if it is nil.
+func NewBucket(name string, store ObjectStore, service *storage.Service) *Bucket {
+	return &Bucket{Name: name, service: service, store: store}
+}
+
+// Create creates the bucket in projectID. It returns false if the bucket
+// already exists.
+func (b *Bucket) Create(ctx context.Context, projectID string) (bool, error) {
+	if b.service == nil {
+		return false, fmt.Errorf("storage service was not initialized")
+	}
+	if _, err := b.service.Buckets.Get(b.Name).Context(ctx).Do(); err == nil {
+		return false, nil
+	} else if ClassifyError(err) != ClassNotFound {
+		return false, storageError("get bucket", b.Name, "", err)
 	}
+	if _, err := b.service.Buckets.Insert(projectID, &storage.Bucket{Name: b.Name}).Context(ctx).Do(); err != nil {
+		return false, storageError("create bucket", b.Name, "", err)
+	}
+	return true, nil
+}
 
-	if _, err := service.Buckets.Get(bucketName).Do(); err == nil {
-		fmt.Printf("Bucket %s already exsits.\n", bucketName)
-		return true
-	} else {
-		// Create a bucket.
-		if res, err := service.Buckets.Insert(projectID, &storage.Bucket{Name: bucketName}).Do(); err == nil {
-			fmt.Printf("Created bucket %v at location %v\n", res.Name, res.SelfLink)
-		} else {
-			fmt.Printf("Failed creating bucket %s: %v\n", bucketName, err)
-		}
+// Delete deletes the bucket. It returns ErrBucketNotEmpty if the bucket has
+// objects. ("rmdir")
+func (b *Bucket) Delete(ctx context.Context) error {
+	if b.service == nil {
+		return fmt.Errorf("storage service was not initialized")
 	}
-	return true
+	names, err := b.Names(ctx, "")
+	if err != nil {
+		return err
+	}
+	if len(names) != 0 {
+		return fmt.Errorf("%w: gs://%s has %d objects", ErrBucketNotEmpty, b.Name, len(names))
+	}
+	if err := b.service.Buckets.Delete(b.Name).Context(ctx).Do(); err != nil {
+		return storageError("delete bucket", b.Name, "", err)
+	}
+	return nil
 }
 
-// GetFileNamesFromBucket returns array of file names in that bucket given the bucket name,. ("ls")
-func GetFileNamesFromBucket(bucketName string) []string {
-	service := CreateService()
-	if service == nil {
-		fmt.Printf("Storage service was not initialized.\n")
-		return nil
+// Names returns the sorted names of the objects whose name starts with
+// prefix. ("ls")
+func (b *Bucket) Names(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := b.store.ListObjects(ctx, b.Name, prefix)
+	if err != nil {
+		return nil, storageError("list", b.Name, prefix, err)
 	}
+	names := make([]string, len(objects))
+	for i, o := range objects {
+		names[i] = o.Name
+	}
+	sort.Strings(names)
+	return names, nil
+}
 
-	var fileNames []string
-	pageToken := ""
-	for {
-		call := service.Objects.List(bucketName)
-		if pageToken != "" {
-			call = call.PageToken(pageToken)
-		}
-		res, err := call.Do()
-		if err != nil {
-			fmt.Printf("Get file list failed: %v\n", err)
-			return nil
-		}
-		for _, object := range res.Items {
-			fileNames = append(fileNames, object.Name)
-		}
-		if pageToken = res.NextPageToken; pageToken == "" {
-			break
+// DeleteFiles deletes all objects whose name starts with prefix, and returns
+// the names of the deleted objects. ("rm")
+func (b *Bucket) DeleteFiles(ctx context.Context, prefix string) ([]string, error) {
+	names, err := b.Names(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		if err := b.store.DeleteObject(ctx, b.Name, name); err != nil {
+			return names[:i], storageError("delete", b.Name, name, err)
 		}
 	}
-	return fileNames
+	return names, nil
 }
 
-// DeleteFiles deletes all files with specified prefix from bucket. ("rm")
-func DeleteFiles(bucketName string, prefixFileName string) bool {
-	service := CreateService()
-	if service == nil {
-		fmt.Printf("Storage service was not initialized.\n")
-		return false
+// Upload uploads the local file fileName to targetDir + its base name, and
+// returns the name of the object. ("cp")
+func (b *Bucket) Upload(ctx context.Context, fileName string, targetDir string) (string, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	name := targetDir + filepath.Base(fileName)
+	if err := b.store.WriteObject(ctx, b.Name, name, content, ""); err != nil {
+		return "", storageError("write", b.Name, name, err)
 	}
+	return name, nil
+}
 
-	_, err := service.Buckets.Get(bucketName).Do()
-	if err != nil {
-		fmt.Printf("Bucket %s does not exists.\n", bucketName)
-		return false
+// CopyFile copies the object fileName to the bucket dest, on the server
+// side, keeping its content type and metadata. Both buckets must be
+// reachable through the store of b. ("cp")
+func (b *Bucket) CopyFile(ctx context.Context, dest *Bucket, fileName string) error {
+	if err := b.store.CopyObject(ctx, b.Name, dest.Name, fileName); err != nil {
+		return storageError("copy", b.Name, fileName, err)
 	}
+	return nil
+}
 
-	// Delete files.
-	pageToken := ""
-	for {
-		// Get list all objects in source bucket.
-		sourceFiles := service.Objects.List(bucketName)
-		sourceFiles.Prefix(prefixFileName)
-		if pageToken != "" {
-			sourceFiles.PageToken(pageToken)
+// DefaultSyncConcurrency is the number of copies SyncTo runs at the same
+// time when SyncOptions.Concurrency is not set.
+const DefaultSyncConcurrency = 8
+
+// SyncOptions change how SyncTo synchronizes two buckets.
+type SyncOptions struct {
+	// Concurrency is the maximum number of copies or deletions in flight.
+	Concurrency int
+	// DeleteExtraneous deletes the objects of the destination that are not
+	// in the source, like rsync --delete.
+	DeleteExtraneous bool
+	// VerifyCRC32C copies an object that is already in the destination if
+	// its CRC32C differs, like rsync --checksum. Otherwise objects are
+	// compared by name only.
+	VerifyCRC32C bool
+}
+
+// SyncResult lists what SyncTo did. Each list is sorted.
+type SyncResult struct {
+	// Copied are the objects copied to the destination.
+	Copied []string
+	// Skipped are the objects already in the destination.
+	Skipped []string
+	// Deleted are the extraneous objects deleted from the destination.
+	Deleted []string
+}
+
+// SyncTo copies the objects whose name starts with prefix to dest, unless
+// dest already has the same object. Copies are done on the server side.
+// On error, the result lists what was done before the failure.
+func (b *Bucket) SyncTo(ctx context.Context, dest *Bucket, prefix string, opts SyncOptions) (*SyncResult, error) {
+	existing, err := dest.objects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := b.objects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	result := &SyncResult{}
+	var toCopy []string
+	for name, o := range sources {
+		if d, ok := existing[name]; ok && (!opts.VerifyCRC32C || d.Crc32c == o.Crc32c) {
+			result.Skipped = append(result.Skipped, name)
+			continue
 		}
-		sourceFilesList, err := sourceFiles.Context(context.Background()).Do()
-		if err != nil {
-			fmt.Printf("Objects List of source bucket failed: %v\n", err)
-			return false
+		toCopy = append(toCopy, name)
+	}
+	sort.Strings(result.Skipped)
+
+	result.Copied, err = forEachName(ctx, opts.Concurrency, toCopy, func(ctx context.Context, name string) error {
+		return b.CopyFile(ctx, dest, name)
+	})
+	if err != nil || !opts.DeleteExtraneous {
+		return result, err
+	}
+
+	var toDelete []string
+	for name := range existing {
+		if _, ok := sources[name]; !ok {
+			toDelete = append(toDelete, name)
 		}
-		for _, oneItem := range sourceFilesList.Items {
-			result := service.Objects.Delete(bucketName, oneItem.Name).Do()
-			if result != nil {
-				fmt.Printf("Objects deletion failed: %v\n", err)
-				return false
-			}
+	}
+	result.Deleted, err = forEachName(ctx, opts.Concurrency, toDelete, func(ctx context.Context, name string) error {
+		if err := dest.store.DeleteObject(ctx, dest.Name, name); err != nil {
+			return storageError("delete", dest.Name, name, err)
 		}
+		return nil
+	})
+	return result, err
+}
 
-		if pageToken = sourceFilesList.NextPageToken; pageToken == "" {
+// objects returns the objects whose name starts with prefix, by name.
+func (b *Bucket) objects(ctx context.Context, prefix string) (map[string]*storage.Object, error) {
+	list, err := b.store.ListObjects(ctx, b.Name, prefix)
+	if err != nil {
+		return nil, storageError("list", b.Name, prefix, err)
+	}
+	objects := make(map[string]*storage.Object, len(list))
+	for _, o := range list {
+		objects[o.Name] = o
+	}
+	return objects, nil
+}
+
+// forEachName calls fn for every name, with at most concurrency calls in
+// flight, or DefaultSyncConcurrency if concurrency is not positive. After
+// the first failure no new call is started. It returns the sorted names for
+// which fn succeeded, and the first error.
+func forEachName(ctx context.Context, concurrency int, names []string, fn func(ctx context.Context, name string) error) ([]string, error) {
+	if concurrency <= 0 {
+		concurrency = DefaultSyncConcurrency
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		done     []string
+		firstErr error
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, name := range names {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
 			break
 		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := fn(ctx, name)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				done = append(done, name)
+			} else if firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+		}(name)
 	}
-	return true
+	wg.Wait()
+	sort.Strings(done)
+	if firstErr == nil && len(done) < len(names) {
+		// The parent context is done, so some calls were not started.
+		firstErr = ctx.Err()
+	}
+	return done, firstErr
 }
 
-// Delete the bucket if it is empty. ("rmdir")
-func DeleteBucket(bucketName string) bool {
-	service := CreateService()
-	if service == nil {
-		fmt.Printf("Storage service was not initialized.\n")
-		return false
+// sharedService is the storage service used by the deprecated functions
+// below. It is created on first use.
+var sharedService struct {
+	once    sync.Once
+	service *storage.Service
+}
+
+// defaultBucket returns a client for the bucket name using the shared
+// storage service, with retries.
+func defaultBucket(name string) (*Bucket, error) {
+	sharedService.once.Do(func() {
+		sharedService.service = CreateService()
+	})
+	if sharedService.service == nil {
+		return nil, fmt.Errorf("storage service was not initialized")
 	}
+	store := NewTracingStore(NewRetryingStore(NewGCSStore(sharedService.service), DefaultRetryPolicy))
+	return NewBucket(name, store, sharedService.service), nil
+}
 
-	sourceFiles, err := service.Objects.List(bucketName).Do()
+// CreateBucket creates a new bucket. Return true if it already exsits or is created successfully.
+//
+// Deprecated: Use Bucket.Create.
+func CreateBucket(ctx context.Context, projectID string, bucketName string) bool {
+	b, err := defaultBucket(bucketName)
 	if err != nil {
+		log.Printf("%v\n", err)
 		return false
 	}
-	if len(sourceFiles.Items) == 0 {
-		if err := service.Buckets.Delete(bucketName).Do(); err != nil {
-			fmt.Printf("Could not delete bucket %v\n", err)
-			return false
-		} else {
-			fmt.Printf("Delete bucket %s successfully.\n", bucketName)
-			return true
-		}
-	} else {
-		fmt.Printf("Could not delete non empty bucket %v\n", bucketName)
+	if _, err := b.Create(ctx, projectID); err != nil {
+		log.Printf("Failed creating bucket %s: %v\n", bucketName, err)
 		return false
 	}
+	return true
+}
 
+// GetFileNamesFromBucket returns array of file names in that bucket given the bucket name,. ("ls")
+//
+// Deprecated: Use Bucket.Names.
+func GetFileNamesFromBucket(ctx context.Context, bucketName string) []string {
+	b, err := defaultBucket(bucketName)
+	if err != nil {
+		log.Printf("%v\n", err)
+		return nil
+	}
+	names, err := b.Names(ctx, "")
+	if err != nil {
+		log.Printf("Get file list failed: %v\n", err)
+		return nil
+	}
+	return names
 }
 
-// UploadFile uploads one file from local path to bucket. ("cp")
-func UploadFile(bucketName string, fileName string, targetdir string) bool {
-	service := CreateService()
-	if service == nil {
-		fmt.Printf("Storage service was not initialized.\n")
+// DeleteFiles deletes all files with specified prefix from bucket. ("rm")
+//
+// Deprecated: Use Bucket.DeleteFiles.
+func DeleteFiles(ctx context.Context, bucketName string, prefixFileName string) bool {
+	b, err := defaultBucket(bucketName)
+	if err != nil {
+		log.Printf("%v\n", err)
+		return false
+	}
+	if _, err := b.DeleteFiles(ctx, prefixFileName); err != nil {
+		log.Printf("Objects deletion failed: %v\n", err)
 		return false
 	}
+	return true
+}
 
-	file, err := os.Open(fileName)
+// Delete the bucket if it is empty. ("rmdir")
+//
+// Deprecated: Use Bucket.Delete.
+func DeleteBucket(ctx context.Context, bucketName string) bool {
+	b, err := defaultBucket(bucketName)
 	if err != nil {
-		fmt.Printf("Error opening local file %s: %v\n", fileName, err)
+		log.Printf("%v\n", err)
 		return false
 	}
-	object := &storage.Object{Name: targetdir + filepath.Base(fileName)}
-	if res, err := service.Objects.Insert(bucketName, object).Media(file).Do(); err == nil {
-		fmt.Printf("Created object %v at location %v\n", res.Name, res.SelfLink)
-		return true
+	if err := b.Delete(ctx); err != nil {
+		log.Printf("Could not delete bucket %s: %v\n", bucketName, err)
+		return false
 	}
-	fmt.Printf("Objects.Insert failed: %v\n", err)
-	return false
+	return true
 }
 
-// CopyOneFile copies one file from one bucket to another bucket. Return true if succeed. ("cp")
-func CopyOneFile(sourceBucket string, destBucket string, fileName string) bool {
-	service := CreateService()
-	if service == nil {
-		fmt.Printf("Storage service was not initialized.\n")
+// UploadFile uploads one file from local path to bucket. ("cp")
+//
+// Deprecated: Use Bucket.Upload.
+func UploadFile(ctx context.Context, bucketName string, fileName string, targetdir string) bool {
+	b, err := defaultBucket(bucketName)
+	if err != nil {
+		log.Printf("%v\n", err)
 		return false
 	}
+	if _, err := b.Upload(ctx, fileName, targetdir); err != nil {
+		log.Printf("Upload of %s failed: %v\n", fileName, err)
+		return false
+	}
+	return true
+}
 
-	if fileContent, err := service.Objects.Get(sourceBucket, fileName).Download(); err == nil {
-		object := &storage.Object{Name: fileName}
-		_, err := service.Objects.Insert(destBucket, object).Media(fileContent.Body).Do()
-		if err != nil {
-			fmt.Printf("Objects insert failed: %v\n", err)
-			return false
-		}
+// CopyOneFile copies one file from one bucket to another bucket. Return true if succeed. ("cp")
+//
+// Deprecated: Use Bucket.CopyFile.
+func CopyOneFile(ctx context.Context, sourceBucket string, destBucket string, fileName string) bool {
+	src, err := defaultBucket(sourceBucket)
+	if err != nil {
+		log.Printf("%v\n", err)
+		return false
+	}
+	dst, _ := defaultBucket(destBucket)
+	if err := src.CopyFile(ctx, dst, fileName); err != nil {
+		log.Printf("Copy of %s failed: %v\n", fileName, err)
+		return false
 	}
 	return true
 }
 
 // SyncTwoBuckets copies all files with PrefixFileName from SourceBucke to DestBucket if there
 // is no one yet. Return true if succeed.
-func SyncTwoBuckets(sourceBucket string, destBucket string, prefixFileName string) bool {
-	service := CreateService()
-	if service == nil {
-		fmt.Printf("Storage service was not initialized.\n")
+//
+// Deprecated: Use Bucket.SyncTo.
+func SyncTwoBuckets(ctx context.Context, sourceBucket string, destBucket string, prefixFileName string) bool {
+	src, err := defaultBucket(sourceBucket)
+	if err != nil {
+		log.Printf("%v\n", err)
 		return false
 	}
-
-	// Build list of exisitng files in destination bucket.
-	existingFilenames := make(map[string]bool)
-	destPageToken := ""
-	for {
-		destinationFiles := service.Objects.List(destBucket)
-		if destPageToken != "" {
-			destinationFiles.PageToken(destPageToken)
-		}
-		destinationFiles.Prefix(prefixFileName)
-		destinationFilesList, err := destinationFiles.Context(context.Background()).Do()
-		if err != nil {
-			fmt.Printf("Objects.List failed: %v\n", err)
-			return false
-		}
-		for _, oneItem := range destinationFilesList.Items {
-			existingFilenames[oneItem.Name] = true
-		}
-		destPageToken = destinationFilesList.NextPageToken
-		if destPageToken == "" {
-			break
-		}
-	}
-
-	// Copy files.
-	pageToken := ""
-	for {
-		// Get list all objects in source bucket.
-		sourceFiles := service.Objects.List(sourceBucket)
-		sourceFiles.Prefix(prefixFileName)
-		if pageToken != "" {
-			sourceFiles.PageToken(pageToken)
-		}
-		sourceFilesList, err := sourceFiles.Context(context.Background()).Do()
-		if err != nil {
-			fmt.Printf("Objects List of source bucket failed: %v\n", err)
-			return false
-		}
-		for _, oneItem := range sourceFilesList.Items {
-			if existingFilenames[oneItem.Name] {
-				fmt.Printf("object %s already there\n", oneItem.Name)
-				continue
-			}
-			if fileContent, err := service.Objects.Get(sourceBucket, oneItem.Name).Download(); err == nil {
-				// Insert the object into destination bucket.
-				object := &storage.Object{Name: oneItem.Name}
-				_, err := service.Objects.Insert(destBucket, object).Media(fileContent.Body).Do()
-				if err != nil {
-					fmt.Printf("Objects insert failed: %v\n", err)
-					return false
-				}
-			}
-		}
-		pageToken = sourceFilesList.NextPageToken
-		if pageToken == "" {
-			break
-		}
+	dst, _ := defaultBucket(destBucket)
+	if _, err := src.SyncTo(ctx, dst, prefixFileName, SyncOptions{}); err != nil {
+		log.Printf("Sync of %s failed: %v\n", prefixFileName, err)
+		return false
 	}
-
 	return true
 }
 
 // CompareBuckets compares whether 2 buckets have exactly same files. Return true if they are the same.
-func CompareBuckets(sourceBucket string, destBucket string) bool {
-	service := CreateService()
-	if service == nil {
-		fmt.Printf("Storage service was not initialized.\n")
+//
+// Deprecated: Use Bucket.Compare.
+func CompareBuckets(ctx context.Context, sourceBucket string, destBucket string) bool {
+	src, err := defaultBucket(sourceBucket)
+	if err != nil {
+		log.Printf("%v\n", err)
 		return false
 	}
-
-	// Build list of exisitng files in destination bucket.
-	existingFilenames := make(map[string]bool)
-	destPageToken := ""
-	for {
-		destinationFiles := service.Objects.List(destBucket)
-		if destPageToken != "" {
-			destinationFiles.PageToken(destPageToken)
-		}
-		destinationFilesList, err := destinationFiles.Context(context.Background()).Do()
-		if err != nil {
-			fmt.Printf("Objects.List failed: %v\n", err)
-			return false
-		}
-		for _, oneItem := range destinationFilesList.Items {
-			existingFilenames[oneItem.Name] = true
-		}
-		destPageToken = destinationFilesList.NextPageToken
-		if destPageToken == "" {
-			break
-		}
-	}
-
-	// Go through files in destination.
-	pageToken := ""
-	for {
-		// Get list all objects in source bucket.
-		sourceFiles := service.Objects.List(sourceBucket)
-		if pageToken != "" {
-			sourceFiles.PageToken(pageToken)
-		}
-		sourceFilesList, err := sourceFiles.Context(context.Background()).Do()
-		if err != nil {
-			fmt.Printf("Objects List of source bucket failed: %v\n", err)
-			return false
-		}
-		for _, oneItem := range sourceFilesList.Items {
-			if existingFilenames[oneItem.Name] {
-				// File is already there. We need to compare the size.
-				existingFilenames[oneItem.Name] = false
-				continue
-			} else {
-				fmt.Printf("Here is a file in sourceBucket but not in destBucket: %s", oneItem.Name)
-				return false
-			}
-
-		}
-		pageToken = sourceFilesList.NextPageToken
-		if pageToken == "" {
-			break
-		}
+	dst, _ := defaultBucket(destBucket)
+	diff, err := src.Compare(ctx, dst, CompareOptions{})
+	if err != nil {
+		log.Printf("Compare of %s and %s failed: %v\n", sourceBucket, destBucket, err)
+		return false
 	}
-
-	// Go through map existingFilenames[] to see whether all of them are flipped to false.
-	for fileName := range existingFilenames {
-		if existingFilenames[fileName] == true {
-			fmt.Printf("Here is a file in destBucket but not in sourceBucket: %s", fileName)
-			return false
-		}
+	if !diff.Same() {
+		log.Printf("Buckets %s and %s differ: %s\n", sourceBucket, destBucket, diff)
+		return false
 	}
-
 	return true
 }
@@ -1,9 +1,15 @@
 package embargo_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"reflect"
 	"testing"
 
+	"google.golang.org/api/googleapi"
+
 	embargo "github.com/m-lab/etl-embargo"
 )
 
@@ -11,27 +17,108 @@ func TestBucketOperations(t *testing.T) {
 	destBucket := "bucket-gcs-operations-mlab-testing"
 	sourceBucket := "gcs-source-mlab-testing"
 
-	result := embargo.CopyOneFile(sourceBucket, destBucket, "whitelist_full")
+	result := embargo.CopyOneFile(context.Background(), sourceBucket, destBucket, "whitelist_full")
 	if result == false {
 		t.Errorf("Cannot copy file from another bucket.")
 		return
 	}
 
-	fileNames := embargo.GetFileNamesFromBucket(destBucket)
+	fileNames := embargo.GetFileNamesFromBucket(context.Background(), destBucket)
 
 	fmt.Printf("Files in bucket %v:\n", destBucket)
 	for _, fileName := range fileNames {
 		fmt.Println(fileName)
 	}
 
-	result = embargo.CompareBuckets(destBucket, sourceBucket)
+	result = embargo.CompareBuckets(context.Background(), destBucket, sourceBucket)
 	if result == false {
 		t.Errorf("The two buckets are not the same.")
 		return
 	}
-	result = embargo.DeleteFiles(destBucket, "")
+	result = embargo.DeleteFiles(context.Background(), destBucket, "")
 	if result == false {
 		t.Errorf("Cannot delete files. The bucket bucket-gcs-operations-mlab-testing needs to be cleaned up before rerunning the test.")
 		return
 	}
 }
+
+func TestBucket(t *testing.T) {
+	ctx := context.Background()
+	fs := newFakeStore()
+	fs.put("src", "sidestream/a.tgz", []byte("a"))
+	fs.put("src", "sidestream/b.tgz", []byte("b"))
+	fs.put("src", "other/c.tgz", []byte("c"))
+	fs.put("dst", "sidestream/b.tgz", []byte("b"))
+	fs.put("dst", "extra.tgz", []byte("x"))
+	src := embargo.NewBucket("src", fs, nil)
+	dst := embargo.NewBucket("dst", fs, nil)
+
+	result, err := src.SyncTo(ctx, dst, "sidestream/", embargo.SyncOptions{})
+	if err != nil {
+		t.Fatalf("SyncTo() = %v", err)
+	}
+	if !reflect.DeepEqual(result.Copied, []string{"sidestream/a.tgz"}) || !reflect.DeepEqual(result.Skipped, []string{"sidestream/b.tgz"}) {
+		t.Errorf("SyncTo() = %+v", result)
+	}
+
+	diff, err := src.Compare(ctx, dst, embargo.CompareOptions{})
+	if err != nil {
+		t.Fatalf("Compare() = %v", err)
+	}
+	if diff.Same() || !reflect.DeepEqual(diff.OnlyInA, []string{"other/c.tgz"}) || !reflect.DeepEqual(diff.OnlyInB, []string{"extra.tgz"}) {
+		t.Errorf("Compare() = %+v", diff)
+	}
+
+	if err := src.CopyFile(ctx, dst, "missing.tgz"); !errors.Is(err, embargo.ErrSourceMissing) {
+		t.Errorf("CopyFile(missing) = %v, want %v", err, embargo.ErrSourceMissing)
+	}
+
+	fs.fail("delete", &googleapi.Error{Code: http.StatusForbidden})
+	deleted, err := dst.DeleteFiles(ctx, "sidestream/")
+	if !errors.Is(err, embargo.ErrStorage) || len(deleted) != 0 {
+		t.Errorf("DeleteFiles() with a failing delete = %v, %v", deleted, err)
+	}
+	deleted, err = dst.DeleteFiles(ctx, "sidestream/")
+	if err != nil || len(deleted) != 2 {
+		t.Errorf("DeleteFiles() = %v, %v, want 2 objects deleted", deleted, err)
+	}
+	if names, _ := dst.Names(ctx, ""); !reflect.DeepEqual(names, []string{"extra.tgz"}) {
+		t.Errorf("Names() after DeleteFiles() = %v", names)
+	}
+}
+
+func TestBucketSyncOptions(t *testing.T) {
+	ctx := context.Background()
+	fs := newFakeStore()
+	for i := 0; i < 20; i++ {
+		fs.put("src", fmt.Sprintf("sidestream/%02d.tgz", i), []byte("new"))
+	}
+	fs.put("dst", "sidestream/00.tgz", []byte("new"))
+	fs.put("dst", "sidestream/01.tgz", []byte("old"))
+	fs.put("dst", "sidestream/extra.tgz", []byte("x"))
+	fs.put("dst", "other/kept.tgz", []byte("x"))
+	src := embargo.NewBucket("src", fs, nil)
+	dst := embargo.NewBucket("dst", fs, nil)
+
+	opts := embargo.SyncOptions{Concurrency: 3, DeleteExtraneous: true, VerifyCRC32C: true}
+	result, err := src.SyncTo(ctx, dst, "sidestream/", opts)
+	if err != nil {
+		t.Fatalf("SyncTo() = %v", err)
+	}
+	if len(result.Copied) != 19 || result.Copied[0] != "sidestream/01.tgz" {
+		t.Errorf("SyncTo() copied %v, want all but 00.tgz", result.Copied)
+	}
+	if !reflect.DeepEqual(result.Skipped, []string{"sidestream/00.tgz"}) || !reflect.DeepEqual(result.Deleted, []string{"sidestream/extra.tgz"}) {
+		t.Errorf("SyncTo() = %+v", result)
+	}
+	diff, err := src.Compare(ctx, dst, embargo.CompareOptions{})
+	if err != nil || !reflect.DeepEqual(diff.OnlyInB, []string{"other/kept.tgz"}) || len(diff.OnlyInA) != 0 {
+		t.Errorf("Compare() after SyncTo() = %+v, %v", diff, err)
+	}
+
+	fs.put("src", "sidestream/20.tgz", []byte("new"))
+	fs.fail("copy", &googleapi.Error{Code: http.StatusForbidden})
+	if _, err := src.SyncTo(ctx, dst, "sidestream/", opts); !errors.Is(err, embargo.ErrStorage) {
+		t.Errorf("SyncTo() with a failing copy = %v, want %v", err, embargo.ErrStorage)
+	}
+}
@@ -0,0 +1,194 @@
+package embargo_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+var update = flag.Bool("update", false, "regenerate the golden manifests in testdata/golden")
+
+// goldenMember describes one member of an output archive.
+type goldenMember struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Side   string `json:"side"`
+}
+
+// goldenManifest describes the outputs of embargoing one input archive with
+// one whitelist.
+type goldenManifest struct {
+	Input     string         `json:"input"`
+	Whitelist string         `json:"whitelist"`
+	Public    string         `json:"public"`
+	Private   string         `json:"private"`
+	Members   []goldenMember `json:"members"`
+}
+
+// goldenInputs returns the input archives of testdata, leaving out the
+// expected outputs of the older tests.
+func goldenInputs(t *testing.T) []string {
+	all, err := filepath.Glob("testdata/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inputs []string
+	for _, path := range all {
+		if embargo.IsArchiveName(path) && !strings.Contains(path, "-e.") && !strings.Contains(path, "-p.") {
+			inputs = append(inputs, path)
+		}
+	}
+	return inputs
+}
+
+// readMembers appends the members of the tar archive content to members,
+// with the given side.
+func readMembers(content []byte, side string, members []goldenMember) ([]goldenMember, error) {
+	r, _, err := embargo.OpenArchive(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, tr)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, goldenMember{Name: header.Name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil)), Side: side})
+	}
+}
+
+// runGolden embargoes input with whitelist through EmbargoOneTar and
+// returns the manifest of the outputs.
+func runGolden(t *testing.T, input, whitelist string) *goldenManifest {
+	var wc embargo.WhitelistChecker
+	if err := wc.LoadFromLocalWhitelist(whitelist); err != nil {
+		t.Fatal(err)
+	}
+	fs := newFakeStore()
+	ec := embargo.NewEmbargoConfig("scraper", "embargo", "archive", wc, fs)
+	content, err := ioutil.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Base(input)
+	if _, err := ec.EmbargoOneTar(context.Background(), bytes.NewReader(content), name, false); err != nil {
+		t.Fatalf("EmbargoOneTar(%s) = %v", input, err)
+	}
+
+	m := &goldenManifest{
+		Input:     name,
+		Whitelist: filepath.Base(whitelist),
+		Public:    strings.Join(fs.archives("archive"), " "),
+		Private:   strings.Join(fs.archives("embargo"), " "),
+	}
+	for _, out := range []struct{ side, bucket, name string }{
+		{"public", "archive", m.Public},
+		{"private", "embargo", m.Private},
+	} {
+		object, err := fs.ReadObject(context.Background(), out.bucket, out.name)
+		if err != nil {
+			t.Fatalf("no %s output for %s: %v", out.side, input, err)
+		}
+		if m.Members, err = readMembers(object, out.side, m.Members); err != nil {
+			t.Fatalf("cannot read the %s output of %s: %v", out.side, input, err)
+		}
+	}
+	return m
+}
+
+// diffManifests describes the differences between got and want.
+func diffManifests(got, want *goldenManifest) []string {
+	var diffs []string
+	if got.Public != want.Public || got.Private != want.Private {
+		diffs = append(diffs, fmt.Sprintf("outputs %q %q, want %q %q", got.Public, got.Private, want.Public, want.Private))
+	}
+	wantMembers := make(map[string]goldenMember)
+	for _, m := range want.Members {
+		wantMembers[m.Name] = m
+	}
+	for _, m := range got.Members {
+		w, ok := wantMembers[m.Name]
+		delete(wantMembers, m.Name)
+		switch {
+		case !ok:
+			diffs = append(diffs, "unexpected member "+m.Name)
+		case m != w:
+			diffs = append(diffs, fmt.Sprintf("member %+v, want %+v", m, w))
+		}
+	}
+	for _, w := range want.Members {
+		if _, ok := wantMembers[w.Name]; ok {
+			diffs = append(diffs, "missing member "+w.Name)
+		}
+	}
+	if len(diffs) == 0 && len(got.Members) == len(want.Members) {
+		for i := range got.Members {
+			if got.Members[i] != want.Members[i] {
+				diffs = append(diffs, "members are not in the expected order")
+				break
+			}
+		}
+	}
+	return diffs
+}
+
+// TestGolden compares the outputs of EmbargoOneTar, for every input archive
+// of testdata and every whitelist, to the manifests in testdata/golden.
+// Run "go test -run TestGolden -update" to regenerate them.
+func TestGolden(t *testing.T) {
+	for _, input := range goldenInputs(t) {
+		for _, whitelist := range []string{"testdata/whitelist", "testdata/whitelist_full"} {
+			got := runGolden(t, input, whitelist)
+			golden := filepath.Join("testdata", "golden", strings.SplitN(got.Input, ".", 2)[0]+"."+got.Whitelist+".json")
+			if *update {
+				content, err := json.MarshalIndent(got, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(golden, append(content, '\n'), 0644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			content, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Errorf("cannot read %s, run with -update to create it: %v", golden, err)
+				continue
+			}
+			want := &goldenManifest{}
+			if err := json.Unmarshal(content, want); err != nil {
+				t.Fatalf("cannot parse %s: %v", golden, err)
+			}
+			for _, d := range diffManifests(got, want) {
+				t.Errorf("%s: %s", golden, d)
+			}
+		}
+	}
+}
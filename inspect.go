@@ -0,0 +1,192 @@
+// Inspection of the content of the web100 snapshot files of sidestream.
+// A file starts with a "K:" line naming the web100 variables, followed by
+// one "C:" line of values per connection snapshot.
+package embargo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/etl-embargo/metrics"
+	"github.com/m-lab/etl/web100"
+)
+
+// Snapshots summarizes the connections of a web100 snapshot file.
+type Snapshots struct {
+	// LocalAddresses and RemoteAddresses are the distinct addresses of the
+	// connections, normalized and sorted.
+	LocalAddresses  []string
+	RemoteAddresses []string
+	// FirstStart and LastStart are the earliest and latest start times of
+	// the connections.
+	FirstStart time.Time
+	LastStart  time.Time
+	// Connections is the number of "C:" lines.
+	Connections int
+}
+
+// errNoSnapshot is returned for files without a "K:" header or "C:" lines.
+var errNoSnapshot = errors.New("no web100 snapshot")
+
+// InspectWeb100 parses a web100 snapshot file, gzipped or not.
+func InspectWeb100(content []byte) (*Snapshots, error) {
+	r, err := MemberReader(content)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var columns map[string]int
+	local := make(map[string]struct{})
+	remote := make(map[string]struct{})
+	s := &Snapshots{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "K:":
+			columns = make(map[string]int, len(fields))
+			for i, name := range fields {
+				columns[name] = i
+			}
+		case "C:":
+			if columns == nil {
+				return nil, fmt.Errorf("line %d: values before the K: header", line)
+			}
+			if len(fields) != len(columns) {
+				return nil, fmt.Errorf("line %d: %d values for %d variables", line, len(fields), len(columns))
+			}
+			if err := s.add(fields, columns, local, remote); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if s.Connections == 0 {
+		return nil, errNoSnapshot
+	}
+	s.LocalAddresses = sortedKeys(local)
+	s.RemoteAddresses = sortedKeys(remote)
+	return s, nil
+}
+
+// add adds the connection of one "C:" line to s.
+func (s *Snapshots) add(fields []string, columns map[string]int, local, remote map[string]struct{}) error {
+	value := func(name string) (string, error) {
+		i, ok := columns[name]
+		if !ok {
+			return "", fmt.Errorf("no %s variable", name)
+		}
+		return fields[i], nil
+	}
+	for _, a := range []struct {
+		name string
+		set  map[string]struct{}
+	}{{"LocalAddress", local}, {"RemAddress", remote}} {
+		v, err := value(a.name)
+		if err != nil {
+			return err
+		}
+		ip, err := web100.NormalizeIPv6(v)
+		if err != nil {
+			return fmt.Errorf("bad %s %q: %v", a.name, v, err)
+		}
+		a.set[ip] = struct{}{}
+	}
+	sec, err := value("StartTimeSec")
+	if err != nil {
+		return err
+	}
+	usec, err := value("StartTimeUsec")
+	if err != nil {
+		return err
+	}
+	secs, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad StartTimeSec %q", sec)
+	}
+	usecs, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad StartTimeUsec %q", usec)
+	}
+	start := time.Unix(secs, usecs*1000).UTC()
+	if s.Connections == 0 || start.Before(s.FirstStart) {
+		s.FirstStart = start
+	}
+	if s.Connections == 0 || start.After(s.LastStart) {
+		s.LastStart = start
+	}
+	s.Connections++
+	return nil
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Results of the inspection of a file, used as metric labels.
+const (
+	inspectMatch       = "match"
+	inspectMismatch    = "mismatch"
+	inspectNoNameIP    = "no_filename_ip"
+	inspectParseFailed = "parse_failed"
+)
+
+// isPublic decides whether the web100 file name, of the given content, can
+// be published, from its name, and from its content if it is inspected.
+func (ec *EmbargoConfig) isPublic(name string, content []byte) bool {
+	if !ec.inspectContent {
+		return ec.Whitelist().CheckInWhiteList(name)
+	}
+	public, result := ec.inspectPublic(name, content)
+	metrics.ContentInspectionsTotal.WithLabelValues(result).Inc()
+	return public
+}
+
+// inspectPublic decides from its content whether the web100 file name can
+// be published, and returns the result of the inspection. A file whose
+// name has no IP is public if all its local addresses are in the
+// whitelist. A file whose local addresses differ from the IP of its name is
+// embargoed. A file that cannot be parsed is decided by its name.
+func (ec *EmbargoConfig) inspectPublic(name string, content []byte) (bool, string) {
+	fn := FileName{Name: name}
+	nameIP := fn.GetLocalIP()
+	day := fileDay(name)
+	whitelist := ec.Whitelist()
+	snapshots, err := InspectWeb100(content)
+	if err != nil {
+		log.Printf("cannot inspect %s: %v\n", name, err)
+		return nameIP != "" && whitelist.CheckIPOn(nameIP, day), inspectParseFailed
+	}
+	if nameIP == "" {
+		for _, ip := range snapshots.LocalAddresses {
+			if !whitelist.CheckIPOn(ip, day) {
+				return false, inspectNoNameIP
+			}
+		}
+		return true, inspectNoNameIP
+	}
+	if len(snapshots.LocalAddresses) != 1 || snapshots.LocalAddresses[0] != nameIP {
+		log.Printf("%s has local addresses %v, embargoing it\n", name, snapshots.LocalAddresses)
+		return false, inspectMismatch
+	}
+	return whitelist.CheckIPOn(nameIP, day), inspectMatch
+}
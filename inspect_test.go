@@ -0,0 +1,187 @@
+package embargo_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+// snapshot returns a web100 snapshot file with one connection per pair of
+// local and remote addresses.
+func snapshot(addresses ...string) string {
+	lines := []string{"K: cid PollTime LocalAddress LocalPort RemAddress RemPort StartTimeSec StartTimeUsec"}
+	for i := 0; i+1 < len(addresses); i += 2 {
+		lines = append(lines, "C: 1 2017-03-15-05:00:37Z "+addresses[i]+" 80 "+addresses[i+1]+" 51234 1489554037 50000")
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestInspectWeb100(t *testing.T) {
+	content := snapshot("213.244.128.144", "1.2.3.4", "2001:4c08:2003:2:::148", "1.2.3.4") +
+		"C: 2 2017-03-15-05:00:37Z 213.244.128.144 80 5.6.7.8 51234 1489554000 0\n"
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(content))
+	zw.Close()
+
+	want := &embargo.Snapshots{
+		LocalAddresses:  []string{"2001:4c08:2003:2::148", "213.244.128.144"},
+		RemoteAddresses: []string{"1.2.3.4", "5.6.7.8"},
+		FirstStart:      time.Unix(1489554000, 0).UTC(),
+		LastStart:       time.Unix(1489554037, 50000000).UTC(),
+		Connections:     3,
+	}
+	for _, c := range [][]byte{[]byte(content), compressed.Bytes()} {
+		got, err := embargo.InspectWeb100(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("InspectWeb100() = %+v, want %+v", got, want)
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"K: cid LocalAddress\n",
+		"C: 1 213.244.128.144\n",
+		snapshot("213.244.128.144", "1.2.3.4") + "C: 1 2\n",
+		snapshot("not-an-ip", "1.2.3.4"),
+		"K: cid LocalAddress RemAddress\nC: 1 213.244.128.144 1.2.3.4\n",
+	} {
+		if _, err := embargo.InspectWeb100([]byte(bad)); err == nil {
+			t.Errorf("InspectWeb100(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestSplitFileInspectContent(t *testing.T) {
+	var whitelist embargo.WhitelistChecker
+	if err := whitelist.LoadFromLocalWhitelist("testdata/whitelist"); err != nil {
+		t.Fatal(err)
+	}
+	members := map[string]string{
+		// The name has no IP, the content has a whitelisted one.
+		"20170315T05:00:00Z_ALL0.web100": snapshot("213.244.128.144", "1.2.3.4"),
+		// The name has no IP, the content has one that is not whitelisted.
+		"20170315T06:00:00Z_ALL0.web100": snapshot("213.244.128.144", "1.2.3.4", "4.34.58.34", "1.2.3.4"),
+		// The name and the content match.
+		"20170315T07:00:00Z_213.244.128.144_0.web100": snapshot("213.244.128.144", "1.2.3.4"),
+		// The name is whitelisted, but not the content.
+		"20170315T08:00:00Z_213.244.128.144_0.web100": snapshot("4.34.58.34", "1.2.3.4"),
+		// The content cannot be parsed, so the name decides.
+		"20170315T09:00:00Z_213.244.128.144_0.web100": "garbage",
+		"20170315T10:00:00Z_4.34.58.34_0.web100":      "garbage",
+	}
+	var names []string
+	for name := range members {
+		names = append(names, name)
+	}
+	input := makeTgz(t, gzip.BestSpeed, members, names...)
+
+	tests := []struct {
+		inspect bool
+		public  []string
+	}{
+		{false, []string{
+			"20170315T07:00:00Z_213.244.128.144_0.web100",
+			"20170315T08:00:00Z_213.244.128.144_0.web100",
+			"20170315T09:00:00Z_213.244.128.144_0.web100",
+		}},
+		{true, []string{
+			"20170315T05:00:00Z_ALL0.web100",
+			"20170315T07:00:00Z_213.244.128.144_0.web100",
+			"20170315T09:00:00Z_213.244.128.144_0.web100",
+		}},
+	}
+	for _, tt := range tests {
+		ec := embargo.NewEmbargoConfig("", "", "", whitelist, nil)
+		ec.SetInspectContent(tt.inspect)
+		private, public, err := ec.SplitFile(context.Background(), bytes.NewReader(input), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicMembers, err := listRegular(public.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		privateMembers, err := listRegular(private.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]bool)
+		for _, m := range publicMembers {
+			got[m.name] = true
+		}
+		for _, name := range tt.public {
+			if !got[name] {
+				t.Errorf("inspect %v: %s is not public", tt.inspect, name)
+			}
+		}
+		if len(publicMembers) != len(tt.public) || len(privateMembers) != len(members)-len(tt.public) {
+			t.Errorf("inspect %v: %d public and %d private members, want %d and %d",
+				tt.inspect, len(publicMembers), len(privateMembers), len(tt.public), len(members)-len(tt.public))
+		}
+	}
+}
+
+// TestSplitFileInspectLegacy classifies the legacy files of 2016, whose
+// names have no IP, from their content.
+func TestSplitFileInspectLegacy(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/20160102T000000Z-mlab3-sin01-sidestream-0000.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := listRegular(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Whitelist the local addresses of all the files.
+	whitelist := embargo.WhitelistChecker{EmbargoWhiteList: make(map[string]struct{})}
+	var web100Files []string
+	for _, m := range members {
+		if !strings.HasSuffix(m.name, ".web100") {
+			continue
+		}
+		web100Files = append(web100Files, m.name)
+		snapshots, err := embargo.InspectWeb100([]byte(m.content))
+		if err != nil {
+			t.Fatalf("%s: %v", m.name, err)
+		}
+		for _, ip := range snapshots.LocalAddresses {
+			whitelist.EmbargoWhiteList[ip] = struct{}{}
+		}
+	}
+	if len(web100Files) == 0 {
+		t.Fatal("no legacy web100 file")
+	}
+
+	for _, inspect := range []bool{false, true} {
+		ec := embargo.NewEmbargoConfig("", "", "", whitelist, nil)
+		ec.SetInspectContent(inspect)
+		_, public, err := ec.SplitFile(context.Background(), bytes.NewReader(input), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicMembers, err := listRegular(public.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]bool)
+		for _, m := range publicMembers {
+			got[m.name] = true
+		}
+		for _, name := range web100Files {
+			if got[name] != inspect {
+				t.Errorf("inspect %v: %s is public: %v", inspect, name, got[name])
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Checks of how far behind embargo and unembargo are: the recent days whose
+// outputs are missing, and the days more than one year old whose embargoed
+// data is still not public.
+package embargo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/m-lab/etl-embargo/metrics"
+)
+
+// DayLag describes what is late for one day.
+type DayLag struct {
+	Date string `json:"date"`
+	// Sources is the number of sidestream archives of the day in the source
+	// bucket, for the days to embargo.
+	Sources int `json:"sources,omitempty"`
+	// MissingPublic and MissingPrivate list the source archives without their
+	// public or private output.
+	MissingPublic  []string `json:"missing_public,omitempty"`
+	MissingPrivate []string `json:"missing_private,omitempty"`
+	// Unpublished lists the private objects that were not copied to the
+	// public bucket, for the days to unembargo.
+	Unpublished []string `json:"unpublished,omitempty"`
+}
+
+// StaleObject is a private object created more than one year ago that is
+// still not public.
+type StaleObject struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// LagReport is the result of CheckLag.
+type LagReport struct {
+	Checked    time.Time `json:"checked"`
+	WindowDays int       `json:"window_days"`
+	// OK is true if nothing is late.
+	OK bool `json:"ok"`
+	// MissingOutputs are the days to embargo with missing outputs, and
+	// OverdueUnembargo the days to unembargo with unpublished objects.
+	MissingOutputs   []*DayLag     `json:"missing_outputs"`
+	OverdueUnembargo []*DayLag     `json:"overdue_unembargo"`
+	StalePrivate     []StaleObject `json:"stale_private"`
+}
+
+// CheckLag checks the windowDays days before now, which should be embargoed,
+// and the windowDays days before now minus one year, which should be
+// unembargoed. The day of now, and one year before it, are still being
+// processed and are left out. The results are also exported as metrics.
+func (ec *EmbargoConfig) CheckLag(ctx context.Context, now time.Time, windowDays int) (*LagReport, error) {
+	if ec.store == nil {
+		return nil, fmt.Errorf("storage service was not initialized")
+	}
+	if windowDays < 1 {
+		return nil, fmt.Errorf("invalid window of %d days", windowDays)
+	}
+	report := &LagReport{
+		Checked:          now.UTC(),
+		WindowDays:       windowDays,
+		MissingOutputs:   []*DayLag{},
+		OverdueUnembargo: []*DayLag{},
+		StalePrivate:     []StaleObject{},
+	}
+	for i := 1; i <= windowDays; i++ {
+		date := now.AddDate(0, 0, -i).Format("20060102")
+		day, err := ec.VerifyOneDay(ctx, date)
+		if err != nil {
+			return nil, err
+		}
+		if !day.Complete() {
+			report.MissingOutputs = append(report.MissingOutputs, &DayLag{
+				Date:           date,
+				Sources:        day.Sources,
+				MissingPublic:  day.MissingPublic,
+				MissingPrivate: day.MissingPrivate,
+			})
+		}
+	}
+
+	embargoEnd := now.AddDate(-1, 0, 0)
+	for i := 1; i <= windowDays; i++ {
+		date := embargoEnd.AddDate(0, 0, -i).Format("20060102")
+		day, stale, err := ec.unpublished(ctx, date, embargoEnd)
+		if err != nil {
+			return nil, err
+		}
+		if len(day.Unpublished) > 0 {
+			report.OverdueUnembargo = append(report.OverdueUnembargo, day)
+		}
+		report.StalePrivate = append(report.StalePrivate, stale...)
+	}
+	report.OK = len(report.MissingOutputs) == 0 && len(report.OverdueUnembargo) == 0 && len(report.StalePrivate) == 0
+
+	metrics.LagDays.WithLabelValues("missing_outputs").Set(float64(len(report.MissingOutputs)))
+	metrics.LagDays.WithLabelValues("overdue_unembargo").Set(float64(len(report.OverdueUnembargo)))
+	metrics.StalePrivateObjects.Set(float64(len(report.StalePrivate)))
+	metrics.LastSuccessTimestamp.WithLabelValues("sidestream", "lag_check").SetToCurrentTime()
+	return report, nil
+}
+
+// unpublished returns the private objects of the date (yyyymmdd) that are not
+// in the public bucket, and those of them created before embargoEnd.
+func (ec *EmbargoConfig) unpublished(ctx context.Context, date string, embargoEnd time.Time) (*DayLag, []StaleObject, error) {
+	prefix := DatePrefix("sidestream", date)
+	private, err := ec.store.ListObjects(ctx, ec.destPrivateBucket, prefix)
+	if err != nil {
+		return nil, nil, storageError("list", ec.destPrivateBucket, prefix, err)
+	}
+	public, err := objectNames(ctx, ec.store, ec.destPublicBucket, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	day := &DayLag{Date: date}
+	var stale []StaleObject
+	for _, o := range private {
+		if public[o.Name] {
+			continue
+		}
+		day.Unpublished = append(day.Unpublished, o.Name)
+		if created, err := time.Parse(time.RFC3339, o.TimeCreated); err == nil && created.Before(embargoEnd) {
+			stale = append(stale, StaleObject{Name: o.Name, Created: created})
+		}
+	}
+	sort.Strings(day.Unpublished)
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Name < stale[j].Name })
+	return day, stale, nil
+}
@@ -0,0 +1,74 @@
+package embargo_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+func TestCheckLag(t *testing.T) {
+	fs := newFakeStore()
+	// Embargoed.
+	fs.put("scraper", "sidestream/2017/05/31/a.tgz", []byte("a"))
+	fs.put("archive", "sidestream/2017/05/31/a.tgz", []byte("a"))
+	fs.put("embargo", "sidestream/2017/05/31/a-e.tgz", []byte("a"))
+	// Without private output.
+	fs.put("scraper", "sidestream/2017/05/30/b.tgz", []byte("b"))
+	fs.put("archive", "sidestream/2017/05/30/b.tgz", []byte("b"))
+	// Unembargoed.
+	fs.put("embargo", "sidestream/2016/05/31/c-e.tgz", []byte("c"))
+	fs.put("archive", "sidestream/2016/05/31/c-e.tgz", []byte("c"))
+	// Not unembargoed, embargoed on time and late.
+	fs.put("embargo", "sidestream/2016/05/30/d-e.tgz", []byte("d"))
+	fs.created["embargo/sidestream/2016/05/30/d-e.tgz"] = time.Date(2016, 5, 31, 3, 0, 0, 0, time.UTC)
+	fs.put("embargo", "sidestream/2016/05/30/e-e.tgz", []byte("e"))
+	fs.created["embargo/sidestream/2016/05/30/e-e.tgz"] = time.Date(2017, 5, 20, 3, 0, 0, 0, time.UTC)
+	// Out of the window.
+	fs.put("scraper", "sidestream/2017/05/29/f.tgz", []byte("f"))
+	fs.put("embargo", "sidestream/2016/05/29/g-e.tgz", []byte("g"))
+
+	ec := embargo.NewEmbargoConfig("scraper", "embargo", "archive", embargo.WhitelistChecker{}, fs)
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	report, err := ec.CheckLag(context.Background(), now, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &embargo.LagReport{
+		Checked:    now,
+		WindowDays: 2,
+		MissingOutputs: []*embargo.DayLag{{
+			Date:           "20170530",
+			Sources:        1,
+			MissingPublic:  []string{},
+			MissingPrivate: []string{"sidestream/2017/05/30/b.tgz"},
+		}},
+		OverdueUnembargo: []*embargo.DayLag{{
+			Date:        "20160530",
+			Unpublished: []string{"sidestream/2016/05/30/d-e.tgz", "sidestream/2016/05/30/e-e.tgz"},
+		}},
+		StalePrivate: []embargo.StaleObject{{
+			Name:    "sidestream/2016/05/30/d-e.tgz",
+			Created: time.Date(2016, 5, 31, 3, 0, 0, 0, time.UTC),
+		}},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("CheckLag() = %+v, want %+v", report, want)
+	}
+
+	// Nothing is late the next day, once everything is done.
+	fs.put("embargo", "sidestream/2017/05/30/b-e.tgz", []byte("b"))
+	report, err = ec.CheckLag(context.Background(), now.AddDate(0, 0, 1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK || len(report.MissingOutputs)+len(report.OverdueUnembargo)+len(report.StalePrivate) != 0 {
+		t.Errorf("CheckLag() = %+v, want nothing late", report)
+	}
+
+	if _, err := ec.CheckLag(context.Background(), now, 0); err == nil {
+		t.Error("CheckLag() of 0 days succeeded")
+	}
+}
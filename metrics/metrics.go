@@ -3,8 +3,10 @@
 package metrics
 
 import (
+	"log"
 	"net/http"
 	"net/http/pprof"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -34,7 +36,7 @@ var (
 			Name: "embargo_tar_output_total",
 			Help: "Number of tar output files by embargo app engine.",
 		},
-		// "sidestream", "public/private"
+		// "sidestream", "public/private/withheld"
 		[]string{"dataset", "status"})
 
 	// Measures the number of web100 files that were processed by embargo service.
@@ -47,9 +49,51 @@ var (
 			Name: "embargo_file_total",
 			Help: "Number of web100 sidestream files that were processed by embargo app engine.",
 		},
-		// "sidestream", "public/private"
+		// "sidestream", "public/private/withheld"
 		[]string{"dataset", "status"})
 
+	// EmbargoDecisionsTotal counts the members of the archives by output and
+	// reason of the decision.
+	// Provides metrics:
+	//   embargo_decisions_total
+	// Example usage:
+	//   metrics.EmbargoDecisionsTotal.WithLabelValues("withheld", "client_withheld").Inc()
+	EmbargoDecisionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "embargo_decisions_total",
+			Help: "Number of archive members by output and reason of the embargo decision.",
+		},
+		// "public/private/withheld", reason
+		[]string{"output", "reason"})
+
+	// AnonymizedFilesTotal counts the anonymized copies of embargoed web100
+	// files, by result.
+	// Provides metrics:
+	//   embargo_anonymized_files_total
+	// Example usage:
+	//   metrics.AnonymizedFilesTotal.WithLabelValues("published").Inc()
+	AnonymizedFilesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "embargo_anonymized_files_total",
+			Help: "Number of anonymized copies of embargoed web100 files.",
+		},
+		// "published/failed"
+		[]string{"result"})
+
+	// ContentInspectionsTotal counts the web100 files whose content was
+	// inspected, by result of the inspection.
+	// Provides metrics:
+	//   embargo_content_inspections_total
+	// Example usage:
+	//   metrics.ContentInspectionsTotal.WithLabelValues("mismatch").Inc()
+	ContentInspectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "embargo_content_inspections_total",
+			Help: "Number of web100 files whose content was inspected.",
+		},
+		// "match/mismatch/no_filename_ip/parse_failed"
+		[]string{"result"})
+
 	// Measures the number of tar files that was unembargoed by daily unembargo cron job.
 	// Provides metrics:
 	//   unembargo_tar_total
@@ -67,16 +111,226 @@ var (
 	// Provides metrics:
 	//   embargo_ipv6_errors_total
 	// Example usage:
-	//   metrics.IPv6ErrorsTotal.WithLabelValues(err.Error()).Inc()
+	//   metrics.IPv6ErrorsTotal.WithLabelValues("invalid_ip").Inc()
 	IPv6ErrorsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "embargo_ipv6_errors_total",
 			Help: "Number of failures normalizing IPv6 addresses.",
 		},
 		[]string{"error"})
+
+	// GCSRetriesTotal counts the retries of storage operations.
+	// Provides metrics:
+	//   embargo_gcs_retries_total
+	// Example usage:
+	//   metrics.GCSRetriesTotal.WithLabelValues("write", "retryable").Inc()
+	GCSRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "embargo_gcs_retries_total",
+			Help: "Number of retried GCS operations.",
+		},
+		// "list/read/write/delete/copy", error class
+		[]string{"operation", "class"})
+
+	// GCSRetryExhaustedTotal counts the storage operations that still failed
+	// with a retryable error when their retry policy was exhausted.
+	// Provides metrics:
+	//   embargo_gcs_retry_exhausted_total
+	// Example usage:
+	//   metrics.GCSRetryExhaustedTotal.WithLabelValues("write").Inc()
+	GCSRetryExhaustedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "embargo_gcs_retry_exhausted_total",
+			Help: "Number of GCS operations that failed after all retries.",
+		},
+		[]string{"operation"})
+
+	// AuthDenialsTotal counts the requests rejected by the auth middleware.
+	// Provides metrics:
+	//   embargo_auth_denials_total
+	// Example usage:
+	//   metrics.AuthDenialsTotal.WithLabelValues("/submit", "invalid_token").Inc()
+	AuthDenialsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "embargo_auth_denials_total",
+			Help: "Number of requests denied by the embargo auth middleware.",
+		},
+		// "/submit", "missing_credentials/invalid_token/principal_not_allowed/not_configured"
+		[]string{"route", "reason"})
+
+	// OperationDuration measures how long the steps of embargo and
+	// unembargo take: downloading one archive, splitting it, uploading its
+	// outputs, and unembargoing one day.
+	// Provides metrics:
+	//   embargo_operation_duration_seconds
+	// Example usage:
+	//   metrics.OperationDuration.WithLabelValues("split").Observe(seconds)
+	OperationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "embargo_operation_duration_seconds",
+			Help: "Duration of the embargo and unembargo operations.",
+			// 10ms to about 5 minutes.
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+		},
+		// "download/split/upload/unembargo"
+		[]string{"operation"})
+
+	// OutputBytesTotal counts the bytes of the archives written, by output.
+	// Provides metrics:
+	//   embargo_output_bytes_total
+	// Example usage:
+	//   metrics.OutputBytesTotal.WithLabelValues("sidestream", "public").Add(n)
+	OutputBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "embargo_output_bytes_total",
+			Help: "Number of bytes of the tar output files by embargo app engine.",
+		},
+		// "sidestream", "public/private/withheld"
+		[]string{"dataset", "output"})
+
+	// WhitelistSize is the number of IPs in the whitelist in use.
+	// Provides metrics:
+	//   embargo_whitelist_size
+	// Example usage:
+	//   metrics.WhitelistSize.Set(n)
+	WhitelistSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "embargo_whitelist_size",
+			Help: "Number of IPs in the embargo whitelist.",
+		})
+
+	// WhitelistFetchesTotal counts the fetches of the whitelist URL, by
+	// result.
+	// Provides metrics:
+	//   embargo_whitelist_fetches_total
+	// Example usage:
+	//   metrics.WhitelistFetchesTotal.WithLabelValues("not_modified").Inc()
+	WhitelistFetchesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "embargo_whitelist_fetches_total",
+			Help: "Number of fetches of the embargo whitelist, by result.",
+		},
+		// "fetched/not_modified/failed"
+		[]string{"result"})
+
+	// WhitelistStale is 1 if the whitelist in use is a cached list, used
+	// because the last fetch failed, and 0 otherwise.
+	// Provides metrics:
+	//   embargo_whitelist_stale
+	// Example usage:
+	//   metrics.WhitelistStale.Set(1)
+	WhitelistStale = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "embargo_whitelist_stale",
+			Help: "Whether the embargo whitelist in use is a fallback cached list.",
+		})
+
+	// WhitelistValidatedTimestamp is the time the whitelist in use was last
+	// fetched or confirmed unchanged, in seconds since the epoch.
+	// Provides metrics:
+	//   embargo_whitelist_validated_timestamp_seconds
+	// Example usage:
+	//   metrics.WhitelistValidatedTimestamp.Set(float64(t.Unix()))
+	WhitelistValidatedTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "embargo_whitelist_validated_timestamp_seconds",
+			Help: "Time the embargo whitelist in use was last validated.",
+		})
+
+	// LastSuccessTimestamp is the time of the last successful whitelist
+	// reload, embargo of an archive, unembargo of a day and lag check, in
+	// seconds since the epoch.
+	// Provides metrics:
+	//   embargo_last_success_timestamp_seconds
+	// Example usage:
+	//   metrics.LastSuccessTimestamp.WithLabelValues("sidestream", "embargo").SetToCurrentTime()
+	LastSuccessTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "embargo_last_success_timestamp_seconds",
+			Help: "Time of the last successful operation, by dataset.",
+		},
+		// "sidestream", "reload/embargo/unembargo/lag_check"
+		[]string{"dataset", "operation"})
+
+	// JobsInFlight is the number of embargo and unembargo jobs running.
+	// Provides metrics:
+	//   embargo_jobs_in_flight
+	// Example usage:
+	//   metrics.JobsInFlight.WithLabelValues("embargo").Inc()
+	JobsInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "embargo_jobs_in_flight",
+			Help: "Number of running embargo and unembargo jobs.",
+		},
+		// "embargo/unembargo"
+		[]string{"action"})
+
+	// LagDays is the number of days that are late, found by the last lag
+	// check: the recent days with missing outputs, and the days more than
+	// one year old that are not unembargoed.
+	// Provides metrics:
+	//   embargo_lag_days
+	// Example usage:
+	//   metrics.LagDays.WithLabelValues("missing_outputs").Set(n)
+	LagDays = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "embargo_lag_days",
+			Help: "Number of days late for embargo or unembargo.",
+		},
+		// "missing_outputs/overdue_unembargo"
+		[]string{"check"})
+
+	// StalePrivateObjects is the number of private objects created more than
+	// one year ago that are still not public, found by the last lag check.
+	// Provides metrics:
+	//   embargo_stale_private_objects
+	// Example usage:
+	//   metrics.StalePrivateObjects.Set(n)
+	StalePrivateObjects = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "embargo_stale_private_objects",
+			Help: "Number of private objects older than the embargo period.",
+		})
 )
 
-func SetupPrometheus() {
+var registerOnce sync.Once
+
+// Register registers the metrics with Prometheus's default registry, and
+// serves them on /metrics of the default serve mux. Only the first call
+// registers anything, so it is safe to call it more than once.
+func Register() {
+	registerOnce.Do(func() {
+		http.Handle("/metrics", promhttp.Handler())
+		prometheus.MustRegister(
+			Metrics_embargoTarInputTotal,
+			Metrics_embargoTarOutputTotal,
+			Metrics_embargoFileTotal,
+			ContentInspectionsTotal,
+			EmbargoDecisionsTotal,
+			AnonymizedFilesTotal,
+			Metrics_unembargoTarTotal,
+			IPv6ErrorsTotal,
+			AuthDenialsTotal,
+			GCSRetriesTotal,
+			GCSRetryExhaustedTotal,
+			OperationDuration,
+			OutputBytesTotal,
+			WhitelistSize,
+			WhitelistFetchesTotal,
+			WhitelistStale,
+			WhitelistValidatedTimestamp,
+			LastSuccessTimestamp,
+			JobsInFlight,
+			LagDays,
+			StalePrivateObjects,
+		)
+	})
+}
+
+// SetupPrometheus registers the metrics and serves them, with pprof, on
+// port 9090. It returns the server so that it can be shut down. Calling it
+// again does not register the metrics twice.
+func SetupPrometheus() *http.Server {
 	// Define a custom serve mux for prometheus to listen on a separate port.
 	// We listen on a separate port so we can forward this port on the host VM.
 	// We cannot forward port 8080 because it is used by AppEngine.
@@ -91,12 +345,13 @@ func SetupPrometheus() {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-	http.Handle("/metrics", promhttp.Handler())
-	// Register the metrics defined with Prometheus's default registry.
-	prometheus.MustRegister(Metrics_embargoTarInputTotal)
-	prometheus.MustRegister(Metrics_embargoTarOutputTotal)
-	prometheus.MustRegister(Metrics_embargoFileTotal)
-	prometheus.MustRegister(Metrics_unembargoTarTotal)
+	Register()
 
-	go http.ListenAndServe(":9090", mux)
+	srv := &http.Server{Addr: ":9090", Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("Metrics server failed: %v\n", err)
+		}
+	}()
+	return srv
 }
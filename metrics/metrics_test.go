@@ -0,0 +1,41 @@
+package metrics_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/etl-embargo/metrics"
+)
+
+func TestSetupPrometheusTwice(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		srv := metrics.SetupPrometheus()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metrics.Register()
+
+	metrics.OperationDuration.WithLabelValues("split").Observe(0.5)
+	metrics.WhitelistSize.Set(3)
+	metrics.JobsInFlight.WithLabelValues("embargo").Inc()
+	metrics.IPv6ErrorsTotal.WithLabelValues("invalid_ip").Inc()
+
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, want := range []string{
+		`embargo_operation_duration_seconds_count{operation="split"} 1`,
+		"embargo_whitelist_size 3",
+		`embargo_jobs_in_flight{action="embargo"} 1`,
+		`embargo_ipv6_errors_total{error="invalid_ip"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics does not have %q", want)
+		}
+	}
+}
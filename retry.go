@@ -0,0 +1,178 @@
+// Retry of storage operations with jittered exponential backoff.
+package embargo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+
+	"github.com/m-lab/etl-embargo/metrics"
+)
+
+// ErrorClass tells how a storage error should be handled.
+type ErrorClass string
+
+// The classes of storage errors. They are also the labels of the retry metric.
+const (
+	ClassNone               ErrorClass = "none"
+	ClassRetryable          ErrorClass = "retryable"
+	ClassPermanent          ErrorClass = "permanent"
+	ClassNotFound           ErrorClass = "not_found"
+	ClassPreconditionFailed ErrorClass = "precondition_failed"
+	ClassCanceled           ErrorClass = "canceled"
+)
+
+// ClassifyError returns the class of an error returned by a storage call.
+// Rate limiting, server errors and network failures are retryable.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ClassNone
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ClassCanceled
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusNotFound:
+			return ClassNotFound
+		case http.StatusPreconditionFailed:
+			return ClassPreconditionFailed
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return ClassRetryable
+		}
+		if gerr.Code >= 500 {
+			return ClassRetryable
+		}
+		return ClassPermanent
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ClassRetryable
+	}
+	return ClassPermanent
+}
+
+// RetryPolicy describes how often and for how long an operation is retried.
+// The delay before retry n is a random duration up to
+// min(MaxDelay, InitialDelay * Multiplier^n), so that clients retrying
+// together spread out.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	// MaxAttempts is the maximum number of calls, including the first one.
+	MaxAttempts int
+	// Budget is the total time after which no retry is started.
+	Budget time.Duration
+}
+
+// DefaultRetryPolicy is used for the GCS calls of the embargo service.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialDelay: 500 * time.Millisecond,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	MaxAttempts:  8,
+	Budget:       5 * time.Minute,
+}
+
+// Do calls fn until it succeeds, fails with an error that is not
+// retryable, or the policy is exhausted. It returns the last error, or
+// ctx.Err() if ctx is done while waiting. Each retry is counted in
+// metrics.GCSRetriesTotal with the operation name.
+func (p RetryPolicy) Do(ctx context.Context, operation string, fn func() error) error {
+	start := time.Now()
+	delay := p.InitialDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		class := ClassifyError(err)
+		if class != ClassRetryable {
+			if class == ClassCanceled && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if attempt >= p.MaxAttempts || time.Since(start)+delay > p.Budget {
+			log.Printf("%s failed after %d attempts: %v\n", operation, attempt, err)
+			metrics.GCSRetryExhaustedTotal.WithLabelValues(operation).Inc()
+			return err
+		}
+		metrics.GCSRetriesTotal.WithLabelValues(operation, string(class)).Inc()
+		wait := time.Duration(rand.Int63n(int64(delay) + 1))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		delay = time.Duration(float64(delay) * p.Multiplier)
+		if delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	}
+}
+
+// retryingStore retries the operations of another ObjectStore.
+type retryingStore struct {
+	store  ObjectStore
+	policy RetryPolicy
+}
+
+// NewRetryingStore returns an ObjectStore retrying the operations of store
+// according to policy.
+func NewRetryingStore(store ObjectStore, policy RetryPolicy) ObjectStore {
+	return &retryingStore{store: store, policy: policy}
+}
+
+func (rs *retryingStore) ListObjects(ctx context.Context, bucket, prefix string) ([]*storage.Object, error) {
+	var objects []*storage.Object
+	err := rs.policy.Do(ctx, "list", func() error {
+		var err error
+		objects, err = rs.store.ListObjects(ctx, bucket, prefix)
+		return err
+	})
+	return objects, err
+}
+
+func (rs *retryingStore) ReadObject(ctx context.Context, bucket, name string) ([]byte, error) {
+	var content []byte
+	err := rs.policy.Do(ctx, "read", func() error {
+		var err error
+		content, err = rs.store.ReadObject(ctx, bucket, name)
+		return err
+	})
+	return content, err
+}
+
+func (rs *retryingStore) WriteObject(ctx context.Context, bucket, name string, content []byte, contentType string) error {
+	return rs.policy.Do(ctx, "write", func() error {
+		return rs.store.WriteObject(ctx, bucket, name, content, contentType)
+	})
+}
+
+// DeleteObject treats "not found" on a retry as success, since an earlier
+// attempt that seemed to fail may have deleted the object.
+func (rs *retryingStore) DeleteObject(ctx context.Context, bucket, name string) error {
+	attempt := 0
+	return rs.policy.Do(ctx, "delete", func() error {
+		attempt++
+		err := rs.store.DeleteObject(ctx, bucket, name)
+		if attempt > 1 && ClassifyError(err) == ClassNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (rs *retryingStore) CopyObject(ctx context.Context, srcBucket, dstBucket, name string) error {
+	return rs.policy.Do(ctx, "copy", func() error {
+		return rs.store.CopyObject(ctx, srcBucket, dstBucket, name)
+	})
+}
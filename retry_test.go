@@ -0,0 +1,102 @@
+package embargo_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+var testPolicy = embargo.RetryPolicy{
+	InitialDelay: time.Millisecond,
+	MaxDelay:     4 * time.Millisecond,
+	Multiplier:   2,
+	MaxAttempts:  4,
+	Budget:       time.Second,
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want embargo.ErrorClass
+	}{
+		{nil, embargo.ClassNone},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, embargo.ClassRetryable},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, embargo.ClassRetryable},
+		{&googleapi.Error{Code: http.StatusNotFound}, embargo.ClassNotFound},
+		{&googleapi.Error{Code: http.StatusPreconditionFailed}, embargo.ClassPreconditionFailed},
+		{&googleapi.Error{Code: http.StatusForbidden}, embargo.ClassPermanent},
+		{io.ErrUnexpectedEOF, embargo.ClassRetryable},
+		{context.Canceled, embargo.ClassCanceled},
+		{errors.New("cannot parse"), embargo.ClassPermanent},
+	}
+	for _, tt := range tests {
+		if got := embargo.ClassifyError(tt.err); got != tt.want {
+			t.Errorf("ClassifyError(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryingStore(t *testing.T) {
+	ctx := context.Background()
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	fs := newFakeStore()
+	rs := embargo.NewRetryingStore(fs, testPolicy)
+
+	// Transient failures are retried.
+	fs.fail("write", unavailable, io.ErrUnexpectedEOF)
+	if err := rs.WriteObject(ctx, "b", "o", []byte("x"), ""); err != nil {
+		t.Errorf("WriteObject() = %v, want success after retries", err)
+	}
+	if fs.calls["write"] != 3 {
+		t.Errorf("WriteObject() made %d calls, want 3", fs.calls["write"])
+	}
+
+	// Permanent failures are not.
+	fs.fail("read", &googleapi.Error{Code: http.StatusForbidden})
+	if _, err := rs.ReadObject(ctx, "b", "o"); err == nil {
+		t.Error("ReadObject() succeeded, want the permanent error")
+	}
+	if fs.calls["read"] != 1 {
+		t.Errorf("ReadObject() made %d calls, want 1", fs.calls["read"])
+	}
+
+	// The policy gives up after MaxAttempts.
+	fs.fail("list", unavailable, unavailable, unavailable, unavailable, unavailable)
+	if _, err := rs.ListObjects(ctx, "b", ""); err != unavailable {
+		t.Errorf("ListObjects() = %v, want %v", err, unavailable)
+	}
+	if fs.calls["list"] != testPolicy.MaxAttempts {
+		t.Errorf("ListObjects() made %d calls, want %d", fs.calls["list"], testPolicy.MaxAttempts)
+	}
+
+	// A delete that seemed to fail but went through is a success: the
+	// retry finds nothing to delete.
+	fs.fail("delete", unavailable)
+	if err := rs.DeleteObject(ctx, "b", "gone"); err != nil {
+		t.Errorf("DeleteObject() = %v, want success", err)
+	}
+}
+
+func TestRetryPolicyCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := testPolicy
+	policy.InitialDelay = time.Hour
+	policy.MaxDelay = time.Hour
+	policy.Budget = 10 * time.Hour
+	calls := 0
+	err := policy.Do(ctx, "test", func() error {
+		calls++
+		cancel()
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+	if err != context.Canceled || calls != 1 {
+		t.Errorf("Do() = %v after %d calls, want %v after 1", err, calls, context.Canceled)
+	}
+}
@@ -0,0 +1,180 @@
+// Statistics of the members of the archives, by output, kind of file and
+// local IP, for one archive or aggregated for one day.
+package embargo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatsPrefix is the prefix, in the private bucket, of the statistics of the
+// archives: the statistics of sidestream/2017/03/15/a.tgz are in
+// stats/sidestream/2017/03/15/a.json. Unembargo copies the objects of a day
+// prefix, so it does not publish them.
+const StatsPrefix = "stats/"
+
+// SideStats counts members and their bytes.
+type SideStats struct {
+	Members int   `json:"members"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// SideCounts are the SideStats of each output: "public", "private",
+// "withheld", and "anonymized" for the anonymized copies.
+type SideCounts map[string]SideStats
+
+func (c SideCounts) add(side string, bytes int64) {
+	s := c[side]
+	s.Members++
+	s.Bytes += bytes
+	c[side] = s
+}
+
+func (c SideCounts) merge(other SideCounts) {
+	for side, o := range other {
+		s := c[side]
+		s.Members += o.Members
+		s.Bytes += o.Bytes
+		c[side] = s
+	}
+}
+
+// TarStats describes what EmbargoOneTar did with the members of one archive,
+// or of all the archives of one day once merged.
+type TarStats struct {
+	// Archives is the number of archives counted.
+	Archives int `json:"archives"`
+	// Sides counts the regular members by output.
+	Sides SideCounts `json:"sides"`
+	// Suffixes counts them by kind of file, like "web100" or "tra", and
+	// LocalIPs by local IP, "none" for the names without IP. Both are
+	// "unknown" for the names that cannot be parsed.
+	Suffixes map[string]SideCounts `json:"suffixes"`
+	LocalIPs map[string]SideCounts `json:"local_ips"`
+	// SkippedNonRegular is the number of entries other than regular files
+	// that were left out, like directories.
+	SkippedNonRegular int `json:"skipped_non_regular"`
+	// ParseFailures is the number of member names that cannot be parsed.
+	ParseFailures int `json:"parse_failures"`
+}
+
+// NewTarStats returns empty statistics.
+func NewTarStats() *TarStats {
+	return &TarStats{
+		Sides:    make(SideCounts),
+		Suffixes: make(map[string]SideCounts),
+		LocalIPs: make(map[string]SideCounts),
+	}
+}
+
+// addMember counts the member name, of size bytes, written to side.
+func (s *TarStats) addMember(name, side string, bytes int64) {
+	s.Sides.add(side, bytes)
+	suffix, ip := "unknown", "unknown"
+	if m, err := ParseMemberName(name); err == nil {
+		suffix, ip = m.Suffix, m.GetLocalIP()
+		if ip == "" {
+			ip = "none"
+		}
+	} else {
+		s.ParseFailures++
+	}
+	for _, c := range []struct {
+		counts map[string]SideCounts
+		key    string
+	}{{s.Suffixes, suffix}, {s.LocalIPs, ip}} {
+		if c.counts[c.key] == nil {
+			c.counts[c.key] = make(SideCounts)
+		}
+		c.counts[c.key].add(side, bytes)
+	}
+}
+
+// Merge adds the statistics of other to s.
+func (s *TarStats) Merge(other *TarStats) {
+	s.Archives += other.Archives
+	s.Sides.merge(other.Sides)
+	for _, c := range []struct{ into, from map[string]SideCounts }{
+		{s.Suffixes, other.Suffixes},
+		{s.LocalIPs, other.LocalIPs},
+	} {
+		for key, counts := range c.from {
+			if c.into[key] == nil {
+				c.into[key] = make(SideCounts)
+			}
+			c.into[key].merge(counts)
+		}
+	}
+	s.SkippedNonRegular += other.SkippedNonRegular
+	s.ParseFailures += other.ParseFailures
+}
+
+// String summarizes s in one line, for the logs.
+func (s *TarStats) String() string {
+	sides := make([]string, 0, len(s.Sides))
+	for side := range s.Sides {
+		sides = append(sides, side)
+	}
+	sort.Strings(sides)
+	parts := []string{strconv.Itoa(s.Archives) + " archive(s)"}
+	for _, side := range sides {
+		parts = append(parts, fmt.Sprintf("%s %d member(s) %d bytes", side, s.Sides[side].Members, s.Sides[side].Bytes))
+	}
+	parts = append(parts, fmt.Sprintf("%d skipped, %d unparsed name(s)", s.SkippedNonRegular, s.ParseFailures))
+	return strings.Join(parts, ", ")
+}
+
+// StatsName returns the name of the statistics of the archive name.
+func StatsName(name string) string {
+	_, ext := codecForName(name)
+	return StatsPrefix + strings.TrimSuffix(name, ext) + ".json"
+}
+
+// writeStats writes the statistics of tarfileName to the private bucket.
+func (ec *EmbargoConfig) writeStats(ctx context.Context, tarfileName string, stats *TarStats) error {
+	content, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	statsName := StatsName(tarfileName)
+	if err := ec.store.WriteObject(ctx, ec.destPrivateBucket, statsName, content, "application/json"); err != nil {
+		err = storageError("write", ec.destPrivateBucket, statsName, err)
+		log.Printf("Objects insert failed: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// DayStats merges the statistics of the archives of one day, in format
+// yyyymmdd, written by EmbargoOneTar.
+func (ec *EmbargoConfig) DayStats(ctx context.Context, date string) (*TarStats, error) {
+	if len(date) != 8 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDate, date)
+	}
+	if _, err := strconv.Atoi(date); err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDate, date)
+	}
+	prefix := StatsPrefix + DatePrefix("sidestream", date) + "/"
+	objects, err := ec.store.ListObjects(ctx, ec.destPrivateBucket, prefix)
+	if err != nil {
+		return nil, storageError("list", ec.destPrivateBucket, prefix, err)
+	}
+	day := NewTarStats()
+	for _, o := range objects {
+		content, err := ec.store.ReadObject(ctx, ec.destPrivateBucket, o.Name)
+		if err != nil {
+			return nil, storageError("read", ec.destPrivateBucket, o.Name, err)
+		}
+		stats := NewTarStats()
+		if err := json.Unmarshal(content, stats); err != nil {
+			return nil, fmt.Errorf("cannot parse %s: %v", o.Name, err)
+		}
+		day.Merge(stats)
+	}
+	return day, nil
+}
@@ -0,0 +1,110 @@
+package embargo_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+func TestEmbargoOneTarStats(t *testing.T) {
+	var whitelist embargo.WhitelistChecker
+	if err := whitelist.LoadFromLocalWhitelist("testdata/whitelist"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile("testdata/20170315T000000Z-mlab3-sea03-sidestream-0000.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newFakeStore()
+	ec := embargo.NewEmbargoConfig("scraper", "embargo", "archive", whitelist, fs)
+	const name = "sidestream/2017/03/15/20170315T000000Z-mlab3-sea03-sidestream-0000.tgz"
+	stats, err := ec.EmbargoOneTar(context.Background(), bytes.NewReader(content), name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The statistics match the outputs.
+	for side, bucket := range map[string]string{"public": "archive", "private": "embargo"} {
+		output := name
+		if side == "private" {
+			output = embargo.EmbargoedName(name)
+		}
+		object, err := fs.ReadObject(context.Background(), bucket, output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members, err := listRegular(object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bytes int64
+		for _, m := range members {
+			bytes += int64(len(m.content))
+		}
+		if got := stats.Sides[side]; got.Members != len(members) || got.Bytes != bytes {
+			t.Errorf("%s stats %+v, want %d members and %d bytes", side, got, len(members), bytes)
+		}
+		var bySuffix embargo.SideStats
+		for _, counts := range stats.Suffixes {
+			bySuffix.Members += counts[side].Members
+			bySuffix.Bytes += counts[side].Bytes
+		}
+		if bySuffix != stats.Sides[side] {
+			t.Errorf("%s stats by suffix %+v, want %+v", side, bySuffix, stats.Sides[side])
+		}
+	}
+	// The sea03 servers are not whitelisted: only the .tra files, without
+	// IP, are public.
+	if got := stats.Suffixes["tra"]["public"]; got != stats.Sides["public"] || got != stats.LocalIPs["none"]["public"] {
+		t.Errorf("public tra stats %+v, want %+v", got, stats.Sides["public"])
+	}
+	if got := stats.LocalIPs["2001:668:1f:1d::43"]["private"].Members; got != 24 {
+		t.Errorf("%d private members counted for 2001:668:1f:1d::43, want 24", got)
+	}
+	if stats.Archives != 1 || stats.ParseFailures != 0 || stats.SkippedNonRegular == 0 {
+		t.Errorf("stats %d archives, %d parse failures, %d skipped", stats.Archives, stats.ParseFailures, stats.SkippedNonRegular)
+	}
+
+	// They are saved next to the outputs, and merged by day.
+	sidecar, err := fs.ReadObject(context.Background(), "embargo", embargo.StatsName(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := embargo.NewTarStats()
+	if err := json.Unmarshal(sidecar, saved); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, stats) {
+		t.Errorf("saved stats %+v, want %+v", saved, stats)
+	}
+
+	odd := makeTgz(t, gzip.BestSpeed, map[string]string{"README": "hello"}, "README")
+	if _, err := ec.EmbargoOneTar(context.Background(), bytes.NewReader(odd), "sidestream/2017/03/15/odd.tgz", false); err != nil {
+		t.Fatal(err)
+	}
+	day, err := ec.DayStats(context.Background(), "20170315")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := embargo.NewTarStats()
+	want.Merge(stats)
+	want.Archives++
+	want.ParseFailures++
+	want.Sides["public"] = embargo.SideStats{Members: stats.Sides["public"].Members + 1, Bytes: stats.Sides["public"].Bytes + 5}
+	want.Suffixes["unknown"] = embargo.SideCounts{"public": {Members: 1, Bytes: 5}}
+	want.LocalIPs["unknown"] = embargo.SideCounts{"public": {Members: 1, Bytes: 5}}
+	if !reflect.DeepEqual(day, want) {
+		t.Errorf("DayStats() = %+v, want %+v", day, want)
+	}
+
+	if _, err := ec.DayStats(context.Background(), "2017"); !errors.Is(err, embargo.ErrInvalidDate) {
+		t.Errorf("DayStats(2017) = %v, want ErrInvalidDate", err)
+	}
+}
@@ -0,0 +1,112 @@
+// Storage operations used by the embargo and unembargo processes, behind an
+// interface so that they can be retried and faked in tests.
+package embargo
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+// ObjectStore is the set of storage operations the embargo process needs.
+// All of them are idempotent, so they can be retried.
+type ObjectStore interface {
+	// ListObjects returns all objects of bucket whose name starts with prefix.
+	ListObjects(ctx context.Context, bucket, prefix string) ([]*storage.Object, error)
+	// ReadObject returns the whole content of an object.
+	ReadObject(ctx context.Context, bucket, name string) ([]byte, error)
+	// WriteObject creates or replaces an object.
+	WriteObject(ctx context.Context, bucket, name string, content []byte, contentType string) error
+	// DeleteObject deletes an object.
+	DeleteObject(ctx context.Context, bucket, name string) error
+	// CopyObject copies an object to another bucket, keeping its name,
+	// content type and metadata.
+	CopyObject(ctx context.Context, srcBucket, dstBucket, name string) error
+}
+
+// gcsStore implements ObjectStore with the GCS JSON API.
+type gcsStore struct {
+	service *storage.Service
+}
+
+// NewGCSStore returns an ObjectStore using service.
+func NewGCSStore(service *storage.Service) ObjectStore {
+	return &gcsStore{service: service}
+}
+
+func (gs *gcsStore) ListObjects(ctx context.Context, bucket, prefix string) ([]*storage.Object, error) {
+	var objects []*storage.Object
+	pageToken := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		call := gs.service.Objects.List(bucket).Prefix(prefix).PageToken(pageToken)
+		list, err := call.Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, list.Items...)
+		if pageToken = list.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+	return objects, nil
+}
+
+func (gs *gcsStore) ReadObject(ctx context.Context, bucket, name string) ([]byte, error) {
+	resp, err := gs.service.Objects.Get(bucket, name).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (gs *gcsStore) WriteObject(ctx context.Context, bucket, name string, content []byte, contentType string) error {
+	object := &storage.Object{Name: name, ContentType: contentType}
+	_, err := gs.service.Objects.Insert(bucket, object).Media(bytes.NewReader(content)).Context(ctx).Do()
+	return err
+}
+
+func (gs *gcsStore) DeleteObject(ctx context.Context, bucket, name string) error {
+	return gs.service.Objects.Delete(bucket, name).Context(ctx).Do()
+}
+
+// CopyObject copies on the server side. Large objects take several rewrite
+// calls, each continuing from the token returned by the previous one.
+// The destination resource is left empty, so the copy keeps the content
+// type and metadata of the source.
+func (gs *gcsStore) CopyObject(ctx context.Context, srcBucket, dstBucket, name string) error {
+	token := ""
+	for {
+		call := gs.service.Objects.Rewrite(srcBucket, name, dstBucket, name, &storage.Object{})
+		if token != "" {
+			call.RewriteToken(token)
+		}
+		resp, err := call.Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		if resp.Done {
+			return nil
+		}
+		token = resp.RewriteToken
+	}
+}
+
+// objectNames returns the set of names of the objects of bucket whose name
+// starts with prefix.
+func objectNames(ctx context.Context, store ObjectStore, bucket, prefix string) (map[string]bool, error) {
+	objects, err := store.ListObjects(ctx, bucket, prefix)
+	if err != nil {
+		return nil, storageError("list", bucket, prefix, err)
+	}
+	names := make(map[string]bool, len(objects))
+	for _, o := range objects {
+		names[o.Name] = true
+	}
+	return names, nil
+}
@@ -0,0 +1,189 @@
+package embargo_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+// fakeStore is an in-memory embargo.ObjectStore. Before each call of an
+// operation, the next error queued for it in failures is returned instead.
+type fakeStore struct {
+	mu       sync.Mutex
+	objects  map[string][]byte // "bucket/name" -> content
+	failures map[string][]error
+	calls    map[string]int
+	created  map[string]time.Time // "bucket/name" -> creation time, if set
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		objects:  make(map[string][]byte),
+		failures: make(map[string][]error),
+		calls:    make(map[string]int),
+		created:  make(map[string]time.Time),
+	}
+}
+
+// fail queues errors to be returned by the next calls of operation.
+func (fs *fakeStore) fail(operation string, errs ...error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failures[operation] = append(fs.failures[operation], errs...)
+}
+
+// call counts a call of operation and returns the queued error, if any.
+func (fs *fakeStore) call(operation string) error {
+	fs.calls[operation]++
+	if errs := fs.failures[operation]; len(errs) > 0 {
+		fs.failures[operation] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func (fs *fakeStore) put(bucket, name string, content []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.objects[bucket+"/"+name] = content
+}
+
+// names returns the sorted names of the objects in bucket.
+func (fs *fakeStore) names(bucket string) []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var names []string
+	for key := range fs.objects {
+		if strings.HasPrefix(key, bucket+"/") {
+			names = append(names, strings.TrimPrefix(key, bucket+"/"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// archives returns the names of the archives in bucket, leaving out the
+// statistics.
+func (fs *fakeStore) archives(bucket string) []string {
+	var names []string
+	for _, name := range fs.names(bucket) {
+		if !strings.HasPrefix(name, embargo.StatsPrefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (fs *fakeStore) ListObjects(ctx context.Context, bucket, prefix string) ([]*storage.Object, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call("list"); err != nil {
+		return nil, err
+	}
+	var objects []*storage.Object
+	for key, content := range fs.objects {
+		if strings.HasPrefix(key, bucket+"/"+prefix) {
+			o := &storage.Object{
+				Name:   strings.TrimPrefix(key, bucket+"/"),
+				Size:   uint64(len(content)),
+				Crc32c: crc32c(content),
+			}
+			if created, ok := fs.created[key]; ok {
+				o.TimeCreated = created.Format(time.RFC3339)
+			}
+			objects = append(objects, o)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+// crc32c returns the checksum of content encoded like in GCS object resources.
+func crc32c(content []byte) string {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+func (fs *fakeStore) ReadObject(ctx context.Context, bucket, name string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call("read"); err != nil {
+		return nil, err
+	}
+	content, ok := fs.objects[bucket+"/"+name]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	return content, nil
+}
+
+func (fs *fakeStore) WriteObject(ctx context.Context, bucket, name string, content []byte, contentType string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call("write"); err != nil {
+		return err
+	}
+	fs.objects[bucket+"/"+name] = append([]byte(nil), content...)
+	return nil
+}
+
+func (fs *fakeStore) DeleteObject(ctx context.Context, bucket, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call("delete"); err != nil {
+		return err
+	}
+	if _, ok := fs.objects[bucket+"/"+name]; !ok {
+		return &googleapi.Error{Code: http.StatusNotFound}
+	}
+	delete(fs.objects, bucket+"/"+name)
+	return nil
+}
+
+func (fs *fakeStore) CopyObject(ctx context.Context, srcBucket, dstBucket, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call("copy"); err != nil {
+		return err
+	}
+	content, ok := fs.objects[srcBucket+"/"+name]
+	if !ok {
+		return &googleapi.Error{Code: http.StatusNotFound}
+	}
+	fs.objects[dstBucket+"/"+name] = content
+	return nil
+}
+
+func TestUnEmbargoOneDay(t *testing.T) {
+	fs := newFakeStore()
+	fs.put("private", "sidestream/2016/01/02/a-e.tgz", []byte("a"))
+	fs.put("private", "sidestream/2016/01/02/b.tgz", []byte("new b"))
+	fs.put("private", "sidestream/2016/01/03/c-e.tgz", []byte("c"))
+	fs.put("public", "sidestream/2016/01/02/b.tgz", []byte("old b"))
+	fs.put("public", "sidestream/2016/01/02/a.tgz", []byte("a"))
+
+	err := embargo.UnEmbargoOneDay(context.Background(), fs, "private", "public", "sidestream/2016/01/02")
+	if err != nil {
+		t.Fatalf("UnEmbargoOneDay() = %v", err)
+	}
+	want := []string{"sidestream/2016/01/02/a-e.tgz", "sidestream/2016/01/02/a.tgz", "sidestream/2016/01/02/b.tgz"}
+	if got := fs.names("public"); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("public bucket = %v, want %v", got, want)
+	}
+	if string(fs.objects["public/sidestream/2016/01/02/b.tgz"]) != "new b" {
+		t.Error("existing public file was not replaced")
+	}
+}
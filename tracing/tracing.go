@@ -0,0 +1,99 @@
+// The tracing package sets up the OpenTelemetry tracing of the embargo
+// service. Until Setup installs an exporter, the spans are no-ops, so tests
+// and tools need no configuration.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters of the spans.
+const (
+	// ExporterNone does not record spans.
+	ExporterNone = ""
+	// ExporterStdout writes the spans as JSON to stdout.
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends the spans to an OTLP gRPC collector, configured by
+	// the standard OTEL_EXPORTER_OTLP_* variables.
+	ExporterOTLP = "otlp"
+)
+
+// Tracer returns the tracer of the embargo spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/m-lab/etl-embargo")
+}
+
+// Start starts a span named name, child of the span of ctx if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// WithSpan returns ctx carrying the span of from, so that the spans started
+// from ctx are its children even though ctx is not derived from from.
+func WithSpan(ctx, from context.Context) context.Context {
+	return trace.ContextWithSpan(ctx, trace.SpanFromContext(from))
+}
+
+// End records err, if not nil, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Setup installs a tracer provider sending the spans to exporter,
+// ExporterStdout or ExporterOTLP. With ExporterNone it does nothing. It
+// returns a function flushing and stopping the exporter.
+func Setup(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	var (
+		exp sdktrace.SpanExporter
+		err error
+	)
+	switch exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		exp, err = otlptracegrpc.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// HandlerFunc wraps h in a span named route, continuing the trace of the
+// request if it has one.
+func HandlerFunc(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Tracer().Start(ctx, route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.RequestURI()),
+			))
+		defer span.End()
+		h(w, r.WithContext(ctx))
+	}
+}
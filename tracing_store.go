@@ -0,0 +1,63 @@
+// An ObjectStore recording a span for each storage operation.
+package embargo
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	storage "google.golang.org/api/storage/v1"
+
+	"github.com/m-lab/etl-embargo/tracing"
+)
+
+// tracingStore records the operations of another ObjectStore as spans,
+// children of the span of their context.
+type tracingStore struct {
+	store ObjectStore
+}
+
+// NewTracingStore returns an ObjectStore recording a span named like
+// "storage.read" for each operation of store, with the bucket, the object
+// and the bytes read or written.
+func NewTracingStore(store ObjectStore) ObjectStore {
+	return &tracingStore{store: store}
+}
+
+func (ts *tracingStore) ListObjects(ctx context.Context, bucket, prefix string) ([]*storage.Object, error) {
+	ctx, span := tracing.Start(ctx, "storage.list", attribute.String("bucket", bucket), attribute.String("prefix", prefix))
+	objects, err := ts.store.ListObjects(ctx, bucket, prefix)
+	span.SetAttributes(attribute.Int("objects", len(objects)))
+	tracing.End(span, err)
+	return objects, err
+}
+
+func (ts *tracingStore) ReadObject(ctx context.Context, bucket, name string) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "storage.read", attribute.String("bucket", bucket), attribute.String("object", name))
+	content, err := ts.store.ReadObject(ctx, bucket, name)
+	span.SetAttributes(attribute.Int("bytes", len(content)))
+	tracing.End(span, err)
+	return content, err
+}
+
+func (ts *tracingStore) WriteObject(ctx context.Context, bucket, name string, content []byte, contentType string) error {
+	ctx, span := tracing.Start(ctx, "storage.write", attribute.String("bucket", bucket), attribute.String("object", name),
+		attribute.Int("bytes", len(content)))
+	err := ts.store.WriteObject(ctx, bucket, name, content, contentType)
+	tracing.End(span, err)
+	return err
+}
+
+func (ts *tracingStore) DeleteObject(ctx context.Context, bucket, name string) error {
+	ctx, span := tracing.Start(ctx, "storage.delete", attribute.String("bucket", bucket), attribute.String("object", name))
+	err := ts.store.DeleteObject(ctx, bucket, name)
+	tracing.End(span, err)
+	return err
+}
+
+func (ts *tracingStore) CopyObject(ctx context.Context, srcBucket, dstBucket, name string) error {
+	ctx, span := tracing.Start(ctx, "storage.copy", attribute.String("bucket", srcBucket),
+		attribute.String("destination", dstBucket), attribute.String("object", name))
+	err := ts.store.CopyObject(ctx, srcBucket, dstBucket, name)
+	tracing.End(span, err)
+	return err
+}
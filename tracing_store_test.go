@@ -0,0 +1,84 @@
+package embargo_test
+
+import (
+	"compress/gzip"
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+// recordSpans records the spans ended until the returned function is called,
+// which returns them as "parent > name", sorted.
+func recordSpans(t *testing.T) func() []string {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return func() []string {
+		otel.SetTracerProvider(previous)
+		spans := recorder.Ended()
+		names := make(map[string]string)
+		for _, s := range spans {
+			names[s.SpanContext().SpanID().String()] = s.Name()
+		}
+		var got []string
+		for _, s := range spans {
+			got = append(got, names[s.Parent().SpanID().String()]+" > "+s.Name())
+		}
+		sort.Strings(got)
+		return got
+	}
+}
+
+func TestTracingStore(t *testing.T) {
+	var whitelist embargo.WhitelistChecker
+	if err := whitelist.LoadFromLocalWhitelist("testdata/whitelist"); err != nil {
+		t.Fatal(err)
+	}
+	const (
+		tarball = "sidestream/2017/03/15/20170315T000000Z-mlab1-sea03-sidestream-0000.tgz"
+		public  = "20170315T05:00:00Z_213.244.128.144_0.web100"
+		private = "20170315T06:00:00Z_4.34.58.34_0.web100"
+	)
+	fs := newFakeStore()
+	fs.put("scraper", tarball, makeTgz(t, gzip.BestSpeed, map[string]string{
+		public:  snapshot("213.244.128.144", "203.0.113.1"),
+		private: snapshot("4.34.58.34", "203.0.113.1"),
+	}, public, private))
+	fs.put("archive", "sidestream/2016/03/15/a-e.tgz", []byte("old a"))
+	fs.put("embargo", "sidestream/2016/03/15/a-e.tgz", []byte("a"))
+	store := embargo.NewTracingStore(fs)
+
+	spans := recordSpans(t)
+	ec := embargo.NewEmbargoConfig("scraper", "embargo", "archive", whitelist, store)
+	if err := ec.EmbargoSingleFile(context.Background(), tarball); err != nil {
+		t.Fatal(err)
+	}
+	if err := embargo.UnEmbargoOneDay(context.Background(), store, "embargo", "archive", "sidestream/2016/03/15"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		" > embargo.tarball",
+		" > unembargo.day",
+		"embargo.download > storage.read",
+		"embargo.tarball > embargo.download",
+		"embargo.tarball > embargo.split",
+		"embargo.tarball > embargo.write",
+		"embargo.write > storage.write",
+		"embargo.write > storage.write",
+		"embargo.write > storage.write",
+		"unembargo.day > storage.copy",
+		"unembargo.day > storage.delete",
+		"unembargo.day > storage.list",
+		"unembargo.day > storage.list",
+	}
+	if got := spans(); !reflect.DeepEqual(got, want) {
+		t.Errorf("spans %q, want %q", got, want)
+	}
+}
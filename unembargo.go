@@ -28,18 +28,18 @@ package embargo
 // 2. Copy the private files directlyif there is no existing public files with the same name.
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"golang.org/x/net/context"
 	storage_v1 "google.golang.org/api/storage/v1"
 	"log"
 	"os"
 	"strconv"
 	"time"
 
-	"cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/m-lab/etl-embargo/metrics"
+	"github.com/m-lab/etl-embargo/tracing"
 )
 
 type UnembargoConfig struct {
@@ -56,15 +56,18 @@ func NewUnembargoConfig(privateBucketName, publicBucketName string) *UnembargoCo
 }
 
 // Get filenames for given bucket with the given prefix. Use the service
-func GetFileNamesWithPrefix(service *storage_v1.Service, bucketName string, prefixFileName string) (map[string]bool, error) {
+func GetFileNamesWithPrefix(ctx context.Context, service *storage_v1.Service, bucketName string, prefixFileName string) (map[string]bool, error) {
 	existingFilenames := make(map[string]bool)
 	pageToken := ""
 	for {
+		if err := ctx.Err(); err != nil {
+			return existingFilenames, err
+		}
 		destinationFiles := service.Objects.List(bucketName)
 
 		destinationFiles.Prefix(prefixFileName)
 		destinationFiles.PageToken(pageToken)
-		destinationFilesList, err := destinationFiles.Context(context.Background()).Do()
+		destinationFilesList, err := destinationFiles.Context(ctx).Do()
 		if err != nil {
 			log.Printf("Objects.List failed: %v\n", err)
 			return existingFilenames, err
@@ -83,67 +86,81 @@ func GetFileNamesWithPrefix(service *storage_v1.Service, bucketName string, pref
 // UnEmbargoOneDayLegacyFiles unembargos one day data in the sourceBucket,
 // and writes the output to destBucket.
 // The date is used as prefixFileName in format sidestream/yyyy/mm/dd
-func UnEmbargoOneDayLegacyFiles(sourceBucket string, destBucket string, prefixFileName string) error {
+// It stops between files and returns ctx.Err() once ctx is done.
+func UnEmbargoOneDayLegacyFiles(ctx context.Context, sourceBucket string, destBucket string, prefixFileName string) error {
 	unembargoService := CreateService()
 	if unembargoService == nil {
 		log.Printf("Storage service was not initialized.\n")
 		return fmt.Errorf("Storage service was not initialized.\n")
 	}
-	client, err := storage.NewClient(context.Background())
+	store := NewTracingStore(NewRetryingStore(NewGCSStore(unembargoService), DefaultRetryPolicy))
+	return UnEmbargoOneDay(ctx, store, sourceBucket, destBucket, prefixFileName)
+}
+
+// UnEmbargoOneDay copies the files with prefixFileName from sourceBucket to
+// destBucket using store, replacing the files with the same name.
+func UnEmbargoOneDay(ctx context.Context, store ObjectStore, sourceBucket string, destBucket string, prefixFileName string) (err error) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "unembargo.day", attribute.String("prefix", prefixFileName))
+	copied, bytes := 0, uint64(0)
+	defer func() {
+		span.SetAttributes(attribute.Int("objects", copied), attribute.Int64("bytes", int64(bytes)))
+		tracing.End(span, err)
+	}()
+	// Build list of exisitng files in destination bucket.
+	existingFilenames, err := objectNames(ctx, store, destBucket, prefixFileName)
 	if err != nil {
 		return err
 	}
 
-	// Build list of exisitng files in destination bucket.
-	existingFilenames, err := GetFileNamesWithPrefix(unembargoService, destBucket, prefixFileName)
+	// Get list all objects in source bucket.
+	sourceFiles, err := store.ListObjects(ctx, sourceBucket, prefixFileName)
 	if err != nil {
-		return err
+		log.Printf("Objects List of source bucket failed: %v\n", err)
+		return storageError("list", sourceBucket, prefixFileName, err)
 	}
 
 	// Copy files.
-	pageToken := ""
-	for {
-		// Get list all objects in source bucket.
-		sourceFiles := unembargoService.Objects.List(sourceBucket)
-		sourceFiles.Prefix(prefixFileName)
-		sourceFiles.PageToken(pageToken)
-		sourceFilesList, err := sourceFiles.Context(context.Background()).Do()
-		if err != nil {
-			log.Printf("Objects List of source bucket failed: %v\n", err)
+	for _, oneItem := range sourceFiles {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		for _, oneItem := range sourceFilesList.Items {
-			if existingFilenames[oneItem.Name] {
-				// Delete the exisitng file in destBucket.
-				result := unembargoService.Objects.Delete(destBucket, oneItem.Name).Do()
-				if result != nil {
-					log.Printf("Objects deletion from public bucket failed.\n")
-					return fmt.Errorf("Objects deletion from public bucket failed.\n")
+		if existingFilenames[oneItem.Name] {
+			// Delete the exisitng file in destBucket.
+			if err := store.DeleteObject(ctx, destBucket, oneItem.Name); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
 				}
+				log.Printf("Objects deletion from public bucket failed.\n")
+				return storageError("delete", destBucket, oneItem.Name, err)
 			}
-			// Copy the file to dest bucket.
-			// CopierFrom() is only available in newer "cloud.google.com/go/storage" libraty
-			src := client.Bucket(sourceBucket).Object(oneItem.Name)
-			dst := client.Bucket(destBucket).Object(oneItem.Name)
-			if _, err := dst.CopierFrom(src).Run(context.Background()); err != nil {
-				return fmt.Errorf("Objects copy failed: %v\n", err)
-			}
-
-			metrics.Metrics_unembargoTarTotal.WithLabelValues("sidestream").Inc()
 		}
-		pageToken = sourceFilesList.NextPageToken
-		if pageToken == "" {
-			break
+		// Copy the file to dest bucket, on the server side.
+		if err := store.CopyObject(ctx, sourceBucket, destBucket, oneItem.Name); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return storageError("copy", sourceBucket, oneItem.Name, err)
 		}
+
+		metrics.Metrics_unembargoTarTotal.WithLabelValues("sidestream").Inc()
+		copied++
+		bytes += oneItem.Size
 	}
+	metrics.OperationDuration.WithLabelValues("unembargo").Observe(time.Since(start).Seconds())
+	metrics.LastSuccessTimestamp.WithLabelValues("sidestream", "unembargo").SetToCurrentTime()
 	return nil
 }
 
 // Unembargo unembargo the data of the input date in format yyyymmdd.
 // TODO(dev): add more validity check for input date.
-func (nc *UnembargoConfig) Unembargo(date int) error {
+func (nc *UnembargoConfig) Unembargo(ctx context.Context, date int) error {
 	if date <= 20160000 || date > 21000000 {
-		return errors.New("The date is out of range.")
+		return fmt.Errorf("%w: %d is out of range", ErrInvalidDate, date)
+	}
+	if date > FormatDateAsInt(time.Now().AddDate(-1, 0, 0)) {
+		log.Printf("Date %d is too new, not qualified for unembargo.", date)
+		return fmt.Errorf("%w: %d", ErrNotEligibleYet, date)
 	}
 
 	f, err := os.OpenFile("UnembargoLogfile", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -155,21 +172,17 @@ func (nc *UnembargoConfig) Unembargo(date int) error {
 
 	log.SetOutput(f)
 
-	if date <= FormatDateAsInt(time.Now().AddDate(-1, 0, 0)) {
-		dateStr := strconv.Itoa(date)
-		inputDir := "sidestream/" + dateStr[0:4] + "/" + dateStr[4:6] + "/" + dateStr[6:8]
-		return UnEmbargoOneDayLegacyFiles(nc.privateBucket, nc.publicBucket, inputDir)
-	}
-	log.Printf("Date %d is too new, not qualified for unembargo.", date)
-	return fmt.Errorf("Date is too new, not qualified for unembargo.")
+	dateStr := strconv.Itoa(date)
+	inputDir := "sidestream/" + dateStr[0:4] + "/" + dateStr[4:6] + "/" + dateStr[6:8]
+	return UnEmbargoOneDayLegacyFiles(ctx, nc.privateBucket, nc.publicBucket, inputDir)
 }
 
-func UnembargoCron(date int) error {
+func UnembargoCron(ctx context.Context, date int) error {
 	project := os.Getenv("GCLOUD_PROJECT")
 	log.Printf("current project: %s", project)
 	privateBucketName := "embargo-" + project
 	publicBucketName := "archive-" + project
 
 	uc := NewUnembargoConfig(privateBucketName, publicBucketName)
-	return uc.Unembargo(date)
+	return uc.Unembargo(ctx, date)
 }
@@ -1,6 +1,7 @@
 package embargo_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/m-lab/etl-embargo"
@@ -12,16 +13,16 @@ func TestUnembargoLegacy(t *testing.T) {
 	publicBucket := "bigstore-data-mlab-testing"
 	testConfig := embargo.NewUnembargoConfig(privateBucket, publicBucket)
 	// Prepare the buckets for input & output.
-	embargo.DeleteFiles(privateBucket, "")
-	embargo.UploadFile(privateBucket, "testdata/20160102T000000Z-mlab3-sin01-sidestream-0000.tgz", "sidestream/2016/01/02/")
-	embargo.DeleteFiles(publicBucket, "")
-	if testConfig.Unembargo(20160102) != nil {
+	embargo.DeleteFiles(context.Background(), privateBucket, "")
+	embargo.UploadFile(context.Background(), privateBucket, "testdata/20160102T000000Z-mlab3-sin01-sidestream-0000.tgz", "sidestream/2016/01/02/")
+	embargo.DeleteFiles(context.Background(), publicBucket, "")
+	if testConfig.Unembargo(context.Background(), 20160102) != nil {
 		t.Errorf("Unembargo func did not return true.")
 		return
 	}
 
 	// Check the publicBucket has that file
-	publicNames := embargo.GetFileNamesFromBucket(publicBucket)
+	publicNames := embargo.GetFileNamesFromBucket(context.Background(), publicBucket)
 	if len(publicNames) != 1 || publicNames[0] != "sidestream/2016/01/02/20160102T000000Z-mlab3-sin01-sidestream-0000.tgz" {
 		t.Errorf("The public bucket does not have the new copy.\n")
 	}
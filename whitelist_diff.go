@@ -0,0 +1,253 @@
+// Diffs of the whitelist grouped by site, and the approval of the reloads
+// that remove whole sites, which would embargo all their data at once.
+package embargo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ErrWhitelistNotApproved means a new whitelist removes whole sites and its
+// checksum was not approved.
+var ErrWhitelistNotApproved = errors.New("whitelist change not approved")
+
+// unknownSite groups the IPs whose hostname is not known.
+const unknownSite = "unknown"
+
+// SiteOf returns the site of an M-Lab hostname, like "sea03" for
+// mlab1.sea03.measurement-lab.org or mlab1-sea03.mlab-oti.measurement-lab.org,
+// or "" if hostname has no site.
+func SiteOf(hostname string) string {
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return ""
+	}
+	if i := strings.Index(labels[0], "-"); i >= 0 {
+		return labels[0][i+1:]
+	}
+	return labels[1]
+}
+
+// SiteDiff is the change of the whitelisted IPs of one site.
+type SiteDiff struct {
+	Site      string   `json:"site"`
+	Hostnames []string `json:"hostnames"`
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	// Before and After are the numbers of IPs of the site in the current
+	// and the candidate lists.
+	Before int `json:"before"`
+	After  int `json:"after"`
+}
+
+// WhitelistDiff compares the whitelist in use with a candidate.
+type WhitelistDiff struct {
+	// Added and Removed are the IPs added and removed by the candidate.
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// Sites are the sites that change, sorted.
+	Sites []*SiteDiff `json:"sites"`
+	// RemovedSites are the sites the candidate removes entirely.
+	RemovedSites []string `json:"removed_sites"`
+	// Checksum is the checksum of the candidate, to approve it.
+	Checksum string `json:"checksum"`
+	// NeedsApproval is true if reloading the candidate requires its
+	// checksum to be approved.
+	NeedsApproval bool `json:"needs_approval"`
+}
+
+// DiffSites compares wc with candidate, grouping the IPs by the site of
+// their hostname, or their site annotation, in either list.
+func (wc *WhitelistChecker) DiffSites(candidate *WhitelistChecker) *WhitelistDiff {
+	diff := &WhitelistDiff{RemovedSites: []string{}, Sites: []*SiteDiff{}, Checksum: candidate.Checksum}
+	diff.Added, diff.Removed = wc.Diff(candidate)
+
+	hostname := func(ip string) string {
+		if h, ok := candidate.Hostnames[ip]; ok {
+			return h
+		}
+		return wc.Hostnames[ip]
+	}
+	sites := make(map[string]*SiteDiff)
+	site := func(ip string) *SiteDiff {
+		name := SiteOf(hostname(ip))
+		if name == "" {
+			name = candidate.Sites[ip]
+		}
+		if name == "" {
+			name = wc.Sites[ip]
+		}
+		if name == "" {
+			name = unknownSite
+		}
+		if sites[name] == nil {
+			sites[name] = &SiteDiff{Site: name, Hostnames: []string{}, Added: []string{}, Removed: []string{}}
+		}
+		return sites[name]
+	}
+	for ip := range wc.keys() {
+		site(ip).Before++
+	}
+	for ip := range candidate.keys() {
+		site(ip).After++
+	}
+	for _, ip := range diff.Added {
+		site(ip).Added = append(site(ip).Added, ip)
+	}
+	for _, ip := range diff.Removed {
+		site(ip).Removed = append(site(ip).Removed, ip)
+	}
+
+	for _, s := range sites {
+		if len(s.Added) == 0 && len(s.Removed) == 0 {
+			continue
+		}
+		hostnames := make(map[string]struct{})
+		for _, ip := range append(append([]string{}, s.Added...), s.Removed...) {
+			if h := hostname(ip); h != "" {
+				hostnames[h] = struct{}{}
+			}
+		}
+		s.Hostnames = sortedKeys(hostnames)
+		diff.Sites = append(diff.Sites, s)
+		if s.Before > 0 && s.After == 0 {
+			diff.RemovedSites = append(diff.RemovedSites, s.Site)
+		}
+	}
+	sort.Slice(diff.Sites, func(i, j int) bool { return diff.Sites[i].Site < diff.Sites[j].Site })
+	sort.Strings(diff.RemovedSites)
+	return diff
+}
+
+// SetWhitelistSource sets where ReloadWhitelist loads the whitelist from, a
+// URL or a local file.
+func (ec *EmbargoConfig) SetWhitelistSource(source string) {
+	if isURL(source) {
+		ec.siteIPURL, ec.siteIPFile = source, ""
+	} else {
+		ec.siteIPFile = source
+	}
+}
+
+// isURL reports whether source is an http(s) URL rather than a file.
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// SetWhitelistApproval makes ReloadWhitelist keep the whitelist in use if
+// the new one removes whole sites, unless its checksum is approved. When no
+// whitelist is in use yet, the new one is compared with the last approved
+// one, kept in the whitelist cache, so restarts are blocked too. Only the
+// very first load, without a cache, needs no approval.
+func (ec *EmbargoConfig) SetWhitelistApproval(required bool, approved string) {
+	ec.whitelistApprovalRequired = required
+	ec.whitelistApproved = approved
+}
+
+// needsApproval reports whether the candidate of diff, against base, cannot
+// be used without approval.
+func (ec *EmbargoConfig) needsApproval(base *WhitelistChecker, diff *WhitelistDiff) bool {
+	return ec.whitelistApprovalRequired && len(base.keys()) > 0 &&
+		len(diff.RemovedSites) > 0 && diff.Checksum != ec.whitelistApproved
+}
+
+// approvedWhitelist returns the whitelist the candidates are compared with:
+// the one in use, or, if there is none yet, the last approved one from the
+// cache. It is empty if there is neither.
+func (ec *EmbargoConfig) approvedWhitelist(ctx context.Context) *WhitelistChecker {
+	if inUse := ec.Whitelist(); len(inUse.keys()) > 0 || ec.whitelistCache == nil {
+		return inUse
+	}
+	cached, err := ec.whitelistCache.Load(ctx)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Cannot load the approved whitelist: %v\n", err)
+		}
+		return new(WhitelistChecker)
+	}
+	approved, err := cached.checker()
+	if err != nil {
+		log.Printf("Cannot parse the approved whitelist: %v\n", err)
+		return new(WhitelistChecker)
+	}
+	return approved
+}
+
+// fetchWhitelist reads a whitelist from source, a URL or a local file, or
+// from where the whitelist in use was loaded if source is empty. It changes
+// neither the whitelist loader nor the cache.
+func (ec *EmbargoConfig) fetchWhitelist(ctx context.Context, source string) (*CachedWhitelist, *WhitelistChecker, error) {
+	var (
+		fetched *CachedWhitelist
+		err     error
+	)
+	switch {
+	case source == "" && ec.siteIPFile == "":
+		fetched, err = ec.urlLoader().Fetch(ctx)
+	case source == "":
+		source = ec.siteIPFile
+		fetched, err = readWhitelistFile(source)
+	case isURL(source):
+		fetched, err = NewWhitelistLoader(source, nil).Fetch(ctx)
+	default:
+		fetched, err = readWhitelistFile(source)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	candidate, err := fetched.checker()
+	if err != nil && fetched.Format == FormatLocal {
+		return nil, nil, fmt.Errorf("%s: %v", source, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return fetched, candidate, nil
+}
+
+// DiffWhitelist loads a candidate whitelist from source, a URL or a local
+// file, or from where the whitelist in use was loaded if source is empty,
+// and compares it with the whitelist in use, or the last approved one. It
+// changes nothing.
+func (ec *EmbargoConfig) DiffWhitelist(source string) (*WhitelistDiff, error) {
+	ec.reloadMu.Lock()
+	defer ec.reloadMu.Unlock()
+	ctx := context.Background()
+	_, candidate, err := ec.fetchWhitelist(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	base := ec.approvedWhitelist(ctx)
+	diff := base.DiffSites(candidate)
+	diff.NeedsApproval = ec.needsApproval(base, diff)
+	return diff, nil
+}
+
+// approve returns ErrWhitelistNotApproved if the candidate of diff, against
+// base, needs approval.
+func (ec *EmbargoConfig) approve(base *WhitelistChecker, diff *WhitelistDiff) error {
+	if !ec.needsApproval(base, diff) {
+		return nil
+	}
+	return fmt.Errorf("%w: it removes sites %s, approve checksum %s",
+		ErrWhitelistNotApproved, strings.Join(diff.RemovedSites, ", "), diff.Checksum)
+}
+
+// acceptWhitelist records fetched, once approved, as the accepted whitelist:
+// in the loader, which caches it, or in the cache for local files.
+func (ec *EmbargoConfig) acceptWhitelist(ctx context.Context, fetched *CachedWhitelist) {
+	if ec.siteIPFile == "" {
+		ec.urlLoader().Accept(ctx, fetched)
+		return
+	}
+	if ec.whitelistCache != nil {
+		if err := ec.whitelistCache.Save(ctx, fetched); err != nil {
+			log.Printf("Cannot cache the whitelist: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package embargo_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+const (
+	// Sites acc02 and sea03, with one samknows machine.
+	hostIPs = `[
+  {"hostname": "mlab1.acc02.measurement-lab.org", "ipv4": "196.49.14.201", "ipv6": ""},
+  {"hostname": "mlab2.samknows.acc02.measurement-lab.org", "ipv4": "196.49.14.214", "ipv6": ""},
+  {"hostname": "mlab3.acc02.measurement-lab.org", "ipv4": "196.49.14.227", "ipv6": ""},
+  {"hostname": "mlab3.sea03.measurement-lab.org", "ipv4": "4.71.210.211", "ipv6": "2001:4c08:2003:2::148"}
+]`
+	// Without sea03 and with a new machine at acc02.
+	hostIPsShrunk = `[
+  {"hostname": "mlab1.acc02.measurement-lab.org", "ipv4": "196.49.14.201", "ipv6": ""},
+  {"hostname": "mlab3.acc02.measurement-lab.org", "ipv4": "196.49.14.227", "ipv6": ""},
+  {"hostname": "mlab4-acc02.mlab-oti.measurement-lab.org", "ipv4": "196.49.14.240", "ipv6": ""}
+]`
+)
+
+// hostIPsServer serves hostIPs, or hostIPsShrunk once *shrunk is true.
+func hostIPsServer(shrunk *bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *shrunk {
+			w.Write([]byte(hostIPsShrunk))
+			return
+		}
+		w.Write([]byte(hostIPs))
+	}))
+}
+
+func TestSiteOf(t *testing.T) {
+	for hostname, want := range map[string]string{
+		"mlab1.acc02.measurement-lab.org":          "acc02",
+		"mlab1-acc02.mlab-oti.measurement-lab.org": "acc02",
+		"localhost": "",
+		"":          "",
+	} {
+		if got := embargo.SiteOf(hostname); got != want {
+			t.Errorf("SiteOf(%q) = %q, want %q", hostname, got, want)
+		}
+	}
+}
+
+func TestDiffSites(t *testing.T) {
+	shrunk := false
+	ts := hostIPsServer(&shrunk)
+	defer ts.Close()
+	var current, candidate embargo.WhitelistChecker
+	if err := current.LoadFromURL(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	shrunk = true
+	if err := candidate.LoadFromURL(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if current.Checksum == "" || current.Checksum == candidate.Checksum {
+		t.Errorf("checksums %q and %q", current.Checksum, candidate.Checksum)
+	}
+
+	diff := current.DiffSites(&candidate)
+	want := &embargo.WhitelistDiff{
+		Added:   []string{"196.49.14.240"},
+		Removed: []string{"2001:4c08:2003:2::148", "4.71.210.211"},
+		Sites: []*embargo.SiteDiff{{
+			Site:      "acc02",
+			Hostnames: []string{"mlab4-acc02.mlab-oti.measurement-lab.org"},
+			Added:     []string{"196.49.14.240"},
+			Removed:   []string{},
+			Before:    2,
+			After:     3,
+		}, {
+			Site:      "sea03",
+			Hostnames: []string{"mlab3.sea03.measurement-lab.org"},
+			Added:     []string{},
+			Removed:   []string{"2001:4c08:2003:2::148", "4.71.210.211"},
+			Before:    2,
+			After:     0,
+		}},
+		RemovedSites: []string{"sea03"},
+		Checksum:     candidate.Checksum,
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("DiffSites() = %+v, want %+v", diff, want)
+	}
+}
+
+func TestReloadWhitelistApproval(t *testing.T) {
+	shrunk := false
+	ts := hostIPsServer(&shrunk)
+	defer ts.Close()
+
+	ec := embargo.NewEmbargoConfig("", "", "", embargo.WhitelistChecker{}, nil)
+	ec.SetWhitelistSource(ts.URL)
+	ec.SetWhitelistApproval(true, "")
+	// The first load needs no approval.
+	if err := ec.ReloadWhitelist(); err != nil {
+		t.Fatal(err)
+	}
+	shrunk = true
+	diff, err := ec.DiffWhitelist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.NeedsApproval {
+		t.Error("removing sea03 does not need approval")
+	}
+	if err := ec.ReloadWhitelist(); !errors.Is(err, embargo.ErrWhitelistNotApproved) {
+		t.Errorf("ReloadWhitelist() = %v, want ErrWhitelistNotApproved", err)
+	}
+	if !ec.Whitelist().CheckIP("4.71.210.211") {
+		t.Error("the unapproved whitelist was loaded")
+	}
+
+	ec.SetWhitelistApproval(true, diff.Checksum)
+	if err := ec.ReloadWhitelist(); err != nil {
+		t.Fatal(err)
+	}
+	if ec.Whitelist().CheckIP("4.71.210.211") || !ec.Whitelist().CheckIP("196.49.14.240") {
+		t.Error("the approved whitelist was not loaded")
+	}
+
+	// A candidate from a file, without hostnames.
+	diff, err = ec.DiffWhitelist("testdata/whitelist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.RemovedSites) != 1 || diff.RemovedSites[0] != "acc02" || len(diff.Sites) != 2 || diff.Sites[1].Site != "unknown" {
+		t.Errorf("DiffWhitelist(file) = %+v", diff)
+	}
+}
+
+func TestDiffWhitelistReadOnly(t *testing.T) {
+	shrunk, failing := false, false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case failing:
+			w.WriteHeader(http.StatusInternalServerError)
+		case shrunk:
+			w.Write([]byte(hostIPsShrunk))
+		default:
+			w.Write([]byte(hostIPs))
+		}
+	}))
+	defer ts.Close()
+	cache := embargo.NewFileWhitelistCache(filepath.Join(t.TempDir(), "whitelist.json"))
+
+	ec := embargo.NewEmbargoConfig("", "", "", embargo.WhitelistChecker{}, nil)
+	ec.SetWhitelistSource(ts.URL)
+	ec.SetWhitelistCache(cache)
+	ec.SetWhitelistApproval(true, "")
+	if err := ec.ReloadWhitelist(); err != nil {
+		t.Fatal(err)
+	}
+	approved := ec.Whitelist().Checksum
+
+	shrunk = true
+	diff, err := ec.DiffWhitelist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.NeedsApproval {
+		t.Error("removing sea03 does not need approval")
+	}
+	cached, err := cache.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cached.Body) != hostIPs {
+		t.Error("DiffWhitelist() cached the unapproved whitelist")
+	}
+	if err := ec.ReloadWhitelist(); !errors.Is(err, embargo.ErrWhitelistNotApproved) {
+		t.Fatalf("ReloadWhitelist() = %v, want ErrWhitelistNotApproved", err)
+	}
+	// The fallback is the approved list, not the unapproved one.
+	failing = true
+	if err := ec.ReloadWhitelist(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ec.Whitelist().Checksum; got != approved {
+		t.Errorf("fallback whitelist %s, want the approved %s", got, approved)
+	}
+}
+
+func TestReloadWhitelistApprovalNetworks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "whitelist")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("196.49.14.0/26 site=acc02\n4.71.210.0/24 site=sea03\n")
+	ec := embargo.NewEmbargoConfig("", "", "", embargo.WhitelistChecker{}, nil)
+	ec.SetWhitelistSource(path)
+	ec.SetWhitelistApproval(true, "")
+	if err := ec.ReloadWhitelist(); err != nil {
+		t.Fatal(err)
+	}
+	write("196.49.14.0/26 site=acc02\n")
+	if err := ec.ReloadWhitelist(); !errors.Is(err, embargo.ErrWhitelistNotApproved) {
+		t.Errorf("ReloadWhitelist() = %v, want ErrWhitelistNotApproved", err)
+	}
+	if !ec.Whitelist().CheckIP("4.71.210.211") {
+		t.Error("the unapproved whitelist of networks was loaded")
+	}
+}
+
+func TestReloadWhitelistWhileSplitting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client_networks")
+	if err := ioutil.WriteFile(path, []byte("203.0.113.0/24 embargo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ec := embargo.NewEmbargoConfig("", "", "", embargo.WhitelistChecker{}, nil)
+	ec.SetWhitelistSource("testdata/whitelist")
+	ec.SetClientNetworksSource(path)
+	if err := ec.ReloadWhitelist(); err != nil {
+		t.Fatal(err)
+	}
+	const public = "20170315T05:00:00Z_213.244.128.144_0.web100"
+	input := makeTgz(t, gzip.BestSpeed, map[string]string{public: snapshot("213.244.128.144", "198.51.100.1")}, public)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if err := ec.ReloadWhitelist(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, _, err := ec.SplitFile(context.Background(), bytes.NewReader(input), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
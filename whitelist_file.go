@@ -0,0 +1,186 @@
+// The format of the local whitelist: one IP or network per line, with
+// optional annotations and comments.
+package embargo
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// whitelistDate is the format of the valid-from and valid-until dates.
+const whitelistDate = "2006-01-02"
+
+// WhitelistEntry is a network, or an IP valid for some dates only, of a
+// local whitelist.
+type WhitelistEntry struct {
+	Network *net.IPNet
+	Site    string
+	Reason  string
+	// ValidFrom and ValidUntil are the first and last days the entry is
+	// valid, or zero if it is valid since or until forever.
+	ValidFrom  time.Time
+	ValidUntil time.Time
+}
+
+// Key returns the IP, or the network, of e.
+func (e *WhitelistEntry) Key() string {
+	if ones, bits := e.Network.Mask.Size(); ones == bits {
+		return e.Network.IP.String()
+	}
+	return e.Network.String()
+}
+
+// validOn reports whether e is valid on day.
+func (e *WhitelistEntry) validOn(day time.Time) bool {
+	if !e.ValidFrom.IsZero() && day.Before(e.ValidFrom) {
+		return false
+	}
+	return e.ValidUntil.IsZero() || day.Before(e.ValidUntil.AddDate(0, 0, 1))
+}
+
+// ParseWhitelist parses a local whitelist. Each line is an IP or a network,
+// followed by optional annotations, like
+//
+//	196.49.14.0/26 site=acc02 reason="new site" valid-from=2017-03-01 valid-until=2017-12-31
+//
+// Values with spaces are quoted. IPv6 addresses are normalized like the IPs
+// of the file names. Blank lines and everything after "#" are skipped.
+func ParseWhitelist(r io.Reader) (*WhitelistChecker, error) {
+	wc := &WhitelistChecker{EmbargoWhiteList: make(map[string]struct{})}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields, err := splitWhitelistLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		entry, ip, err := parseWhitelistEntry(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		key := entry.Key()
+		if ip != "" && entry.ValidFrom.IsZero() && entry.ValidUntil.IsZero() {
+			key = ip
+			wc.EmbargoWhiteList[key] = struct{}{}
+		} else {
+			wc.Entries = append(wc.Entries, *entry)
+		}
+		if entry.Site != "" {
+			if wc.Sites == nil {
+				wc.Sites = make(map[string]string)
+			}
+			wc.Sites[key] = entry.Site
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return wc, nil
+}
+
+// splitWhitelistLine splits line into its fields, keeping the quoted values
+// whole, and drops the comment.
+func splitWhitelistLine(line string) ([]string, error) {
+	var (
+		fields []string
+		field  strings.Builder
+		quoted bool
+	)
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+			field.WriteRune(c)
+		case c == '#':
+			return appendField(fields, &field), nil
+		case c == ' ' || c == '\t':
+			fields = appendField(fields, &field)
+		default:
+			field.WriteRune(c)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+	return appendField(fields, &field), nil
+}
+
+// appendField appends field to fields, if not empty, and resets it.
+func appendField(fields []string, field *strings.Builder) []string {
+	if field.Len() == 0 {
+		return fields
+	}
+	fields = append(fields, field.String())
+	field.Reset()
+	return fields
+}
+
+// parseWhitelistEntry parses the IP or network and the annotations of a
+// line. It also returns the normalized IP, if the line has an IP.
+func parseWhitelistEntry(fields []string) (*WhitelistEntry, string, error) {
+	network, ip, err := parseNetwork(fields[0])
+	if err != nil {
+		return nil, "", err
+	}
+	entry := &WhitelistEntry{Network: network}
+	for _, field := range fields[1:] {
+		i := strings.Index(field, "=")
+		if i < 0 {
+			return nil, "", fmt.Errorf("want key=value, got %q", field)
+		}
+		key, value := field[:i], field[i+1:]
+		switch key {
+		case "site":
+			entry.Site = value
+		case "reason":
+			entry.Reason = value
+		case "valid-from", "valid-until":
+			day, err := time.Parse(whitelistDate, value)
+			if err != nil {
+				return nil, "", fmt.Errorf("bad %s date %q, want YYYY-MM-DD", key, value)
+			}
+			if key == "valid-from" {
+				entry.ValidFrom = day
+			} else {
+				entry.ValidUntil = day
+			}
+		default:
+			return nil, "", fmt.Errorf("unknown annotation %q", key)
+		}
+	}
+	if !entry.ValidFrom.IsZero() && !entry.ValidUntil.IsZero() && entry.ValidUntil.Before(entry.ValidFrom) {
+		return nil, "", fmt.Errorf("valid-until %s before valid-from %s",
+			entry.ValidUntil.Format(whitelistDate), entry.ValidFrom.Format(whitelistDate))
+	}
+	return entry, ip, nil
+}
+
+// readWhitelistFile reads the local whitelist at path, without parsing it.
+func readWhitelistFile(path string) (*CachedWhitelist, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedWhitelist{Body: body, Format: FormatLocal, Validated: time.Now().UTC()}, nil
+}
+
+// readWhitelist parses the whitelist of r and sets its checksum.
+func readWhitelist(r io.Reader) (*WhitelistChecker, error) {
+	hash := sha256.New()
+	wc, err := ParseWhitelist(io.TeeReader(r, hash))
+	if err != nil {
+		return nil, err
+	}
+	wc.Checksum = hex.EncodeToString(hash.Sum(nil))
+	return wc, nil
+}
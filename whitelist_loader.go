@@ -0,0 +1,386 @@
+// Fetching of the whitelist from its URL, with a cache of the last valid
+// list to fall back to when the URL cannot be fetched, even at startup.
+package embargo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl-embargo/metrics"
+)
+
+const (
+	// whitelistTimeout bounds the fetch of the whitelist and the client
+	// networks.
+	whitelistTimeout = 30 * time.Second
+	// maxWhitelistSize bounds the size of the whitelist and the client
+	// networks.
+	maxWhitelistSize = 16 << 20
+)
+
+// listClient downloads the whitelist and the client networks.
+var listClient = &http.Client{Timeout: whitelistTimeout}
+
+// WhitelistCacheName and ClientNetworksCacheName are the default names, in
+// the private bucket, of the caches of the whitelist and the client networks.
+const (
+	WhitelistCacheName      = "cache/mlab-host-ips.json"
+	ClientNetworksCacheName = "cache/client-networks.txt"
+)
+
+// Formats of a CachedWhitelist.
+const (
+	// FormatHostIPs is the JSON list of hosts of the whitelist URLs.
+	FormatHostIPs = ""
+	// FormatLocal is the local whitelist format of ParseWhitelist.
+	FormatLocal = "local"
+	// FormatClientNetworks is the format of ParseClientNetworks, for the
+	// cache of the client networks.
+	FormatClientNetworks = "client-networks"
+)
+
+// CachedWhitelist is a whitelist that was fetched and validated.
+type CachedWhitelist struct {
+	Body         []byte    `json:"body"`
+	Format       string    `json:"format,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Validated    time.Time `json:"validated"`
+}
+
+// checker returns the whitelist of c.
+func (c *CachedWhitelist) checker() (*WhitelistChecker, error) {
+	if c.Format == FormatLocal {
+		return readWhitelist(bytes.NewReader(c.Body))
+	}
+	ips, hostnames, err := filterSites(c.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &WhitelistChecker{EmbargoWhiteList: ips, Hostnames: hostnames, Checksum: checksum(c.Body)}, nil
+}
+
+// WhitelistCache persists the accepted whitelist, which is also the last
+// approved one, see SetWhitelistApproval.
+type WhitelistCache interface {
+	// Load returns the cached whitelist, or an error matching
+	// os.ErrNotExist if there is none.
+	Load(ctx context.Context) (*CachedWhitelist, error)
+	Save(ctx context.Context, c *CachedWhitelist) error
+}
+
+// fileCache caches the whitelist in a local file.
+type fileCache struct {
+	path string
+}
+
+// NewFileWhitelistCache returns a WhitelistCache writing to the local file
+// path.
+func NewFileWhitelistCache(path string) WhitelistCache {
+	return &fileCache{path: path}
+}
+
+func (fc *fileCache) Load(ctx context.Context) (*CachedWhitelist, error) {
+	content, err := ioutil.ReadFile(fc.path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(CachedWhitelist)
+	if err := json.Unmarshal(content, c); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", fc.path, err)
+	}
+	return c, nil
+}
+
+// Save replaces the file at once, so that it is never partly written.
+func (fc *fileCache) Save(ctx context.Context, c *CachedWhitelist) error {
+	content, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fc.path), filepath.Base(fc.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fc.path)
+}
+
+// bucketCache caches the whitelist in an object.
+type bucketCache struct {
+	store        ObjectStore
+	bucket, name string
+}
+
+// NewBucketWhitelistCache returns a WhitelistCache writing to the object
+// name of bucket.
+func NewBucketWhitelistCache(store ObjectStore, bucket, name string) WhitelistCache {
+	return &bucketCache{store: store, bucket: bucket, name: name}
+}
+
+func (bc *bucketCache) Load(ctx context.Context) (*CachedWhitelist, error) {
+	content, err := bc.store.ReadObject(ctx, bc.bucket, bc.name)
+	if ClassifyError(err) == ClassNotFound {
+		return nil, fmt.Errorf("gs://%s/%s: %w", bc.bucket, bc.name, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, storageError("read", bc.bucket, bc.name, err)
+	}
+	c := new(CachedWhitelist)
+	if err := json.Unmarshal(content, c); err != nil {
+		return nil, fmt.Errorf("cannot parse gs://%s/%s: %v", bc.bucket, bc.name, err)
+	}
+	return c, nil
+}
+
+func (bc *bucketCache) Save(ctx context.Context, c *CachedWhitelist) error {
+	content, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := bc.store.WriteObject(ctx, bc.bucket, bc.name, content, "application/json"); err != nil {
+		return storageError("write", bc.bucket, bc.name, err)
+	}
+	return nil
+}
+
+// WhitelistLoader fetches the whitelist from a URL. It only downloads the
+// list again if it changed since the accepted list, and falls back to the
+// accepted list when the URL cannot be fetched or returns an invalid list.
+type WhitelistLoader struct {
+	url    string
+	client *http.Client
+	cache  WhitelistCache
+
+	mu sync.Mutex
+	// last is the accepted list, from the URL or the cache.
+	last  *CachedWhitelist
+	stale bool
+}
+
+// NewWhitelistLoader returns a loader of the whitelist at url, keeping the
+// accepted list in cache if it is not nil.
+func NewWhitelistLoader(url string, cache WhitelistCache) *WhitelistLoader {
+	return &WhitelistLoader{url: url, client: listClient, cache: cache}
+}
+
+// Load fetches the whitelist and accepts it. If it cannot be fetched, or is
+// invalid, the accepted list is returned instead, and Stale reports true.
+// Load only fails if there is no such list.
+func (l *WhitelistLoader) Load(ctx context.Context) (*WhitelistChecker, error) {
+	fetched, err := l.Fetch(ctx)
+	if err == nil {
+		l.Accept(ctx, fetched)
+		return fetched.checker()
+	}
+	accepted := l.Fallback(ctx)
+	if accepted == nil {
+		return nil, err
+	}
+	return accepted.checker()
+}
+
+// Fetch returns the whitelist at the URL, or the accepted list if it did not
+// change. It changes neither the accepted list nor the cache, so that the
+// list can be checked before it is accepted.
+func (l *WhitelistLoader) Fetch(ctx context.Context) (*CachedWhitelist, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loadCache(ctx)
+	fetched, result, err := l.fetch(ctx)
+	metrics.WhitelistFetchesTotal.WithLabelValues(result).Inc()
+	if err != nil {
+		log.Printf("Cannot fetch the whitelist from %s: %v\n", l.url, err)
+		return nil, err
+	}
+	return fetched, nil
+}
+
+// Accept makes c, returned by Fetch, the accepted list, and caches it.
+func (l *WhitelistLoader) Accept(ctx context.Context, c *CachedWhitelist) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last, l.stale = c, false
+	if l.cache != nil {
+		if err := l.cache.Save(ctx, c); err != nil {
+			log.Printf("Cannot cache the whitelist: %v\n", err)
+		}
+	}
+}
+
+// Fallback returns the accepted list, from memory or the cache, and makes
+// Stale report true. It returns nil if there is no accepted list.
+func (l *WhitelistLoader) Fallback(ctx context.Context) *CachedWhitelist {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loadCache(ctx)
+	if l.last == nil {
+		return nil
+	}
+	log.Printf("Using the whitelist validated at %s.\n", l.last.Validated.Format(time.RFC3339))
+	l.stale = true
+	return l.last
+}
+
+// loadCache sets l.last from the cache, if not set yet.
+func (l *WhitelistLoader) loadCache(ctx context.Context) {
+	if l.last != nil || l.cache == nil {
+		return
+	}
+	cached, err := l.cache.Load(ctx)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Cannot load the cached whitelist: %v\n", err)
+		}
+		return
+	}
+	l.last = cached
+}
+
+// Stale reports whether the whitelist in use is the accepted list returned
+// by Fallback rather than a fetched one.
+func (l *WhitelistLoader) Stale() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stale
+}
+
+// Validated returns when the accepted list was fetched or confirmed
+// unchanged, or the zero time if there is none.
+func (l *WhitelistLoader) Validated() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last == nil {
+		return time.Time{}
+	}
+	return l.last.Validated
+}
+
+// fetch gets the list, unless it did not change since l.last. It returns
+// the result for the fetch metric: "fetched", "not_modified" or "failed".
+func (l *WhitelistLoader) fetch(ctx context.Context) (*CachedWhitelist, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url, nil)
+	if err != nil {
+		return nil, "failed", err
+	}
+	if l.last != nil {
+		if l.last.ETag != "" {
+			req.Header.Set("If-None-Match", l.last.ETag)
+		}
+		if l.last.LastModified != "" {
+			req.Header.Set("If-Modified-Since", l.last.LastModified)
+		}
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, "failed", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && l.last != nil:
+		unchanged := *l.last
+		unchanged.Validated = time.Now().UTC()
+		return &unchanged, "not_modified", nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, "failed", fmt.Errorf("GET %s: %s", l.url, resp.Status)
+	}
+	body, err := readList(resp)
+	if err != nil {
+		return nil, "failed", err
+	}
+	ips, _, err := filterSites(body)
+	if err != nil {
+		return nil, "failed", err
+	}
+	if len(ips) == 0 {
+		return nil, "failed", errors.New("empty whitelist")
+	}
+	return &CachedWhitelist{
+		Body:         body,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Validated:    time.Now().UTC(),
+	}, "fetched", nil
+}
+
+// readList reads the body of a list downloaded with listClient, like the
+// whitelist or the client networks. It accepts JSON and plain text, but not,
+// for example, the HTML error page of a proxy, and at most maxWhitelistSize
+// bytes.
+func readList(resp *http.Response) ([]byte, error) {
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("bad content type %q: %v", contentType, err)
+	}
+	if mediaType != "application/json" && mediaType != "text/plain" && !strings.HasSuffix(mediaType, "+json") {
+		return nil, fmt.Errorf("unexpected content type %q", mediaType)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxWhitelistSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxWhitelistSize {
+		return nil, fmt.Errorf("list larger than %d bytes", maxWhitelistSize)
+	}
+	return body, nil
+}
+
+// SetWhitelistCache sets where the accepted whitelist is cached, to fall
+// back to when the URL fails and to check the approval of the first load.
+func (ec *EmbargoConfig) SetWhitelistCache(cache WhitelistCache) {
+	ec.whitelistCache = cache
+	ec.whitelistLoader = nil
+}
+
+// urlLoader returns the loader of the whitelist at siteIPURL.
+func (ec *EmbargoConfig) urlLoader() *WhitelistLoader {
+	if ec.whitelistLoader == nil || ec.whitelistLoader.url != ec.siteIPURL {
+		ec.whitelistLoader = NewWhitelistLoader(ec.siteIPURL, ec.whitelistCache)
+	}
+	return ec.whitelistLoader
+}
+
+// cacheFromEnv returns the cache named by the environment variable env:
+// gs://bucket/name, a local file, or by default name in the private bucket.
+func (ec *EmbargoConfig) cacheFromEnv(env, name string) WhitelistCache {
+	source := os.Getenv(env)
+	switch {
+	case source == "":
+		return NewBucketWhitelistCache(ec.store, ec.destPrivateBucket, name)
+	case strings.HasPrefix(source, "gs://"):
+		bucket, name := splitGCSURL(source)
+		return NewBucketWhitelistCache(ec.store, bucket, name)
+	}
+	return NewFileWhitelistCache(source)
+}
+
+// splitGCSURL returns the bucket and the object name of gs://bucket/name.
+func splitGCSURL(url string) (bucket, name string) {
+	path := strings.TrimPrefix(url, "gs://")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
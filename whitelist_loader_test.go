@@ -0,0 +1,116 @@
+package embargo_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	embargo "github.com/m-lab/etl-embargo"
+)
+
+// whitelistServer serves hostIPs with an ETag, or the given status and
+// content type if status is not 200. It counts the requests answered with
+// 304 Not Modified.
+type whitelistServer struct {
+	status      int
+	contentType string
+	notModified int
+}
+
+func (ws *whitelistServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ws.status != http.StatusOK {
+		w.WriteHeader(ws.status)
+		return
+	}
+	if r.Header.Get("If-None-Match") == `"v1"` {
+		ws.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", `"v1"`)
+	w.Header().Set("Content-Type", ws.contentType)
+	w.Write([]byte(hostIPs))
+}
+
+func TestWhitelistLoader(t *testing.T) {
+	ws := &whitelistServer{status: http.StatusOK, contentType: "application/json"}
+	ts := httptest.NewServer(ws)
+	defer ts.Close()
+	ctx := context.Background()
+	cache := embargo.NewFileWhitelistCache(filepath.Join(t.TempDir(), "whitelist.json"))
+
+	l := embargo.NewWhitelistLoader(ts.URL, cache)
+	first, err := l.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.CheckIP("4.71.210.211") || l.Stale() || l.Validated().IsZero() {
+		t.Errorf("Load() = %v, stale %v, validated %v", first.EmbargoWhiteList, l.Stale(), l.Validated())
+	}
+	again, err := l.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.notModified != 1 || again.Checksum != first.Checksum {
+		t.Errorf("second Load() got %d 304s, checksum %q", ws.notModified, again.Checksum)
+	}
+
+	// The last valid list is used when the URL fails.
+	ws.status = http.StatusInternalServerError
+	stale, err := l.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Stale() || stale.Checksum != first.Checksum {
+		t.Errorf("Load() after failure: stale %v, checksum %q", l.Stale(), stale.Checksum)
+	}
+
+	// A new loader, as at startup, falls back to the cache.
+	restarted, err := embargo.NewWhitelistLoader(ts.URL, cache).Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Checksum != first.Checksum {
+		t.Errorf("Load() from cache: checksum %q, want %q", restarted.Checksum, first.Checksum)
+	}
+	// And fails without one.
+	if _, err := embargo.NewWhitelistLoader(ts.URL, nil).Load(ctx); err == nil {
+		t.Error("Load() without cache succeeded after a 500")
+	}
+}
+
+func TestWhitelistLoaderRejects(t *testing.T) {
+	for _, ws := range []*whitelistServer{
+		{status: http.StatusNotFound},
+		{status: http.StatusOK, contentType: "text/html; charset=utf-8"},
+	} {
+		ts := httptest.NewServer(ws)
+		var wc embargo.WhitelistChecker
+		if err := wc.LoadFromURL(ts.URL); err == nil {
+			t.Errorf("LoadFromURL() with status %d and type %q succeeded", ws.status, ws.contentType)
+		}
+		ts.Close()
+	}
+}
+
+func TestBucketWhitelistCache(t *testing.T) {
+	ctx := context.Background()
+	fs := newFakeStore()
+	cache := embargo.NewBucketWhitelistCache(fs, "embargo", embargo.WhitelistCacheName)
+	if _, err := cache.Load(ctx); err == nil {
+		t.Fatal("Load() of a missing cache succeeded")
+	}
+	want := &embargo.CachedWhitelist{Body: []byte(hostIPs), ETag: `"v1"`}
+	if err := cache.Save(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := cache.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Body) != hostIPs || got.ETag != want.ETag {
+		t.Errorf("Load() = %+v, want %+v", got, want)
+	}
+}